@@ -0,0 +1,41 @@
+package application
+
+import (
+	"github.com/actionpay/postmanq/common"
+	"github.com/actionpay/postmanq/mailer"
+)
+
+// приложение, создающее ключи dkim и проверяющее их DNS записи
+type Dkim struct {
+	Abstract
+}
+
+// создает новое приложение
+func NewDkim() common.Application {
+	return new(Dkim)
+}
+
+// запускает приложение с аргументами
+func (d *Dkim) RunWithArgs(args ...interface{}) {
+	common.App = d
+	d.services = []interface{}{
+		mailer.Inst(),
+	}
+
+	event := common.NewApplicationEvent(common.InitApplicationEventKind)
+	event.Args = make(map[string]interface{})
+	event.Args["action"] = args[0]
+	event.Args["domain"] = args[1]
+	event.Args["selector"] = args[2]
+	event.Args["type"] = args[3]
+	event.Args["bits"] = args[4]
+	event.Args["output"] = args[5]
+
+	d.run(d, event)
+}
+
+// запускает сервисы приложения
+func (d *Dkim) FireRun(event *common.ApplicationEvent, abstractService interface{}) {
+	service := abstractService.(common.DkimService)
+	go service.OnDkim(event)
+}
@@ -0,0 +1,39 @@
+package application
+
+import (
+	"github.com/actionpay/postmanq/common"
+	"github.com/actionpay/postmanq/guardian"
+)
+
+// приложение, управляющее списком подавления
+type Suppress struct {
+	Abstract
+}
+
+// создает новое приложение
+func NewSuppress() common.Application {
+	return new(Suppress)
+}
+
+// запускает приложение с аргументами
+func (s *Suppress) RunWithArgs(args ...interface{}) {
+	common.App = s
+	s.services = []interface{}{
+		guardian.Inst(),
+	}
+
+	event := common.NewApplicationEvent(common.InitApplicationEventKind)
+	event.Args = make(map[string]interface{})
+	event.Args["action"] = args[0]
+	event.Args["pattern"] = args[1]
+	event.Args["reason"] = args[2]
+	event.Args["timeout"] = args[3]
+
+	s.run(s, event)
+}
+
+// запускает сервисы приложения
+func (s *Suppress) FireRun(event *common.ApplicationEvent, abstractService interface{}) {
+	service := abstractService.(common.SuppressService)
+	go service.OnSuppress(event)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/actionpay/postmanq/application"
+	"github.com/actionpay/postmanq/common"
+)
+
+func main() {
+	var file, action, domain, selector, keyType, output string
+	var bits int
+	flag.StringVar(&file, "f", common.ExampleConfigYaml, "configuration yaml file")
+	flag.StringVar(&action, "a", "check", "action - check|generate")
+	flag.StringVar(&domain, "d", common.InvalidInputString, "postman domain, necessary for generate")
+	flag.StringVar(&selector, "s", common.InvalidInputString, "dkim selector, necessary for generate")
+	flag.StringVar(&keyType, "t", "rsa", "key type - rsa|ed25519")
+	flag.IntVar(&bits, "b", 2048, "rsa key size")
+	flag.StringVar(&output, "o", common.InvalidInputString, "private key file, necessary for generate")
+	flag.Parse()
+
+	app := application.NewDkim()
+	isValidGenerate := domain != common.InvalidInputString && selector != common.InvalidInputString && output != common.InvalidInputString
+	if app.IsValidConfigFilename(file) && (action == "check" || action == "generate" && isValidGenerate) {
+		app.SetConfigFilename(file)
+		app.RunWithArgs(action, domain, selector, keyType, bits, output)
+	} else {
+		fmt.Println("Usage: pmq-dkim -f [-a] [-d] [-s] [-t] [-b] [-o]")
+		flag.VisitAll(common.PrintUsage)
+		fmt.Println("Example:")
+		fmt.Printf("  pmq-dkim -f %s\n", common.ExampleConfigYaml)
+		fmt.Printf("  pmq-dkim -f %s -d example.com\n", common.ExampleConfigYaml)
+		fmt.Printf("  pmq-dkim -f %s -a generate -d example.com -s mail2025 -o /path/to/private/key_rsa2\n", common.ExampleConfigYaml)
+		fmt.Printf("  pmq-dkim -f %s -a generate -d example.com -s ed2025 -t ed25519 -o /path/to/private/key_ed25519\n", common.ExampleConfigYaml)
+	}
+}
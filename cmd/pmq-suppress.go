@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/actionpay/postmanq/application"
+	"github.com/actionpay/postmanq/common"
+	"time"
+)
+
+func main() {
+	var file, action, pattern, reason string
+	var timeout time.Duration
+	flag.StringVar(&file, "f", common.ExampleConfigYaml, "configuration yaml file")
+	flag.StringVar(&action, "a", "list", "action - list|check|add|remove")
+	flag.StringVar(&pattern, "p", common.InvalidInputString, "address, domain, *.domain, wildcard or re:regexp, necessary for check, add and remove")
+	flag.StringVar(&reason, "r", "manual", "reason of suppression")
+	flag.DurationVar(&timeout, "t", 0, "suppression lifetime, by default suppression never expires")
+	flag.Parse()
+
+	app := application.NewSuppress()
+	if app.IsValidConfigFilename(file) && (action == "list" || pattern != common.InvalidInputString) {
+		app.SetConfigFilename(file)
+		app.RunWithArgs(action, pattern, reason, timeout)
+	} else {
+		fmt.Println("Usage: pmq-suppress -f [-a] [-p] [-r] [-t]")
+		flag.VisitAll(common.PrintUsage)
+		fmt.Println("Example:")
+		fmt.Printf("  pmq-suppress -f %s\n", common.ExampleConfigYaml)
+		fmt.Printf("  pmq-suppress -f %s -a check -p mail@example.com\n", common.ExampleConfigYaml)
+		fmt.Printf("  pmq-suppress -f %s -a add -p mail@example.com -r \"user request\"\n", common.ExampleConfigYaml)
+		fmt.Printf("  pmq-suppress -f %s -a add -p *.example.com -t 720h\n", common.ExampleConfigYaml)
+		fmt.Printf("  pmq-suppress -f %s -a add -p 're:^test\\d+@example\\.com$'\n", common.ExampleConfigYaml)
+		fmt.Printf("  pmq-suppress -f %s -a remove -p mail@example.com\n", common.ExampleConfigYaml)
+	}
+}
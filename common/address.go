@@ -0,0 +1,313 @@
+package common
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// максимальная длина локальной части адреса в байтах, RFC 5321 4.5.3.1.1
+	maxLocalPartLen = 64
+
+	// максимальная длина домена в байтах, RFC 5321 4.5.3.1.2
+	maxDomainLen = 253
+
+	// максимальная длина метки домена в байтах
+	maxLabelLen = 63
+
+	// максимальная длина адреса в байтах, RFC 5321 4.5.3.1.3 с учетом угловых скобок
+	maxAddressLen = 254
+
+	// префикс метки домена, закодированной punycode
+	punycodePrefix = "xn--"
+
+	// специальные символы, допустимые в локальной части без кавычек, RFC 5322 3.2.3
+	atextSpecials = "!#$%&'*+-/=?^_`{|}~"
+)
+
+// почтовый адрес
+type Address struct {
+	// локальная часть адреса, регистр сохраняется
+	Local string
+
+	// домен в нижнем регистре, интернациональный домен хранится в punycode
+	Domain string
+
+	// локальная часть содержит не ASCII символы, для отправки необходимо расширение SMTPUTF8
+	UTF8 bool
+}
+
+// возвращает адрес в виде local@domain
+func (a *Address) String() string {
+	return a.Local + "@" + a.Domain
+}
+
+// разбирает почтовый адрес по RFC 5321 и RFC 5322
+// принимает адрес с отображаемым именем - Name <mail@example.com>, адрес в угловых скобках и адрес без скобок
+// домен приводится к нижнему регистру, интернациональный домен кодируется в punycode
+func ParseAddress(value string) (*Address, error) {
+	address := strings.TrimSpace(value)
+	// отбрасываем отображаемое имя
+	if strings.HasSuffix(address, ">") {
+		start := strings.LastIndex(address, "<")
+		if start == -1 {
+			return nil, fmt.Errorf("invalid address %q, unbalanced angle brackets", value)
+		}
+		address = strings.TrimSpace(address[start+1 : len(address)-1])
+	}
+	if len(address) > maxAddressLen {
+		return nil, fmt.Errorf("invalid address %q, address is longer than %d bytes", value, maxAddressLen)
+	}
+	// домен не может содержать @, а локальная часть в кавычках может
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return nil, fmt.Errorf("invalid address %q, @ is not found", value)
+	}
+	utf8Local, err := parseLocalPart(address[:at])
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q, %v", value, err)
+	}
+	domain, err := ParseDomain(address[at+1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q, %v", value, err)
+	}
+	return &Address{Local: address[:at], Domain: domain, UTF8: utf8Local}, nil
+}
+
+// проверяет локальную часть адреса
+// возвращает true, если локальная часть содержит не ASCII символы
+func parseLocalPart(local string) (bool, error) {
+	if len(local) == 0 {
+		return false, fmt.Errorf("local part is empty")
+	}
+	if len(local) > maxLocalPartLen {
+		return false, fmt.Errorf("local part is longer than %d bytes", maxLocalPartLen)
+	}
+	if !utf8.ValidString(local) {
+		return false, fmt.Errorf("local part is not valid utf-8")
+	}
+	isUTF8 := false
+	if local[0] == '"' {
+		// строка в кавычках, RFC 5321 4.1.2 Quoted-string
+		if len(local) < 2 || local[len(local)-1] != '"' {
+			return false, fmt.Errorf("local part has unclosed quote")
+		}
+		for i := 1; i < len(local)-1; i++ {
+			char := local[i]
+			switch {
+			case char == '\\':
+				i++
+				if i == len(local)-1 || local[i] < 32 || local[i] > 126 {
+					return false, fmt.Errorf("local part has invalid quoted pair")
+				}
+			case char == '"':
+				return false, fmt.Errorf("local part has unescaped quote")
+			case char >= 0x80:
+				isUTF8 = true
+			case char < 32 || char > 126:
+				return false, fmt.Errorf("local part has invalid character %q", char)
+			}
+		}
+	} else {
+		// точки разделяют непустые атомы, RFC 5321 4.1.2 Dot-string
+		for _, atom := range strings.Split(local, ".") {
+			if len(atom) == 0 {
+				return false, fmt.Errorf("local part has empty atom")
+			}
+			for _, char := range atom {
+				switch {
+				case char >= 0x80:
+					isUTF8 = true
+				case 'a' <= char && char <= 'z', 'A' <= char && char <= 'Z', '0' <= char && char <= '9':
+				case strings.ContainsRune(atextSpecials, char):
+				default:
+					return false, fmt.Errorf("local part has invalid character %q", char)
+				}
+			}
+		}
+	}
+	return isUTF8, nil
+}
+
+// проверяет домен и приводит его к ASCII виду
+// домен приводится к нижнему регистру и NFKC, как при отображении UTS 46,
+// метки с не ASCII символами проверяются по RFC 5892 и кодируются в punycode, RFC 5890
+func ParseDomain(value string) (string, error) {
+	domain := strings.TrimSpace(value)
+	if !utf8.ValidString(domain) {
+		return EmptyStr, fmt.Errorf("domain %s is not valid utf-8", value)
+	}
+	// полноширинные символы и совместимые формы приводятся к обычным, регистр сравнивается после нормализации
+	domain = norm.NFKC.String(strings.ToLower(norm.NFKC.String(domain)))
+	// идеографическая точка считается разделителем меток, RFC 3490 3.1
+	domain = strings.Replace(domain, "。", ".", -1)
+	domain = strings.TrimSuffix(domain, ".")
+	if len(domain) == 0 {
+		return EmptyStr, fmt.Errorf("domain is empty")
+	}
+	if strings.HasPrefix(domain, "[") {
+		return EmptyStr, fmt.Errorf("address literal %s is not supported", value)
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return EmptyStr, fmt.Errorf("domain %s has no top level domain", value)
+	}
+	for i, label := range labels {
+		if !isASCII(label) {
+			err := checkUnicodeLabel(label)
+			if err != nil {
+				return EmptyStr, fmt.Errorf("domain %s is not valid, %v", value, err)
+			}
+			encoded, err := punycodeEncode(label)
+			if err != nil {
+				return EmptyStr, fmt.Errorf("can't encode domain %s, %v", value, err)
+			}
+			label = punycodePrefix + encoded
+			labels[i] = label
+		}
+		if len(label) == 0 || len(label) > maxLabelLen {
+			return EmptyStr, fmt.Errorf("domain %s has label with invalid length", value)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return EmptyStr, fmt.Errorf("domain %s has label starting or ending with hyphen", value)
+		}
+		for j := 0; j < len(label); j++ {
+			char := label[j]
+			if !('a' <= char && char <= 'z' || '0' <= char && char <= '9' || char == '-') {
+				return EmptyStr, fmt.Errorf("domain %s has invalid character %q", value, char)
+			}
+		}
+	}
+	if strings.Trim(labels[len(labels)-1], "0123456789") == EmptyStr {
+		return EmptyStr, fmt.Errorf("domain %s has numeric top level domain", value)
+	}
+	domain = strings.Join(labels, ".")
+	if len(domain) > maxDomainLen {
+		return EmptyStr, fmt.Errorf("domain %s is longer than %d bytes", value, maxDomainLen)
+	}
+	return domain, nil
+}
+
+// проверяет, что метка состоит из допустимых в IDNA2008 символов, RFC 5891 4.2.3
+// допускаются буквы, цифры, комбинируемые знаки и дефис, метка не может начинаться со знака
+func checkUnicodeLabel(label string) error {
+	if strings.HasPrefix(label, punycodePrefix) {
+		return fmt.Errorf("label %s has ACE prefix and not ASCII characters", label)
+	}
+	for i, char := range label {
+		if unicode.IsMark(char) {
+			if i == 0 {
+				return fmt.Errorf("label %s begins with combining mark", label)
+			}
+		} else if !(unicode.IsLetter(char) || unicode.IsDigit(char) || char == '-') {
+			return fmt.Errorf("label %s has disallowed character %q", label, char)
+		}
+	}
+	return nil
+}
+
+// проверяет, что строка состоит только из ASCII символов
+func isASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// параметры punycode, RFC 3492 5
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+// кодирует метку домена в punycode, RFC 3492 6.3
+func punycodeEncode(label string) (string, error) {
+	runes := []rune(label)
+	output := make([]byte, 0, len(label)*2)
+	for _, char := range runes {
+		if char < 0x80 {
+			output = append(output, byte(char))
+		}
+	}
+	basicLen := len(output)
+	handled := basicLen
+	if basicLen > 0 {
+		output = append(output, '-')
+	}
+	n, delta, bias := punycodeInitialN, 0, punycodeInitialBias
+	for handled < len(runes) {
+		// находим наименьший еще не обработанный символ
+		next := int(utf8.MaxRune) + 1
+		for _, char := range runes {
+			if int(char) >= n && int(char) < next {
+				next = int(char)
+			}
+		}
+		delta += (next - n) * (handled + 1)
+		if delta < 0 {
+			return EmptyStr, fmt.Errorf("punycode overflow")
+		}
+		n = next
+		for _, char := range runes {
+			if int(char) < n {
+				delta++
+			} else if int(char) == n {
+				q := delta
+				for k := punycodeBase; ; k += punycodeBase {
+					t := k - bias
+					if t < punycodeTMin {
+						t = punycodeTMin
+					} else if t > punycodeTMax {
+						t = punycodeTMax
+					}
+					if q < t {
+						break
+					}
+					output = append(output, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+					q = (q - t) / (punycodeBase - t)
+				}
+				output = append(output, punycodeDigit(q))
+				bias = punycodeAdapt(delta, handled+1, handled == basicLen)
+				delta = 0
+				handled++
+			}
+		}
+		delta++
+		n++
+	}
+	return string(output), nil
+}
+
+// адаптирует смещение, RFC 3492 6.1
+func punycodeAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+// возвращает символ цифры punycode
+func punycodeDigit(digit int) byte {
+	if digit < 26 {
+		return byte('a' + digit)
+	}
+	return byte('0' + digit - 26)
+}
@@ -0,0 +1,75 @@
+package common
+
+import "testing"
+
+func TestParseAddress(t *testing.T) {
+	ok := map[string]string{
+		"a@b.com":                    "a@b.com",
+		"User <Ivan@Example.ONLINE>": "Ivan@example.online",
+		"\"Ivan, Petrov\" <a@b.com>": "a@b.com",
+		"<a@b.com>":                  "a@b.com",
+		"\"a b@c\"@x.company":        "\"a b@c\"@x.company",
+		"\"a\\\"b\"@x.com":           "\"a\\\"b\"@x.com",
+		"ivan@münchen.de":            "ivan@xn--mnchen-3ya.de",
+		"ivan@MÜNCHEN.DE":            "ivan@xn--mnchen-3ya.de",
+		"иван@почта.рф":              "иван@xn--80a1acny.xn--p1ai",
+		"a+tag@bücher.example":       "a+tag@xn--bcher-kva.example",
+		"a@ＥＸＡＭＰＬＥ．com":              "a@example.com",
+		"a@mu\u0308nchen.de":         "a@xn--mnchen-3ya.de",
+		"a@example.com.":             "a@example.com",
+		"a@例え。テスト":                   "a@xn--r8jz45g.xn--zckzah",
+	}
+	for in, want := range ok {
+		a, err := ParseAddress(in)
+		if err != nil || a.String() != want {
+			t.Errorf("%s: %v %v", in, a, err)
+		}
+	}
+	for _, in := range []string{
+		"",
+		"a",
+		"a..b@x.com",
+		".a@x.com",
+		"@x.com",
+		"a@",
+		"a@x",
+		"a@-x.com",
+		"a@x-.com",
+		"a@x_y.com",
+		"a@[1.2.3.4]",
+		"a b@x.com",
+		"a@x.123",
+		"\"a\"b\"@x.com",
+		"User <a@b.com",
+		"a@☃.com",
+		"a@\u0308x.com",
+		"a@xn--ü.com",
+		"a@" + string([]byte{0xff}) + ".com",
+	} {
+		if a, err := ParseAddress(in); err == nil {
+			t.Errorf("%q: want error, got %v", in, a)
+		}
+	}
+	a, _ := ParseAddress("иван@x.ru")
+	if !a.UTF8 {
+		t.Error("utf8")
+	}
+}
+
+// примеры из RFC 3492 7.1
+func TestPunycodeEncode(t *testing.T) {
+	samples := map[string]string{
+		"ليهمابتكلموشعربي؟":            "egbpdaj6bu4bxfgehfvwxn",
+		"他们为什么不说中文":                    "ihqwcrb4cv8a8dqg056pqjye",
+		"他們爲什麽不說中文":                    "ihqwctvzc91f659drss3x8bo0yb",
+		"Pročprostěnemluvíčesky":       "Proprostnemluvesky-uyb24dma41a",
+		"почемужеонинеговорятпорусски": "b1abfaaepdrnnbgefbadotcwatmq2g4l",
+		"3年B組金八先生":                     "3B-ww4c5e180e575a65lsy2b",
+		"-> $1.00 <-":                  "-> $1.00 <--",
+	}
+	for in, want := range samples {
+		if out, err := punycodeEncode(in); err != nil || out != want {
+			t.Errorf("%s: want %s, got %s %v", in, want, out, err)
+		}
+	}
+}
@@ -22,6 +22,9 @@ var (
 	// объект текущего приложения, иногда необходим сервисам, для отправки событий приложению
 	App Application
 
+	// список подавления, пополняется адресами, на которые больше нельзя отправлять письма
+	Suppressions Suppressor
+
 	// сервисы, используются для создания итератора
 	Services []interface{}
 
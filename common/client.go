@@ -3,6 +3,7 @@ package common
 import (
 	"net"
 	"net/smtp"
+	"sync"
 	"time"
 )
 
@@ -21,6 +22,8 @@ const (
 )
 
 // клиент почтового сервера
+// пока клиент лежит в очереди, его статус может изменить таймер ожидания,
+// поэтому статус и таймер защищены семафором
 type SmtpClient struct {
 	// идертификатор клиента для удобства в логах
 	Id int
@@ -35,10 +38,22 @@ type SmtpClient struct {
 	ModifyDate time.Time
 
 	// статус
-	Status SmtpClientStatus
+	status SmtpClientStatus
 
 	// таймер, по истечении которого, соединение к почтовому сервису будет разорвано
 	timer *time.Timer
+
+	// семафор
+	mutex *sync.Mutex
+}
+
+// создает нового клиента
+func NewSmtpClient(id int) *SmtpClient {
+	return &SmtpClient{
+		Id:     id,
+		status: WorkingSmtpClientStatus,
+		mutex:  new(sync.Mutex),
+	}
 }
 
 // сстанавливайт таймаут на чтение и запись соединения
@@ -48,21 +63,67 @@ func (s *SmtpClient) SetTimeout(timeout time.Duration) {
 
 // переводит клиента в ожидание
 // после окончания ожидания соединение разрывается, а статус меняется на отсоединенный
+// закрытый клиент остается отсоединенным
 func (s *SmtpClient) Wait() {
-	s.Status = WaitingSmtpClientStatus
-	s.timer = time.AfterFunc(App.Timeout().Waiting, func() {
-		s.Status = DisconnectedSmtpClientStatus
+	s.mutex.Lock()
+	if s.status != DisconnectedSmtpClientStatus {
+		s.status = WaitingSmtpClientStatus
+		s.timer = time.AfterFunc(App.Timeout().Waiting, s.disconnect)
+	}
+	s.mutex.Unlock()
+}
+
+// разрывает соединение, например, после сетевой ошибки
+// соединитель переоткроет клиента, когда получит его из очереди
+func (s *SmtpClient) Close() {
+	s.mutex.Lock()
+	s.status = DisconnectedSmtpClientStatus
+	s.Conn.Close()
+	s.mutex.Unlock()
+}
+
+// разрывает соединение, если клиента так и не разбудили
+func (s *SmtpClient) disconnect() {
+	s.mutex.Lock()
+	if s.status == WaitingSmtpClientStatus {
+		s.status = DisconnectedSmtpClientStatus
 		s.Worker.Quit()
-		s.timer = nil
-	})
+	}
+	s.timer = nil
+	s.mutex.Unlock()
 }
 
 // переводит клиента в рабочее состояние
 // если клиент был в ожидании, ожидание прерывается
-func (s *SmtpClient) Wakeup() {
-	s.Status = WorkingSmtpClientStatus
+// возвращает false, если клиент уже отсоединен и его необходимо переоткрыть
+func (s *SmtpClient) Wakeup() bool {
+	s.mutex.Lock()
 	if s.timer != nil {
 		s.timer.Stop()
 		s.timer = nil
 	}
+	if s.status == WaitingSmtpClientStatus {
+		s.status = WorkingSmtpClientStatus
+	}
+	isConnected := s.status == WorkingSmtpClientStatus
+	s.mutex.Unlock()
+	return isConnected
+}
+
+// возвращает статус клиента
+func (s *SmtpClient) Status() SmtpClientStatus {
+	s.mutex.Lock()
+	status := s.status
+	s.mutex.Unlock()
+	return status
+}
+
+// переоткрывает клиента с новым соединением
+func (s *SmtpClient) Reopen(conn net.Conn, worker *smtp.Client) {
+	s.mutex.Lock()
+	s.Conn = conn
+	s.Worker = worker
+	s.ModifyDate = time.Now()
+	s.status = WorkingSmtpClientStatus
+	s.mutex.Unlock()
 }
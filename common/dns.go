@@ -0,0 +1,38 @@
+package common
+
+import (
+	"net"
+	"strings"
+)
+
+// максимальное количество переходов по MX записям при определении почтового провайдера
+const maxRealServerNameDepth = 5
+
+// определяет почтового провайдера по доменному имени MX сервера,
+// например, для gmail-smtp-in.l.google.com. провайдером будет google.com
+// используется соединителем и сервисом ограничений, чтобы объединять почтовые сервисы, обслуживаемые одним провайдером
+func RealServerName(hostname string) string {
+	return realServerName(hostname, maxRealServerNameDepth)
+}
+
+// определяет почтового провайдера, переходя по MX записям не больше depth раз,
+// т.к. MX записи доменов могут ссылаться друг на друга по кругу
+func realServerName(hostname string, depth int) string {
+	parts := strings.Split(hostname, ".")
+	partsLen := len(parts)
+	// у имени без домена второго уровня провайдер совпадает с именем
+	if partsLen < 3 {
+		return strings.TrimRight(hostname, ".")
+	}
+	hostname = strings.Join(parts[partsLen-3:partsLen-1], ".")
+	mxes, err := net.LookupMX(hostname)
+	if err == nil && len(mxes) > 0 {
+		if strings.Contains(mxes[0].Host, hostname) || depth <= 1 {
+			return hostname
+		} else {
+			return realServerName(mxes[0].Host, depth-1)
+		}
+	} else {
+		return hostname
+	}
+}
@@ -66,6 +66,12 @@ const (
 
 	// отмена отправки
 	RevokeSendEventResult
+
+	// отказ в отправке, письмо нарушает политику и перекладывается в очередь для ошибок политики
+	RejectSendEventResult
+
+	// ошибка на стороне отправителя, например, письмо не удалось подписать, письмо перекладывается в очередь для технических ошибок
+	TechnicalErrorSendEventResult
 )
 
 // событие отправки письма
@@ -85,11 +91,55 @@ type SendEvent struct {
 	// количество попыток отправок письма
 	TryCount int
 
+	// очередь, из которой получено письмо
+	Binding string
+
+	// письмо пересылается из другой системы, к нему добавляется печать ARC
+	Forwarding bool
+
 	// итератор сервисов, участвующих в отправке письма
 	Iterator *Iterator
 
 	// очередь, в которую необходимо будет положить клиента после отправки письма
 	Queue *LimitedQueue
+
+	// переключение на другой сервер почтового сервиса, если через текущий сервер письмо отправить не удалось
+	Failover Failover
+
+	// учет ответов почтового сервиса для адаптивного ограничения
+	Feedback Feedback
+
+	// ограничения, которые проверяются после выбора ip отправителя
+	AddressLimit AddressLimit
+}
+
+// ограничения, зависящие от ip отправителя
+type AddressLimit interface {
+	// проверяет ограничения для ip, с которого будет отправлено письмо
+	// возвращает false, если ограничение превышено и письмо необходимо отложить
+	Check(*SendEvent, string) bool
+
+	// возвращает жетоны, взятые при проверке, если письмо будет отправлено с другого ip
+	Release(*SendEvent)
+}
+
+// учет ответов почтового сервиса
+type Feedback interface {
+	// учитывает ответ почтового сервиса, nil означает успешную отправку
+	Respond(*SendEvent, error)
+
+	// сообщает, что отправка письма закончена, успешно или нет
+	Release()
+}
+
+// переключение на другой сервер почтового сервиса
+type Failover interface {
+	// учитывает успешную отправку письма через сервер
+	Success()
+
+	// учитывает неудачную отправку письма через сервер и передает письмо следующему серверу
+	// возвращает false, если других серверов нет и письмо необходимо вернуть в очередь
+	Failure(error) bool
 }
 
 // создает событие отправки сообщения
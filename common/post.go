@@ -1,30 +1,27 @@
 package common
 
 import (
-	"errors"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	// Максимальное количество попыток подключения к почтовику за отправку письма
-	MaxTryConnectionCount int    = 30
-	AllDomains            string = "*"
-	EmptyStr              string = ""
+	AllDomains string = "*"
+	EmptyStr   string = ""
+
+	// рекомендуемая длина строки заголовка, RFC 5322 2.1.1
+	RecommendedLineLen = 78
 )
 
 var (
-	// Регулярка для проверки адреса почты, сразу компилируем, чтобы при отправке не терять на этом время
-	EmailRegexp   = regexp.MustCompile(`^[\w\d\.\_\%\+\-]+@([\w\d\.\-]+\.\w{2,5})$`)
-	HostnameRegex = regexp.MustCompile(`^[\w\d\.\-]+\.\w{2,5}$`)
 	EmptyStrSlice = []string{}
 )
 
 // таймауты приложения
 type Timeout struct {
-	Sleep      time.Duration `yaml:"sleep"`
+	Lookup     time.Duration `yaml:"lookup"`
+	FreeClient time.Duration `yaml:"freeClient"`
 	Waiting    time.Duration `yaml:"waiting"`
 	Connection time.Duration `yaml:"connection"`
 	Hello      time.Duration `yaml:"hello"`
@@ -35,8 +32,11 @@ type Timeout struct {
 
 // инициализирует значения таймаутов по умолчанию
 func (t *Timeout) Init() {
-	if t.Sleep == 0 {
-		t.Sleep = time.Second
+	if t.Lookup == 0 {
+		t.Lookup = time.Minute
+	}
+	if t.FreeClient == 0 {
+		t.FreeClient = 30 * time.Second
 	}
 	if t.Waiting == 0 {
 		t.Waiting = 30 * time.Second
@@ -92,6 +92,10 @@ type MailMessage struct {
 	// идентификатор для логов
 	Id int64 `json:"-"`
 
+	// идентификатор письма в системе отправителя, кодируется в адрес VERP, по нему асинхронный отказ сопоставляется с письмом
+	// если не указан, создается при первой отправке письма с VERP
+	Uid string `json:"uid"`
+
 	// отправитель
 	Envelope string `json:"envelope"`
 
@@ -101,46 +105,75 @@ type MailMessage struct {
 	// тело письма
 	Body string `json:"body"`
 
+	// ссылки для отписки, https и mailto, из них создается заголовок List-Unsubscribe, необязательный параметр
+	Unsubscribe []string `json:"unsubscribe"`
+
+	// идентификатор рассылки для заголовка Feedback-ID, например campaign:customer:type, необязательный параметр
+	FeedbackId string `json:"feedbackId"`
+
+	// шаблон письма, если указан, письмо создается из шаблона, а body не указывается
+	Template string `json:"template"`
+
+	// переменные шаблона
+	Vars map[string]interface{} `json:"vars"`
+
+	// тема письма, созданного из шаблона
+	Subject string `json:"subject"`
+
+	// отправитель письма, созданного из шаблона, например Name <mail@example.com>, по умолчанию envelope
+	From string `json:"from"`
+
+	// получатель письма, созданного из шаблона, по умолчанию recipient
+	To string `json:"to"`
+
 	// домен отправителя, удобно сразу получить и использовать далее
 	HostnameFrom string `json:"-"`
 
 	// Домен получателя, удобно сразу получить и использовать далее
 	HostnameTo string `json:"-"`
 
+	// адрес отправителя или получателя содержит не ASCII символы, для отправки необходимо расширение SMTPUTF8
+	SmtpUtf8 bool `json:"-"`
+
 	// дата создания, используется в основном сервисом ограничений
 	CreatedDate time.Time `json:"-"`
 
 	// тип очереди, в которою письмо уже было отправлено после неудачной отправки, ипользуется для цепочки очередей
 	BindingType DelayedBindingType `json:"bindingType"`
 
+	// время, через которое появятся жетоны превышенного ограничения, столько письмо пролежит в отложенной очереди
+	Delay time.Duration `json:"-"`
+
 	// ошибка отправки
 	Error *MailError `json:"error"`
 }
 
 // инициализирует письмо
-func (m *MailMessage) Init() {
+// адреса отправителя и получателя проверяются и приводятся к каноническому виду
+// возвращает ошибку, если один из адресов невалидный, такое письмо отправить нельзя
+func (m *MailMessage) Init() error {
 	m.Id = time.Now().UnixNano()
 	m.CreatedDate = time.Now()
-	if hostname, err := m.getHostnameFromEmail(m.Envelope); err == nil {
-		m.HostnameFrom = hostname
-	}
-	if hostname, err := m.getHostnameFromEmail(m.Recipient); err == nil {
-		m.HostnameTo = hostname
-	}
-}
-
-// получает домен из адреса
-func (m *MailMessage) getHostnameFromEmail(email string) (string, error) {
-	matches := EmailRegexp.FindAllStringSubmatch(email, -1)
-	if len(matches) == 1 && len(matches[0]) == 2 {
-		return matches[0][1], nil
-	} else {
-		return "", errors.New("invalid email address")
+	envelope, err := ParseAddress(m.Envelope)
+	if err == nil {
+		m.Envelope = envelope.String()
+		m.HostnameFrom = envelope.Domain
+		var recipient *Address
+		recipient, err = ParseAddress(m.Recipient)
+		if err == nil {
+			m.Recipient = recipient.String()
+			m.HostnameTo = recipient.Domain
+			m.SmtpUtf8 = envelope.UTF8 || recipient.UTF8
+		}
 	}
+	return err
 }
 
 // возвращает письмо обратно в очередь после ошибки во время отправки
 func ReturnMail(event *SendEvent, err error) {
+	if event.Feedback != nil {
+		event.Feedback.Release()
+	}
 	// необходимо проверить сообщение на наличие кода ошибки
 	// обычно код идет первым
 	if err != nil {
@@ -157,14 +190,6 @@ func ReturnMail(event *SendEvent, err error) {
 		}
 	}
 
-	// если в событии уже создан клиент
-	if event.Client != nil {
-		if event.Client.Worker != nil {
-			// сбрасываем цепочку команд к почтовому сервису
-			event.Client.Worker.Reset()
-		}
-	}
-
 	// отпускаем поток получателя сообщений из очереди
 	if event.Message.Error == nil {
 		event.Result <- DelaySendEventResult
@@ -176,3 +201,59 @@ func ReturnMail(event *SendEvent, err error) {
 		}
 	}
 }
+
+// возвращает письмо, превысившее ограничение, в отложенную очередь
+// очередь должна быть указана в письме
+func OverlimitMail(event *SendEvent) {
+	if event.Feedback != nil {
+		event.Feedback.Release()
+	}
+	event.Result <- OverlimitSendEventResult
+}
+
+// отзывает письмо, письмо с причиной отзыва перекладывается в очередь для отозванных писем
+func RevokeMail(event *SendEvent, reason string) {
+	if event.Feedback != nil {
+		event.Feedback.Release()
+	}
+	event.Message.Error = &MailError{Message: reason}
+	event.Result <- RevokeSendEventResult
+}
+
+// письмо не удалось подготовить к отправке, письмо с ошибкой перекладывается в очередь для технических ошибок
+func FailMail(event *SendEvent, code int, message string) {
+	if event.Feedback != nil {
+		event.Feedback.Release()
+	}
+	event.Message.Error = &MailError{Message: message, Code: code}
+	event.Result <- TechnicalErrorSendEventResult
+}
+
+// отклоняет письмо, нарушившее политику, письмо с ошибкой перекладывается в очередь для ошибок политики
+func RejectMail(event *SendEvent, code int, message string) {
+	if event.Feedback != nil {
+		event.Feedback.Release()
+	}
+	event.Message.Error = &MailError{Message: message, Code: code}
+	event.Result <- RejectSendEventResult
+}
+
+// переносит строки заголовка длиннее limit символов по пробелам, RFC 5322 2.2.3
+// строку без пробелов перенести нельзя, она остается как есть
+func FoldHeader(header string, limit int) string {
+	lines := strings.Split(strings.TrimSuffix(header, "\r\n"), "\r\n")
+	folded := make([]string, 0, len(lines))
+	for _, line := range lines {
+		for len(line) > limit {
+			// перенос вставляется перед пробелом, пробел становится началом следующей строки
+			space := strings.LastIndexAny(line[1:limit+1], " \t") + 1
+			if space <= 0 {
+				break
+			}
+			folded = append(folded, line[:space])
+			line = line[space:]
+		}
+		folded = append(folded, line)
+	}
+	return strings.Join(folded, "\r\n") + "\r\n"
+}
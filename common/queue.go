@@ -89,16 +89,36 @@ type LimitedQueue struct {
 
 	// максимальное количество элементов, которое было в очереди
 	maxLen int
+
+	// сигнал, будит ожидающих появления элемента в очереди
+	// может быть общим для нескольких очередей
+	signal *Signal
 }
 
 // создает новую лимитированную очередь
-func NewLimitQueue() *LimitedQueue {
+// если сигнал не передан, создается новый
+func NewLimitQueue(signal *Signal) *LimitedQueue {
+	if signal == nil {
+		signal = NewSignal()
+	}
 	return &LimitedQueue{
 		Queue:  NewQueue(),
 		status: unlimitedQueueStatus,
+		signal: signal,
 	}
 }
 
+// добавляет элемент в конец очереди и будит первого ожидающего
+func (l *LimitedQueue) Push(item interface{}) {
+	l.Queue.Push(item)
+	l.signal.Notify()
+}
+
+// возвращает сигнал очереди
+func (l *LimitedQueue) Signal() *Signal {
+	return l.signal
+}
+
 // сигнализирует, что очередь имеет лимит
 func (l *LimitedQueue) HasLimit() bool {
 	l.mutex.Lock()
@@ -114,9 +134,10 @@ func (l *LimitedQueue) HasLimitOn() {
 	}
 }
 
-// снимает лимит очереди
+// снимает лимит очереди и будит ожидающих, теперь они могут создать новые элементы
 func (l *LimitedQueue) HasLimitOff() {
 	l.setStatus(unlimitedQueueStatus)
+	l.signal.Broadcast()
 }
 
 // устанавливает статус очереди
@@ -140,3 +161,21 @@ func (l *LimitedQueue) AddMaxLen() {
 	l.maxLen++
 	l.mutex.Unlock()
 }
+
+// уменьшает максимальную длину очереди
+// если элементов в очереди больше не будет, лимит снимается, и ожидающие будятся,
+// иначе они проспят до окончания ожидания, хотя уже могут создать новый элемент
+func (l *LimitedQueue) RemoveMaxLen() {
+	l.mutex.Lock()
+	if l.maxLen > 0 {
+		l.maxLen--
+	}
+	isLifted := l.maxLen == 0 && l.status == limitedQueueStatus
+	if l.maxLen == 0 {
+		l.status = unlimitedQueueStatus
+	}
+	l.mutex.Unlock()
+	if isLifted {
+		l.signal.Broadcast()
+	}
+}
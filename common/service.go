@@ -44,3 +44,24 @@ type GrepService interface {
 	Service
 	OnGrep(*ApplicationEvent)
 }
+
+// сервис, управляющий списком подавления из консоли
+type SuppressService interface {
+	Service
+	OnSuppress(*ApplicationEvent)
+}
+
+// сервис, создающий ключи dkim и проверяющий их DNS записи
+type DkimService interface {
+	Service
+	OnDkim(*ApplicationEvent)
+}
+
+// список подавления, адреса из него исключаются из рассылки
+type Suppressor interface {
+	// добавляет адрес после жесткого отказа почтового сервиса
+	SuppressBounce(string, string)
+
+	// добавляет адрес после жалобы получателя
+	SuppressComplaint(string, string)
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// сигнал о появлении свободного элемента, например, о возврате клиента в очередь
+// ожидающие не занимают горутины, а паркуются в списке, каждый сигнал будит первого из них
+// время ожидания отсчитывает таймер, а не спящая горутина
+type Signal struct {
+	// номер сигнала, увеличивается при каждом сигнале
+	generation uint64
+
+	// ожидающие в порядке очереди
+	waiters *list.List
+
+	// семафор
+	mutex *sync.Mutex
+}
+
+// ожидающий сигнала
+type signalWaiter struct {
+	// вызывается при сигнале
+	wakeup func()
+
+	// таймер окончания ожидания
+	timer *time.Timer
+}
+
+// создает новый сигнал
+func NewSignal() *Signal {
+	return &Signal{
+		waiters: list.New(),
+		mutex:   new(sync.Mutex),
+	}
+}
+
+// возвращает номер последнего сигнала
+// номер необходимо получить до проверки состояния, чтобы не пропустить сигнал
+func (s *Signal) Generation() uint64 {
+	s.mutex.Lock()
+	generation := s.generation
+	s.mutex.Unlock()
+	return generation
+}
+
+// паркует ожидающего до следующего сигнала, но не дольше указанного времени
+// если сигнал был после получения номера generation, wakeup вызывается сразу
+// вызывается ровно одна из функций: wakeup при сигнале или expire по истечении времени ожидания
+func (s *Signal) Wait(generation uint64, timeout time.Duration, wakeup, expire func()) {
+	s.mutex.Lock()
+	if s.generation != generation {
+		s.mutex.Unlock()
+		wakeup()
+		return
+	}
+	waiter := &signalWaiter{wakeup: wakeup}
+	element := s.waiters.PushBack(waiter)
+	waiter.timer = time.AfterFunc(timeout, func() {
+		s.mutex.Lock()
+		// ожидающего могли разбудить одновременно с окончанием ожидания
+		expired := element.Value != nil
+		if expired {
+			s.waiters.Remove(element)
+			element.Value = nil
+		}
+		s.mutex.Unlock()
+		if expired {
+			expire()
+		}
+	})
+	s.mutex.Unlock()
+}
+
+// будит первого ожидающего
+func (s *Signal) Notify() {
+	s.mutex.Lock()
+	s.generation++
+	var waiter *signalWaiter
+	if element := s.waiters.Front(); element != nil {
+		waiter = element.Value.(*signalWaiter)
+		s.waiters.Remove(element)
+		element.Value = nil
+		waiter.timer.Stop()
+	}
+	s.mutex.Unlock()
+	if waiter != nil {
+		waiter.wakeup()
+	}
+}
+
+// будит всех ожидающих, например, когда снят лимит и каждый из них может создать свой элемент
+func (s *Signal) Broadcast() {
+	s.mutex.Lock()
+	s.generation++
+	waiters := make([]*signalWaiter, 0, s.waiters.Len())
+	for element := s.waiters.Front(); element != nil; element = s.waiters.Front() {
+		waiter := element.Value.(*signalWaiter)
+		s.waiters.Remove(element)
+		element.Value = nil
+		waiter.timer.Stop()
+		waiters = append(waiters, waiter)
+	}
+	s.mutex.Unlock()
+	for _, waiter := range waiters {
+		waiter.wakeup()
+	}
+}
+
+// возвращает количество ожидающих
+func (s *Signal) Len() int {
+	s.mutex.Lock()
+	waitersLen := s.waiters.Len()
+	s.mutex.Unlock()
+	return waitersLen
+}
+
+// ожидает закрытия канала не дольше указанного времени
+// возвращает false, если время ожидания истекло
+func WaitSignal(ch <-chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignalWakesWaitersInOrder(t *testing.T) {
+	signal := NewSignal()
+	woken := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		id := i
+		signal.Wait(signal.Generation(), time.Minute, func() { woken <- id }, func() { t.Errorf("waiter %d expired", id) })
+	}
+	if signal.Len() != 2 {
+		t.Fatalf("expected 2 waiters, got %d", signal.Len())
+	}
+	signal.Notify()
+	if id := <-woken; id != 1 {
+		t.Fatalf("expected first waiter, got %d", id)
+	}
+	if signal.Len() != 1 {
+		t.Fatalf("expected 1 waiter, got %d", signal.Len())
+	}
+	signal.Notify()
+	if id := <-woken; id != 2 {
+		t.Fatalf("expected second waiter, got %d", id)
+	}
+}
+
+func TestSignalWakesImmediatelyAfterMissedNotify(t *testing.T) {
+	signal := NewSignal()
+	generation := signal.Generation()
+	signal.Notify()
+	woken := false
+	signal.Wait(generation, time.Minute, func() { woken = true }, func() {})
+	if !woken || signal.Len() != 0 {
+		t.Fatalf("waiter should be woken without parking")
+	}
+}
+
+func TestSignalExpires(t *testing.T) {
+	signal := NewSignal()
+	expired := make(chan bool)
+	signal.Wait(signal.Generation(), 10*time.Millisecond, func() { t.Error("waiter woken") }, func() { expired <- true })
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("waiter didn't expire")
+	}
+	if signal.Len() != 0 {
+		t.Fatalf("expired waiter should be removed")
+	}
+	// сигнал без ожидающих не должен будить истекшего
+	signal.Notify()
+}
+
+func TestSignalBroadcastWakesAllWaiters(t *testing.T) {
+	signal := NewSignal()
+	woken := make(chan int, 3)
+	for i := 1; i <= 3; i++ {
+		id := i
+		signal.Wait(signal.Generation(), time.Minute, func() { woken <- id }, func() { t.Errorf("waiter %d expired", id) })
+	}
+	generation := signal.Generation()
+	signal.Broadcast()
+	if len(woken) != 3 || signal.Len() != 0 || signal.Generation() == generation {
+		t.Fatalf("expected all waiters to be woken, got %d, left %d", len(woken), signal.Len())
+	}
+}
+
+// ожидающие будятся, когда лимит очереди снят, и не ждут окончания ожидания
+func TestLimitedQueueWakesWaitersWhenLimitRemoved(t *testing.T) {
+	queue := NewLimitQueue(nil)
+	queue.AddMaxLen()
+	queue.AddMaxLen()
+	queue.HasLimitOn()
+	woken := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		queue.Signal().Wait(queue.Signal().Generation(), time.Minute, func() { woken <- true }, func() {})
+	}
+	queue.RemoveMaxLen()
+	if len(woken) != 0 || !queue.HasLimit() {
+		t.Fatalf("waiters shouldn't be woken while queue has limit")
+	}
+	queue.RemoveMaxLen()
+	if len(woken) != 2 || queue.HasLimit() {
+		t.Fatalf("expected waiters to be woken after limit is removed, got %d", len(woken))
+	}
+}
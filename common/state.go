@@ -0,0 +1,64 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// как часто сохраняется состояние сервисов
+const StateSaveInterval = time.Minute
+
+// файл, в котором сервис хранит состояние между перезапусками в формате json
+// если путь до файла не указан, состояние не читается и не сохраняется
+type StateFile struct {
+	// путь до файла
+	Filename string
+}
+
+// создает файл состояния
+func NewStateFile(filename string) *StateFile {
+	return &StateFile{filename}
+}
+
+// читает состояние из файла
+// возвращает false, если путь не указан или файла еще нет
+// при ошибке состояние могло прочитаться частично, поэтому его необходимо создать заново
+func (s *StateFile) Load(state interface{}) (bool, error) {
+	if len(s.Filename) == 0 {
+		return false, nil
+	}
+	bytes, err := ioutil.ReadFile(s.Filename)
+	if err == nil {
+		return true, json.Unmarshal(bytes, state)
+	} else if os.IsNotExist(err) {
+		return false, nil
+	} else {
+		return false, err
+	}
+}
+
+// сохраняет состояние в файл
+// сначала пишет во временный файл, чтобы при падении не потерять предыдущее состояние
+func (s *StateFile) Save(state interface{}) error {
+	if len(s.Filename) == 0 {
+		return nil
+	}
+	bytes, err := json.Marshal(state)
+	if err == nil {
+		tmpFilename := s.Filename + ".tmp"
+		err = ioutil.WriteFile(tmpFilename, bytes, 0644)
+		if err == nil {
+			err = os.Rename(tmpFilename, s.Filename)
+		}
+	}
+	return err
+}
+
+// периодически вызывает сохранение состояния
+func (s *StateFile) Run(save func()) {
+	for range time.Tick(StateSaveInterval) {
+		save()
+	}
+}
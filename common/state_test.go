@@ -0,0 +1,47 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateFileSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postmanq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := NewStateFile(filepath.Join(dir, "state.json"))
+
+	states := make(map[string]int)
+	if ok, err := file.Load(&states); ok || err != nil {
+		t.Fatalf("missing file should be skipped, got %v, %v", ok, err)
+	}
+	if err := file.Save(map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file.Filename + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file should be renamed")
+	}
+	if ok, err := file.Load(&states); !ok || err != nil || states["a"] != 1 {
+		t.Fatalf("expected saved state, got %v, %v, %v", states, ok, err)
+	}
+
+	ioutil.WriteFile(file.Filename, []byte("{"), 0644)
+	if _, err := file.Load(&states); err == nil {
+		t.Fatalf("expected error for broken state")
+	}
+}
+
+func TestStateFileWithoutFilename(t *testing.T) {
+	file := NewStateFile(EmptyStr)
+	if err := file.Save(1); err != nil {
+		t.Fatal(err)
+	}
+	var state int
+	if ok, err := file.Load(&state); ok || err != nil {
+		t.Fatalf("state without filename should be skipped")
+	}
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// префикс адреса для отказов по умолчанию
+	defaultVerpPrefix = "bounces"
+
+	// длина подписи адреса в байтах, в адрес подпись записывается в hex
+	verpTagLen = 5
+)
+
+// настройки VERP, адреса отправителя, в котором закодированы письмо и получатель
+// асинхронный отказ приходит на такой адрес, и по нему можно найти письмо, на которое пришел отказ
+type VerpConfig struct {
+	// префикс локальной части адреса, по умолчанию bounces
+	Prefix string `yaml:"prefix"`
+
+	// домен адреса, на его MX сервер приходят отказы, по умолчанию домен отправителя
+	Domain string `yaml:"domain"`
+
+	// секрет, которым подписывается адрес, чтобы отказ на адрес, созданный не PostmanQ, не подавил получателя
+	Secret string `yaml:"secret"`
+}
+
+// адрес VERP, разобранный на составляющие
+type VerpAddress struct {
+	// идентификатор письма
+	Uid string
+
+	// получатель письма, может отсутствовать, если адрес получателя не поместился в адрес
+	Recipient string
+}
+
+// проверяет настройки и задает значения по умолчанию
+func (v *VerpConfig) Init(hostname string) error {
+	if len(v.Prefix) == 0 {
+		v.Prefix = defaultVerpPrefix
+	}
+	if len(v.Domain) == 0 {
+		v.Domain = hostname
+	}
+	if len(v.Secret) == 0 {
+		return fmt.Errorf("verp secret should be defined")
+	}
+	domain, err := ParseDomain(v.Domain)
+	if err == nil {
+		v.Domain = domain
+		if strings.ContainsAny(v.Prefix, "+=@") || !isVerpUid(v.Prefix) {
+			err = fmt.Errorf("verp prefix %s should contain only letters, digits, dots, hyphens and underscores", v.Prefix)
+		}
+	}
+	return err
+}
+
+// кодирует идентификатор письма и получателя в адрес вида prefix+uid=tag=local=domain@verp.domain, tag - подпись uid и получателя
+// если адрес получателя не помещается в локальную часть, кодируется только идентификатор - prefix+uid=tag@verp.domain
+func (v *VerpConfig) Encode(uid, recipient string) (string, error) {
+	if !isVerpUid(uid) {
+		return EmptyStr, fmt.Errorf("verp uid %s should contain only letters, digits, dots, hyphens and underscores", uid)
+	}
+	short := fmt.Sprintf("%s+%s=%s@%s", v.Prefix, uid, v.tag(uid, EmptyStr), v.Domain)
+	if _, err := ParseAddress(short); err != nil {
+		return EmptyStr, err
+	}
+	address, err := ParseAddress(recipient)
+	if err != nil {
+		return short, nil
+	}
+	full := fmt.Sprintf("%s+%s=%s=%s=%s@%s", v.Prefix, uid, v.tag(uid, address.String()), address.Local, address.Domain, v.Domain)
+	if _, err := ParseAddress(full); err == nil && strings.Index(full, "@") <= maxLocalPartLen {
+		return full, nil
+	}
+	return short, nil
+}
+
+// подписывает идентификатор письма и получателя секретом, как SRS, RFC 2104
+// регистр не учитывается, т.к. почтовые серверы могут изменить регистр адреса
+func (v *VerpConfig) tag(uid, recipient string) string {
+	mac := hmac.New(sha256.New, []byte(v.Secret))
+	mac.Write([]byte(strings.ToLower(uid + "=" + recipient)))
+	return hex.EncodeToString(mac.Sum(nil)[:verpTagLen])
+}
+
+// разбирает адрес VERP
+// возвращает ошибку, если адрес не является адресом VERP отправителя или подпись адреса не совпадает
+func (v *VerpConfig) Decode(value string) (*VerpAddress, error) {
+	address, err := ParseAddress(value)
+	if err != nil {
+		return nil, err
+	}
+	prefix := v.Prefix + "+"
+	if address.Domain != v.Domain || !strings.HasPrefix(address.Local, prefix) {
+		return nil, fmt.Errorf("%s is not verp address", value)
+	}
+	// идентификатор и подпись не содержат =, а домен получателя не может содержать =
+	parts := strings.SplitN(address.Local[len(prefix):], "=", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%s has no verp tag", value)
+	}
+	verp := &VerpAddress{Uid: parts[0]}
+	if !isVerpUid(verp.Uid) {
+		return nil, fmt.Errorf("%s has invalid verp uid", value)
+	}
+	if len(parts) == 3 {
+		last := strings.LastIndex(parts[2], "=")
+		if last == -1 {
+			return nil, fmt.Errorf("%s has invalid verp recipient", value)
+		}
+		recipient, err := ParseAddress(parts[2][:last] + "@" + parts[2][last+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s has invalid verp recipient, %v", value, err)
+		}
+		verp.Recipient = recipient.String()
+	}
+	if !hmac.Equal([]byte(strings.ToLower(parts[1])), []byte(v.tag(verp.Uid, verp.Recipient))) {
+		return nil, fmt.Errorf("%s has invalid verp tag", value)
+	}
+	return verp, nil
+}
+
+// проверяет, что идентификатор можно поместить в локальную часть адреса без экранирования
+func isVerpUid(uid string) bool {
+	if len(uid) == 0 {
+		return false
+	}
+	for _, char := range uid {
+		if !('a' <= char && char <= 'z' || 'A' <= char && char <= 'Z' || '0' <= char && char <= '9' || char == '.' || char == '-' || char == '_') {
+			return false
+		}
+	}
+	return true
+}
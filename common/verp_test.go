@@ -0,0 +1,78 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerp(t *testing.T) {
+	v := &VerpConfig{Domain: "Bounce.Example.com", Secret: "secret"}
+	if err := v.Init("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	a, err := v.Encode("k3x9", "john.doe+tag@Mail.ru")
+	tag := v.tag("k3x9", "john.doe+tag@mail.ru")
+	if err != nil || a != "bounces+k3x9="+tag+"=john.doe+tag=mail.ru@bounce.example.com" {
+		t.Fatal(a, err)
+	}
+	d, err := v.Decode("<" + strings.ToUpper(a[:7]) + a[7:] + ">")
+	if err == nil {
+		t.Fatal("prefix is case sensitive", d)
+	}
+	d, err = v.Decode(a)
+	if err != nil || d.Uid != "k3x9" || d.Recipient != "john.doe+tag@mail.ru" {
+		t.Fatal(d, err)
+	}
+	// почтовый сервер может изменить регистр адреса
+	if d, err = v.Decode(strings.Replace(a, tag, strings.ToUpper(tag), 1)); err != nil || d.Uid != "k3x9" {
+		t.Fatal(d, err)
+	}
+	a, _ = v.Encode("k3x9", strings.Repeat("x", 60)+"@mail.ru")
+	if a != "bounces+k3x9="+v.tag("k3x9", "")+"@bounce.example.com" {
+		t.Fatal(a)
+	}
+	d, _ = v.Decode(a)
+	if d.Uid != "k3x9" || d.Recipient != "" {
+		t.Fatal(d)
+	}
+	a, _ = v.Encode("1", "a=b@x.ru")
+	if d, _ = v.Decode(a); d.Recipient != "a=b@x.ru" {
+		t.Fatal(a, d)
+	}
+	if _, err = v.Encode("a b", "a@b.ru"); err == nil {
+		t.Fatal("bad uid")
+	}
+	if _, err = v.Decode("bounces+1@other.com"); err == nil {
+		t.Fatal("other domain")
+	}
+	if _, err = v.Decode("postmaster@bounce.example.com"); err == nil {
+		t.Fatal("not verp")
+	}
+}
+
+func TestVerpTag(t *testing.T) {
+	v := &VerpConfig{Secret: "secret"}
+	if err := v.Init("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := v.Encode("k3x9", "john@mail.ru")
+	for _, forged := range []string{
+		"bounces+k3x9@example.com",
+		"bounces+k3x9=john=mail.ru@example.com",
+		strings.Replace(a, "john", "jane", 1),
+		strings.Replace(a, "k3x9", "k3x8", 1),
+		"bounces+k3x9=" + v.tag("k3x9", "") + "=jane=mail.ru@example.com",
+	} {
+		if d, err := v.Decode(forged); err == nil {
+			t.Errorf("%s: forged address is decoded - %v", forged, d)
+		}
+	}
+	other := &VerpConfig{Secret: "other"}
+	other.Init("example.com")
+	if d, err := other.Decode(a); err == nil {
+		t.Fatal("address with other secret is decoded", d)
+	}
+	if err := (&VerpConfig{}).Init("example.com"); err == nil {
+		t.Fatal("empty secret")
+	}
+}
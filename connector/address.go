@@ -0,0 +1,127 @@
+package connector
+
+import (
+	"fmt"
+	"github.com/actionpay/postmanq/common"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// формат даты начала прогрева
+const warmupDateLayout = "2006-01-02"
+
+// ip, с которого рассылаются письма
+// в настройках может быть указан строкой или объектом
+//
+//	ips: [1.1.1.1, {ip: 2.2.2.2, weight: 2, helo: mail2.example.com}]
+type Address struct {
+	// ip
+	IP string `yaml:"ip"`
+
+	// имя, которым представляемся почтовым сервисам при отправке с ip, должно совпадать с PTR записью ip
+	Helo string `yaml:"helo"`
+
+	// вес ip, используется взвешенной стратегией, по умолчанию 1
+	Weight int `yaml:"weight"`
+
+	// прогрев ip, используется стратегией прогрева
+	Warmup *Warmup `yaml:"warmup"`
+}
+
+// разбирает ip из настроек
+func (a *Address) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var ip string
+	err := unmarshal(&ip)
+	if err == nil {
+		a.IP = ip
+	} else {
+		type plainAddress Address
+		err = unmarshal((*plainAddress)(a))
+	}
+	if err == nil && a.Weight <= 0 {
+		a.Weight = 1
+	}
+	return err
+}
+
+// прогрев ip
+// количество писем в сутки растет от начального до конечного в течение заданного количества дней,
+// после окончания прогрева ограничение снимается
+type Warmup struct {
+	// дата начала прогрева в формате 2006-01-02
+	Start string `yaml:"start"`
+
+	// количество дней прогрева
+	Days int `yaml:"days"`
+
+	// количество писем в сутки в первый день прогрева
+	Initial int64 `yaml:"initial"`
+
+	// количество писем в сутки, к которому приходит прогрев
+	Target int64 `yaml:"target"`
+
+	// дата начала прогрева
+	startDate time.Time
+}
+
+// инициализирует прогрев
+func (w *Warmup) init() error {
+	var err error
+	w.startDate, err = time.ParseInLocation(warmupDateLayout, w.Start, time.Local)
+	if w.Initial <= 0 {
+		w.Initial = 1
+	}
+	if w.Target < w.Initial {
+		w.Target = w.Initial
+	}
+	return err
+}
+
+// возвращает количество писем, которое можно отправить с ip за сутки
+// после окончания прогрева ограничения нет и возвращается -1
+// количество растет экспоненциально, т.к. почтовые сервисы лучше относятся к плавному удвоению объемов
+func (w *Warmup) quota(now time.Time) int64 {
+	day := int(now.Sub(w.startDate).Hours() / 24)
+	if day < 0 {
+		return 0
+	} else if day >= w.Days {
+		return -1
+	} else {
+		growth := float64(w.Target) / float64(w.Initial)
+		return int64(float64(w.Initial) * math.Pow(growth, float64(day)/float64(w.Days)))
+	}
+}
+
+// проверяет, что PTR запись ip указывает на имя, а имя резолвится в ip
+// возвращает описание несоответствия или пустую строку
+func (a *Address) verifyPtr(helo string) string {
+	names, err := net.LookupAddr(a.IP)
+	if err == nil {
+		for _, name := range names {
+			if strings.EqualFold(strings.TrimRight(name, "."), helo) {
+				return a.verifyForward(helo)
+			}
+		}
+		return fmt.Sprintf("ptr of %s points to %v, not to %s", a.IP, names, helo)
+	} else {
+		return fmt.Sprintf("can't lookup ptr for %s, error - %v", a.IP, err)
+	}
+}
+
+// проверяет, что имя резолвится в ip
+func (a *Address) verifyForward(helo string) string {
+	ips, err := net.LookupIP(helo)
+	if err == nil {
+		ip := net.ParseIP(a.IP)
+		for _, heloIP := range ips {
+			if heloIP.Equal(ip) {
+				return common.EmptyStr
+			}
+		}
+		return fmt.Sprintf("%s resolves to %v, not to %s", helo, ips, a.IP)
+	} else {
+		return fmt.Sprintf("can't lookup %s, error - %v", helo, err)
+	}
+}
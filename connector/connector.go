@@ -12,6 +12,9 @@ import (
 
 var (
 	connectorEvents = make(chan *ConnectionEvent)
+
+	// порт, на котором почтовые сервисы принимают письма
+	smtpPort = "25"
 )
 
 // соединитель, устанавливает соединение к почтовому сервису
@@ -41,59 +44,152 @@ func (c *Connector) connect(event *ConnectionEvent) {
 receiveConnect:
 	event.TryCount++
 	var targetClient *common.SmtpClient
+	// номер сигнала получаем до поиска клиента,
+	// иначе можно пропустить возврат клиента в очередь, пока смотрим очереди
+	signal := event.server.signal(event.address)
+	var generation uint64
+	if signal != nil {
+		generation = signal.Generation()
+	}
+	// признак того, что у почтового сервиса есть занятые клиенты, которые вернутся в очередь
+	hasBusyClients := false
+
+	now := time.Now()
 
-	// смотрим все mx сервера почтового сервиса
-	for _, mxServer := range event.server.mxServers {
+	// смотрим все mx сервера почтового сервиса в порядке приоритета
+	for _, mxServer := range sortMxServers(event.server.getMxServers(), event.family) {
+		// сервер, через который письмо не удалось отправить в этой попытке, пропускаем
+		if event.failedMxServers[mxServer] {
+			continue
+		}
+		// сервер без адреса выбранного семейства пропускаем, соединиться с ним по этому семейству нельзя,
+		// и неудачей сервера это не считается
+		if !mxServer.hasFamily(event.family) {
+			logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d skip mx server %s without %s address", c.id, event.Message.Id, mxServer.hostname, event.family)
+			continue
+		}
+		// очереди создаются по ip отправителя при поиске сервера, без очереди клиента не получить
+		queue, ok := mxServer.queues[event.address]
+		if !ok {
+			logger.By(event.Message.HostnameFrom).Warn("connector#%d-%d mx server %s has no queue for %s", c.id, event.Message.Id, mxServer.hostname, event.address)
+			continue
+		}
+		event.Queue = queue
+		// разомкнутый сервер пропускаем до окончания паузы
+		isAvailable, isProbe := mxServer.acquire(event.family, now)
+		if !isAvailable {
+			logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d skip unhealthy mx server %s", c.id, event.Message.Id, mxServer.hostname)
+			continue
+		}
 		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d try receive connection for %s", c.id, event.Message.Id, mxServer.hostname)
 
 		// пробуем получить клиента
-		event.Queue, _ = mxServer.queues[event.address]
 		client := event.Queue.Pop()
+		isConnected := false
 		if client != nil {
 			targetClient = client.(*common.SmtpClient)
+			// будим клиента сразу, чтобы таймер ожидания не разорвал соединение,
+			// пока клиент используется
+			isConnected = targetClient.Wakeup()
 			logger.By(event.Message.HostnameFrom).Debug("connector%d-%d found free smtp client#%d", c.id, event.Message.Id, targetClient.Id)
 		}
 
 		// создаем новое соединение к почтовому сервису
 		// если не удалось найти клиента
 		// или клиент разорвал соединение
-		if (targetClient == nil && !event.Queue.HasLimit()) ||
-			(targetClient != nil && targetClient.Status == common.DisconnectedSmtpClientStatus) {
+		if (targetClient == nil && !event.Queue.HasLimit()) || (targetClient != nil && !isConnected) {
 			logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d can't find free smtp client for %s", c.id, event.Message.Id, mxServer.hostname)
 			c.createSmtpClient(mxServer, event, &targetClient)
+			// если не удалось переоткрыть клиента, забываем о нем,
+			// очередь должна знать, что клиентов стало меньше
+			if targetClient != nil && !isConnected && targetClient.Status() == common.DisconnectedSmtpClientStatus {
+				event.Queue.RemoveMaxLen()
+				targetClient = nil
+			}
+		}
+
+		// пробная попытка расходуется, только если письмо действительно пойдет через сервер
+		if isProbe {
+			if targetClient == nil {
+				mxServer.cancelProbe(event.family)
+			} else {
+				mxServer.startProbe(event.family, now)
+			}
 		}
 
 		if targetClient != nil {
+			event.mxServer = mxServer
 			break
 		}
+		if event.Queue.HasLimit() {
+			hasBusyClients = true
+		}
 	}
 
 	// если клиент не создан, значит мы создали максимум соединений к почтовому сервису
 	if targetClient == nil {
-		// приостановим работу горутины
 		goto waitConnect
 	} else {
-		targetClient.Wakeup()
 		event.Client = targetClient
+		// отправитель сообщит, удалось ли отправить письмо через сервер
+		event.Failover = event
 		// передаем событие отправителю
 		event.Iterator.Next().(common.SendingService).Events() <- event.SendEvent
 	}
 	return
 
 waitConnect:
-	if event.TryCount >= common.MaxTryConnectionCount {
-		common.ReturnMail(
-			event.SendEvent,
-			errors.New(fmt.Sprintf("connector#%d can't connect to %s", c.id, event.Message.HostnameTo)),
-		)
-	} else {
+	// если занятых клиентов нет, то и ждать нечего
+	if hasBusyClients && signal != nil {
+		if event.deadline.IsZero() {
+			event.deadline = time.Now().Add(common.App.Timeout().FreeClient)
+		}
 		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d can't find free connections, wait...", c.id, event.Message.Id)
-		time.Sleep(common.App.Timeout().Sleep)
-		goto receiveConnect
+		// событие паркуется в сигнале, чтобы соединитель мог обрабатывать другие письма
+		c.wait(event, signal, generation)
+	} else {
+		// письмо не будет отправлено с выбранного ip, поэтому жетоны его ограничений возвращаются
+		event.releaseAddressLimit()
+		if event.nextFamily() {
+			// если не удалось установить соединение по одному семейству адресов, пробуем другое
+			logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d fall back to %s address %s", c.id, event.Message.Id, event.family, event.address)
+			if event.checkAddressLimit() {
+				goto receiveConnect
+			} else {
+				common.OverlimitMail(event.SendEvent)
+			}
+		} else {
+			common.ReturnMail(
+				event.SendEvent,
+				errors.New(fmt.Sprintf("connector#%d can't connect to %s", c.id, event.Message.HostnameTo)),
+			)
+		}
 	}
 	return
 }
 
+// паркует событие до возврата клиента в очередь, после чего поиск клиента повторяется
+// если клиент не вернулся до крайнего срока, письмо возвращается в очередь
+func (c *Connector) wait(event *ConnectionEvent, signal *common.Signal, generation uint64) {
+	signal.Wait(
+		generation,
+		event.deadline.Sub(time.Now()),
+		func() {
+			logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d smtp client returned to queue, retry", c.id, event.Message.Id)
+			// будит тот, кто вернул клиента, он не должен ждать соединителя
+			go func() {
+				connectorEvents <- event
+			}()
+		},
+		func() {
+			common.ReturnMail(
+				event.SendEvent,
+				errors.New(fmt.Sprintf("connector#%d can't wait free connection to %s", c.id, event.Message.HostnameTo)),
+			)
+		},
+	)
+}
+
 // создает соединение к почтовому сервису
 func (c *Connector) createSmtpClient(mxServer *MxServer, event *ConnectionEvent, ptrSmtpClient **common.SmtpClient) {
 	// устанавливаем ip, с которого бцдем отсылать письмо
@@ -104,31 +200,35 @@ func (c *Connector) createSmtpClient(mxServer *MxServer, event *ConnectionEvent,
 			Timeout:   common.App.Timeout().Connection,
 			LocalAddr: tcpAddr,
 		}
-		hostname := net.JoinHostPort(mxServer.hostname, "25")
+		hostname := net.JoinHostPort(mxServer.hostname, smtpPort)
 		// создаем соединение к почтовому сервису
-		connection, err := dialer.Dial("tcp", hostname)
+		connection, err := dialer.Dial(event.family.network(), hostname)
 		if err == nil {
 			logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d connect to %s", c.id, event.Message.Id, hostname)
 			connection.SetDeadline(time.Now().Add(common.App.Timeout().Hello))
 			client, err := smtp.NewClient(connection, mxServer.hostname)
 			if err == nil {
 				logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d create client to %s", c.id, event.Message.Id, mxServer.hostname)
-				err = client.Hello(service.getHostname(event.Message.HostnameFrom))
+				err = client.Hello(service.getHostname(event.Message.HostnameFrom, event.address))
 				if err == nil {
 					logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d send command HELLO: %s", c.id, event.Message.Id, event.Message.HostnameFrom)
 					// проверяем доступно ли TLS
-					if mxServer.useTLS {
-						mxServer.useTLS, _ = client.Extension("STARTTLS")
+					if mxServer.isUseTLS() {
+						if hasTLS, _ := client.Extension("STARTTLS"); !hasTLS {
+							mxServer.dontUseTLS()
+						}
 					}
-					logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d use TLS %v", c.id, event.Message.Id, mxServer.useTLS)
+					useTLS := mxServer.isUseTLS()
+					logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d use TLS %v", c.id, event.Message.Id, useTLS)
 					// создаем TLS или обычное соединение
-					if mxServer.useTLS {
+					if useTLS {
 						c.initTlsSmtpClient(mxServer, event, ptrSmtpClient, connection, client)
 					} else {
 						c.initSmtpClient(mxServer, event, ptrSmtpClient, connection, client)
 					}
 				} else {
 					client.Quit()
+					event.markFailure(mxServer)
 					logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d can't create client to %s, err - %v", c.id, event.Message.Id, mxServer.hostname, err)
 				}
 			} else {
@@ -137,6 +237,7 @@ func (c *Connector) createSmtpClient(mxServer *MxServer, event *ConnectionEvent,
 				// ставим лимит очереди, чтобы не пытаться открывать новые соединения и не создавать новые клиенты
 				event.Queue.HasLimitOn()
 				connection.Close()
+				event.markFailure(mxServer)
 				logger.By(event.Message.HostnameFrom).Warn("connector#%d-%d can't create client to %s, err - %v", c.id, event.Message.Id, mxServer.hostname, err)
 			}
 		} else {
@@ -144,6 +245,7 @@ func (c *Connector) createSmtpClient(mxServer *MxServer, event *ConnectionEvent,
 			// возможно, на почтовом сервисе стоит ограничение на количество соединений
 			// ставим лимит очереди, чтобы не пытаться открывать новые соединения
 			event.Queue.HasLimitOn()
+			event.markFailure(mxServer)
 			logger.By(event.Message.HostnameFrom).Warn("connector#%d-%d can't dial to %s, err - %v", c.id, event.Message.Id, hostname, err)
 		}
 	} else {
@@ -155,7 +257,7 @@ func (c *Connector) createSmtpClient(mxServer *MxServer, event *ConnectionEvent,
 func (c *Connector) initTlsSmtpClient(mxServer *MxServer, event *ConnectionEvent, ptrSmtpClient **common.SmtpClient, connection net.Conn, client *smtp.Client) {
 	// если есть какие данные о сертификате и к серверу можно создать TLS соединение
 	conf := service.getTlsConfig(event.Message.HostnameFrom)
-	if conf != nil && mxServer.useTLS {
+	if conf != nil && mxServer.isUseTLS() {
 		// открываем TLS соединение
 		err := client.StartTLS(conf)
 		// если все нормально, создаем клиента
@@ -185,16 +287,12 @@ func (c *Connector) initSmtpClient(mxServer *MxServer, event *ConnectionEvent, p
 		for _, queue := range mxServer.queues {
 			count += queue.MaxLen()
 		}
-		*ptrSmtpClient = &common.SmtpClient{
-			Id: count + 1,
-		}
+		*ptrSmtpClient = common.NewSmtpClient(count + 1)
 		// увеличиваем максимальную длину очереди
 		event.Queue.AddMaxLen()
 	}
 	smtpClient := *ptrSmtpClient
-	smtpClient.Conn = connection
-	smtpClient.Worker = client
-	smtpClient.ModifyDate = time.Now()
+	smtpClient.Reopen(connection, client)
 	if isNil {
 		logger.By(event.Message.HostnameFrom).Debug("connector#%d-%d create smtp client#%d for %s", c.id, event.Message.Id, smtpClient.Id, mxServer.hostname)
 	} else {
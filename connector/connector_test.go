@@ -0,0 +1,264 @@
+package connector
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/actionpay/postmanq/common"
+	"github.com/actionpay/postmanq/logger"
+)
+
+// приложение с короткими таймаутами
+type testApplication struct {
+	common.Application
+}
+
+func (testApplication) Timeout() common.Timeout {
+	timeout := common.Timeout{}
+	timeout.Init()
+	timeout.Waiting = 50 * time.Millisecond
+	return timeout
+}
+
+func (testApplication) Events() chan *common.ApplicationEvent {
+	return make(chan *common.ApplicationEvent, 100)
+}
+
+// отправитель, который передает письмо через полученного клиента
+type testMailer struct {
+	events chan *common.SendEvent
+}
+
+func (t *testMailer) OnInit(*common.ApplicationEvent) {}
+func (t *testMailer) OnRun()                          {}
+func (t *testMailer) OnFinish()                       {}
+func (t *testMailer) Events() chan *common.SendEvent  { return t.events }
+
+func (t *testMailer) run() {
+	for event := range t.events {
+		go t.send(event)
+	}
+}
+
+func (t *testMailer) send(event *common.SendEvent) {
+	worker := event.Client.Worker
+	err := worker.Mail(event.Message.Envelope)
+	if err == nil {
+		err = worker.Rcpt(event.Message.Recipient)
+	}
+	if err == nil {
+		wc, dataErr := worker.Data()
+		if dataErr == nil {
+			wc.Write([]byte("Subject: test\r\n\r\ntest\r\n"))
+			err = wc.Close()
+		} else {
+			err = dataErr
+		}
+	}
+	if err == nil {
+		err = worker.Reset()
+	}
+	if err == nil {
+		event.Failover.Success()
+		event.Client.Wait()
+		event.Queue.Push(event.Client)
+		event.Result <- common.SuccessSendEventResult
+	} else {
+		event.Client.Close()
+		event.Queue.Push(event.Client)
+		event.Result <- common.ErrorSendEventResult
+	}
+}
+
+// почтовые серверы, каждый из которых принимает не больше maxConns соединений одновременно,
+// остальным отвечают 421, как делают почтовые сервисы с ограничением соединений
+// серверы различаются по ip, на который пришло соединение
+func serveTestSmtp(listener net.Listener, maxConns int32) {
+	conns := make(map[string]*int32)
+	mutex := new(sync.Mutex)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+		mutex.Lock()
+		hostConns, ok := conns[host]
+		if !ok {
+			hostConns = new(int32)
+			conns[host] = hostConns
+		}
+		mutex.Unlock()
+		go func(conn net.Conn, conns *int32) {
+			defer conn.Close()
+			if atomic.AddInt32(conns, 1) > maxConns {
+				atomic.AddInt32(conns, -1)
+				conn.Write([]byte("421 too many connections\r\n"))
+				return
+			}
+			defer atomic.AddInt32(conns, -1)
+			reader := bufio.NewReader(conn)
+			conn.Write([]byte("220 test ESMTP\r\n"))
+			isData := false
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if isData {
+					if line == ".\r\n" {
+						isData = false
+						conn.Write([]byte("250 queued\r\n"))
+					}
+					continue
+				}
+				cmd := strings.ToUpper(strings.TrimSpace(line))
+				switch {
+				case strings.HasPrefix(cmd, "EHLO"):
+					conn.Write([]byte("250-test\r\n250 8BITMIME\r\n"))
+				case strings.HasPrefix(cmd, "DATA"):
+					isData = true
+					conn.Write([]byte("354 go ahead\r\n"))
+				case strings.HasPrefix(cmd, "QUIT"):
+					conn.Write([]byte("221 bye\r\n"))
+					return
+				default:
+					conn.Write([]byte("250 ok\r\n"))
+				}
+			}
+		}(conn, hostConns)
+	}
+}
+
+// множество писем одновременно отправляются через ограниченное количество соединений,
+// тест запускается с -race
+func TestConnectorConcurrentLoad(t *testing.T) {
+	common.App = testApplication{}
+	logger.Inst()
+	listener, err := net.Listen("tcp4", ":0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	go serveTestSmtp(listener, 4)
+	_, smtpPort, _ = net.SplitHostPort(listener.Addr().String())
+
+	mailer := &testMailer{events: make(chan *common.SendEvent)}
+	go mailer.run()
+	common.Services = []interface{}{Inst(), mailer}
+
+	address := &Address{IP: "127.0.0.1", Weight: 1}
+	conf := &Config{
+		Addresses:        []*Address{address},
+		FamilyPreference: PreferIPv4FamilyPreference,
+		strategy:         new(RoundRobinStrategy),
+		pools:            map[Family][]*Address{IPv4Family: {address}},
+		helos:            map[string]string{address.IP: "localhost"},
+		hostnames:        map[Family]string{IPv4Family: "localhost"},
+	}
+	conf.strategy.init(newAddressState())
+	service.Configs = map[string]*Config{"example.com": conf}
+	service.storage = newStateStorage(common.EmptyStr)
+	service.ConnectorsCount = 8
+	// отказы из-за ограничения соединений не должны размыкать сервер
+	service.MxFailures = 1 << 20
+	service.MxCooldown = time.Minute
+	for hostname, ip := range map[string]string{"a.test": "127.0.0.2", "b.test": "127.0.0.3"} {
+		mailServer := newMailServer(0)
+		mxServer := newMxServer(mailServer, ip, "example.com")
+		mxServer.ips = []net.IP{net.ParseIP(ip)}
+		mailServer.complete([]*MxServer{mxServer}, SuccessMailServerStatus)
+		mailServers[hostname] = mailServer
+	}
+	service.OnRun()
+
+	results := make(map[common.SendEventResult]int)
+	mutex := new(sync.Mutex)
+	group := new(sync.WaitGroup)
+	for i := 0; i < 400; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			recipient := "user@a.test"
+			if i%2 == 0 {
+				recipient = "user@b.test"
+			}
+			message := &common.MailMessage{Envelope: "sender@example.com", Recipient: recipient}
+			message.Init()
+			event := common.NewSendEvent(message)
+			event.Iterator.Next().(common.SendingService).Events() <- event
+			result := <-event.Result
+			mutex.Lock()
+			results[result]++
+			mutex.Unlock()
+			// часть клиентов успевает уйти в ожидание и отсоединиться
+			if i%50 == 0 {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}(i)
+	}
+	group.Wait()
+	// письма возвращаются в очередь, только если сервер отказал в соединении раньше,
+	// чем открылся первый клиент, тогда ждать некого
+	delayed := results[common.DelaySendEventResult]
+	if results[common.SuccessSendEventResult]+delayed != 400 || delayed > service.ConnectorsCount*len(mailServers) {
+		t.Fatalf("expected mails to be sent, got %v", results)
+	}
+}
+
+// сервер без адреса семейства не используется для соединения по этому семейству, и неудачей это не считается
+func TestConnectorSkipsMxServerWithoutFamily(t *testing.T) {
+	common.App = testApplication{}
+	logger.Inst()
+	mxServer := newTestMxServer()
+	service.MxFailures = 1
+	mxServer.ips = []net.IP{net.ParseIP("127.0.0.2")}
+	mailServer := newMailServer(0)
+	mailServer.complete([]*MxServer{mxServer}, SuccessMailServerStatus)
+
+	message := &common.MailMessage{Envelope: "sender@example.com", Recipient: "user@v4.test"}
+	message.Init()
+	event := &ConnectionEvent{
+		SendEvent:       common.NewSendEvent(message),
+		server:          mailServer,
+		address:         "::1",
+		family:          IPv6Family,
+		failedMxServers: make(map[*MxServer]bool),
+	}
+	go new(Connector).connect(event)
+	if result := <-event.Result; result != common.DelaySendEventResult {
+		t.Fatalf("expected mail to be returned, got %v", result)
+	}
+	if mxServer.getFailures(IPv4Family) != 0 || mxServer.getFailures(IPv6Family) != 0 {
+		t.Fatalf("family mismatch is counted as failure")
+	}
+}
+
+// ip отправителя, для которого у сервера нет очереди, не приводит к панике, письмо возвращается
+func TestConnectorSkipsMxServerWithoutQueue(t *testing.T) {
+	common.App = testApplication{}
+	logger.Inst()
+	mxServer := newTestMxServer()
+	mxServer.ips = []net.IP{net.ParseIP("127.0.0.2")}
+	mailServer := newMailServer(0)
+	mailServer.complete([]*MxServer{mxServer}, SuccessMailServerStatus)
+
+	message := &common.MailMessage{Envelope: "sender@example.com", Recipient: "user@v4.test"}
+	message.Init()
+	event := &ConnectionEvent{
+		SendEvent:       common.NewSendEvent(message),
+		server:          mailServer,
+		address:         "127.0.0.9",
+		family:          IPv4Family,
+		failedMxServers: make(map[*MxServer]bool),
+	}
+	go new(Connector).connect(event)
+	if result := <-event.Result; result != common.DelaySendEventResult {
+		t.Fatalf("expected mail to be returned, got %v", result)
+	}
+}
@@ -0,0 +1,90 @@
+package connector
+
+import "net"
+
+// семейство адресов
+type Family int
+
+const (
+	// IPv4
+	IPv4Family Family = iota
+
+	// IPv6
+	IPv6Family
+)
+
+var (
+	// сети для установки соединения по семейству адресов
+	familyNetworks = map[Family]string{
+		IPv4Family: "tcp4",
+		IPv6Family: "tcp6",
+	}
+
+	// названия семейств адресов для логов
+	familyNames = map[Family]string{
+		IPv4Family: "IPv4",
+		IPv6Family: "IPv6",
+	}
+)
+
+// определяет семейство адреса
+func familyOf(ip net.IP) Family {
+	if ip.To4() == nil {
+		return IPv6Family
+	} else {
+		return IPv4Family
+	}
+}
+
+// определяет семейство адреса, заданного строкой
+func familyOfAddress(address string) Family {
+	return familyOf(net.ParseIP(address))
+}
+
+// возвращает сеть для установки соединения
+func (f Family) network() string {
+	return familyNetworks[f]
+}
+
+// возвращает название семейства
+func (f Family) String() string {
+	return familyNames[f]
+}
+
+// предпочтение семейства адресов для почтового сервиса
+type FamilyPreference string
+
+const (
+	// сначала IPv4, затем IPv6, используется по умолчанию
+	PreferIPv4FamilyPreference FamilyPreference = "preferIPv4"
+
+	// сначала IPv6, затем IPv4
+	PreferIPv6FamilyPreference FamilyPreference = "preferIPv6"
+
+	// только IPv4
+	IPv4OnlyFamilyPreference FamilyPreference = "ipv4Only"
+
+	// только IPv6
+	IPv6OnlyFamilyPreference FamilyPreference = "ipv6Only"
+)
+
+var (
+	// семейства адресов в порядке предпочтения
+	familyPreferences = map[FamilyPreference][]Family{
+		PreferIPv4FamilyPreference: {IPv4Family, IPv6Family},
+		PreferIPv6FamilyPreference: {IPv6Family, IPv4Family},
+		IPv4OnlyFamilyPreference:   {IPv4Family},
+		IPv6OnlyFamilyPreference:   {IPv6Family},
+	}
+)
+
+// проверяет, что предпочтение известно
+func (f FamilyPreference) isValid() bool {
+	_, ok := familyPreferences[f]
+	return ok
+}
+
+// возвращает семейства адресов в порядке предпочтения
+func (f FamilyPreference) families() []Family {
+	return familyPreferences[f]
+}
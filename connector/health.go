@@ -0,0 +1,131 @@
+package connector
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// количество неудач подряд, после которого сервер перестает использоваться
+	defaultMxFailures = 3
+
+	// пауза, после которой к неисправному серверу делается пробная попытка
+	defaultMxCooldown = time.Minute
+)
+
+// состояние сервера по одному семейству адресов
+// после нескольких неудач подряд сервер размыкается и не используется до окончания паузы,
+// после паузы к серверу пропускается одна пробная попытка,
+// успешная попытка замыкает сервер, неудачная продлевает паузу
+type MxHealth struct {
+	// количество неудач подряд
+	failures int
+
+	// дата размыкания или последней пробной попытки
+	openDate time.Time
+
+	// пробная попытка зарезервирована соединителем, но клиент еще не получен
+	probing bool
+}
+
+// возвращает состояние сервера для семейства адресов, вызывается под семафором
+// неудачи учитываются по семействам, т.к. сервер может быть недоступен по IPv6 и доступен по IPv4
+func (m *MxServer) healthOf(family Family) *MxHealth {
+	if m.health == nil {
+		m.health = make(map[Family]*MxHealth)
+	}
+	health, ok := m.health[family]
+	if !ok {
+		health = new(MxHealth)
+		m.health[family] = health
+	}
+	return health
+}
+
+// проверяет, что через сервер можно отправить письмо по семейству адресов
+// если пауза закончилась, резервирует пробную попытку, поэтому другие соединители сервер пропустят
+// второе значение говорит, что попытка пробная, ее необходимо начать или отменить после поиска клиента
+func (m *MxServer) acquire(family Family, now time.Time) (bool, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	health := m.healthOf(family)
+	if health.failures < service.MxFailures {
+		return true, false
+	} else if !health.probing && now.Sub(health.openDate) >= service.MxCooldown {
+		health.probing = true
+		return true, true
+	} else {
+		return false, false
+	}
+}
+
+// начинает пробную попытку, когда клиент получен, и вместе с ней новую паузу,
+// поэтому до следующей паузы пробная попытка будет только одна
+func (m *MxServer) startProbe(family Family, now time.Time) {
+	m.mutex.Lock()
+	health := m.healthOf(family)
+	if health.probing {
+		health.probing = false
+		health.openDate = now
+	}
+	m.mutex.Unlock()
+}
+
+// отменяет пробную попытку, если клиента получить не удалось, например, все клиенты заняты
+func (m *MxServer) cancelProbe(family Family) {
+	m.mutex.Lock()
+	m.healthOf(family).probing = false
+	m.mutex.Unlock()
+}
+
+// учитывает успешную отправку через сервер по семейству адресов
+func (m *MxServer) success(family Family) {
+	m.mutex.Lock()
+	health := m.healthOf(family)
+	health.failures = 0
+	health.probing = false
+	m.mutex.Unlock()
+}
+
+// учитывает неудачу при соединении или отправке через сервер по семейству адресов
+// возвращает true, если сервер разомкнулся для семейства
+func (m *MxServer) failure(family Family) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	health := m.healthOf(family)
+	health.failures++
+	// неудачное соединение тоже является пробной попыткой
+	health.probing = false
+	if health.failures >= service.MxFailures {
+		health.openDate = time.Now()
+		return true
+	} else {
+		return false
+	}
+}
+
+// возвращает количество неудач подряд по семейству адресов
+func (m *MxServer) getFailures(family Family) int {
+	m.mutex.Lock()
+	failures := m.healthOf(family).failures
+	m.mutex.Unlock()
+	return failures
+}
+
+// сортирует сервера по MX приоритету, а сервера с одинаковым приоритетом - по количеству неудач по семейству адресов
+func sortMxServers(mxServers []*MxServer, family Family) []*MxServer {
+	sorted := make([]*MxServer, len(mxServers))
+	failures := make(map[*MxServer]int)
+	for i, mxServer := range mxServers {
+		sorted[i] = mxServer
+		failures[mxServer] = mxServer.getFailures(family)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].preference == sorted[j].preference {
+			return failures[sorted[i]] < failures[sorted[j]]
+		} else {
+			return sorted[i].preference < sorted[j].preference
+		}
+	})
+	return sorted
+}
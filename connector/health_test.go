@@ -0,0 +1,64 @@
+package connector
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMxServer() *MxServer {
+	Inst()
+	service.MxFailures = 2
+	service.MxCooldown = time.Minute
+	return &MxServer{hostname: "mx.test", mutex: new(sync.Mutex)}
+}
+
+func TestMxServerKeepsProbeWithoutClient(t *testing.T) {
+	mxServer := newTestMxServer()
+	mxServer.failure(IPv4Family)
+	mxServer.failure(IPv4Family)
+	now := time.Now().Add(2 * time.Minute)
+
+	isAvailable, isProbe := mxServer.acquire(IPv4Family, now)
+	if !isAvailable || !isProbe {
+		t.Fatalf("expected probe after cooldown")
+	}
+	if isAvailable, _ := mxServer.acquire(IPv4Family, now); isAvailable {
+		t.Fatalf("probe should be reserved by one connector")
+	}
+	// клиента не получили, проба не израсходована
+	mxServer.cancelProbe(IPv4Family)
+	if isAvailable, isProbe := mxServer.acquire(IPv4Family, now); !isAvailable || !isProbe {
+		t.Fatalf("expected probe after cancel")
+	}
+	// клиента получили, начинается новая пауза
+	mxServer.startProbe(IPv4Family, now)
+	if isAvailable, _ := mxServer.acquire(IPv4Family, now.Add(time.Second)); isAvailable {
+		t.Fatalf("server should be paused after probe start")
+	}
+	mxServer.success(IPv4Family)
+	if isAvailable, isProbe := mxServer.acquire(IPv4Family, now.Add(time.Second)); !isAvailable || isProbe {
+		t.Fatalf("server should be closed after success")
+	}
+}
+
+// неудачи по одному семейству адресов не размыкают сервер для другого
+func TestMxServerHealthByFamily(t *testing.T) {
+	mxServer := newTestMxServer()
+	mxServer.failure(IPv6Family)
+	mxServer.failure(IPv6Family)
+	now := time.Now()
+	if isAvailable, _ := mxServer.acquire(IPv6Family, now); isAvailable {
+		t.Fatalf("server should be paused for IPv6")
+	}
+	if isAvailable, isProbe := mxServer.acquire(IPv4Family, now); !isAvailable || isProbe {
+		t.Fatalf("server should be closed for IPv4")
+	}
+	mxServer.success(IPv4Family)
+	if isAvailable, _ := mxServer.acquire(IPv6Family, now); isAvailable {
+		t.Fatalf("IPv4 success shouldn't close server for IPv6")
+	}
+	if mxServer.getFailures(IPv4Family) != 0 || mxServer.getFailures(IPv6Family) != 2 {
+		t.Fatalf("unexpected failures")
+	}
+}
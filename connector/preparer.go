@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/actionpay/postmanq/common"
 	"github.com/actionpay/postmanq/logger"
-	"time"
 )
 
 // заготовщик, подготавливает событие соединения
@@ -32,10 +31,10 @@ func (p *Preparer) prepare(event *common.SendEvent) {
 	logger.By(event.Message.HostnameFrom).Info("preparer#%d-%d try create connection", p.id, event.Message.Id)
 
 	connectionEvent := &ConnectionEvent{
-		SendEvent:   event,
-		servers:     make(chan *MailServer, 1),
-		connectorId: p.id,
-		address:     service.getAddress(event.Message.HostnameFrom, p.id),
+		SendEvent:       event,
+		servers:         make(chan *MailServer, 1),
+		connectorId:     p.id,
+		failedMxServers: make(map[*MxServer]bool),
 	}
 	goto connectToMailServer
 
@@ -43,12 +42,27 @@ connectToMailServer:
 	// отправляем событие сбора информации о сервере
 	seekerEvents <- connectionEvent
 	server := <-connectionEvent.servers
-	switch server.status {
+	switch server.getStatus() {
 	case LookupMailServerStatus:
 		goto waitLookup
 	case SuccessMailServerStatus:
 		connectionEvent.server = server
-		connectorEvents <- connectionEvent
+		connectionEvent.families = service.getFamilies(connectionEvent)
+		// выбираем ip того семейства адресов, которое поддерживает почтовый сервис
+		if connectionEvent.nextFamily() {
+			if connectionEvent.checkAddressLimit() {
+				connectorEvents <- connectionEvent
+			} else {
+				// ограничение для выбранного ip превышено, письмо отправим позже
+				common.OverlimitMail(event)
+			}
+		} else {
+			// если все ip исчерпали суточную квоту или семейства адресов не совпали, письмо отправим позже
+			common.ReturnMail(
+				event,
+				errors.New(fmt.Sprintf("preparer#%d-%d can't find free ip for %s", p.id, event.Message.Id, event.Message.HostnameTo)),
+			)
+		}
 	case ErrorMailServerStatus:
 		common.ReturnMail(
 			event,
@@ -59,7 +73,14 @@ connectToMailServer:
 
 waitLookup:
 	logger.By(event.Message.HostnameFrom).Debug("preparer#%d-%d wait ending look up mail server %s...", p.id, event.Message.Id, event.Message.HostnameTo)
-	time.Sleep(common.App.Timeout().Sleep)
-	goto connectToMailServer
+	// ждем, пока искатель не закончит поиск информации о почтовом сервисе
+	if common.WaitSignal(server.lookupDone, common.App.Timeout().Lookup) {
+		goto connectToMailServer
+	} else {
+		common.ReturnMail(
+			event,
+			errors.New(fmt.Sprintf("preparer#%d-%d can't wait ending look up %s", p.id, event.Message.Id, event.Message.HostnameTo)),
+		)
+	}
 	return
 }
@@ -1,6 +1,7 @@
 package connector
 
 import (
+	"github.com/actionpay/postmanq/common"
 	"github.com/actionpay/postmanq/logger"
 	"net"
 	"strings"
@@ -10,6 +11,7 @@ import (
 var (
 	seekerEvents = make(chan *ConnectionEvent)
 	// семафор, необходим для поиска MX серверов
+	// все обращения к mailServers должны происходить под этим семафором
 	seekerMutex = new(sync.Mutex)
 )
 
@@ -35,57 +37,49 @@ func (s *Seeker) run() {
 // ищет информацию о сервере
 func (s *Seeker) seek(event *ConnectionEvent) {
 	hostnameTo := event.Message.HostnameTo
-	// добавляем новый почтовый домен
-	seekerMutex.Lock()
-	if _, ok := mailServers[hostnameTo]; !ok {
-		logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d create mail server for %s", event.connectorId, event.Message.Id, hostnameTo)
-		mailServers[hostnameTo] = &MailServer{
-			status:      LookupMailServerStatus,
-			connectorId: event.connectorId,
-		}
-	}
-	seekerMutex.Unlock()
-	mailServer := mailServers[hostnameTo]
+	mailServer, created := s.findOrCreateMailServer(event)
 	// если пришло несколько несколько писем на один почтовый сервис,
 	// и информация о сервисе еще не собрана,
-	// то таким образом блокируем повторную попытку собрать инфомацию о почтовом сервисе
-	if event.connectorId == mailServer.connectorId && mailServer.status == LookupMailServerStatus {
+	// то информацию собирает только тот искатель, который создал почтовый сервис,
+	// остальные получат почтовый сервис в статусе поиска и будут ждать окончания поиска
+	if created {
 		logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d look up mx domains for %s...", s.id, event.Message.Id, hostnameTo)
-		mailServer := mailServers[hostnameTo]
 		// ищем почтовые сервера для домена
 		mxes, err := net.LookupMX(hostnameTo)
 		if err == nil {
-			mailServer.mxServers = make([]*MxServer, len(mxes))
+			mxServers := make([]*MxServer, len(mxes))
 			for i, mx := range mxes {
 				mxHostname := strings.TrimRight(mx.Host, ".")
 				logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d look up mx domain %s for %s", s.id, event.Message.Id, mxHostname, hostnameTo)
-				mxServer := newMxServer(mxHostname, event.Message.HostnameFrom)
-				mxServer.realServerName = s.seekRealServerName(mx.Host)
+				mxServer := newMxServer(mailServer, mxHostname, event.Message.HostnameFrom)
+				mxServer.preference = mx.Pref
+				// адреса сервера нужны, чтобы знать, по каким семействам адресов можно установить соединение
+				mxServer.ips, _ = net.LookupIP(mxHostname)
+				mxServer.realServerName = common.RealServerName(mx.Host)
 				logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d look up detect real server name %s", s.id, event.Message.Id, mxServer.realServerName)
-				mailServer.mxServers[i] = mxServer
+				mxServers[i] = mxServer
 			}
-			mailServer.status = SuccessMailServerStatus
+			mailServer.complete(mxServers, SuccessMailServerStatus)
 			logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d look up %s success", s.id, event.Message.Id, hostnameTo)
 		} else {
-			mailServer.status = ErrorMailServerStatus
+			mailServer.complete(nil, ErrorMailServerStatus)
 			logger.By(event.Message.HostnameFrom).Warn("seeker#%d-%d can't look up mx domains for %s", s.id, event.Message.Id, hostnameTo)
 		}
 	}
 	event.servers <- mailServer
 }
 
-func (s *Seeker) seekRealServerName(hostname string) string {
-	parts := strings.Split(hostname, ".")
-	partsLen := len(parts)
-	hostname = strings.Join(parts[partsLen-3:partsLen-1], ".")
-	mxes, err := net.LookupMX(hostname)
-	if err == nil {
-		if strings.Contains(mxes[0].Host, hostname) {
-			return hostname
-		} else {
-			return s.seekRealServerName(mxes[0].Host)
-		}
-	} else {
-		return hostname
+// ищет почтовый сервис по домену получателя, если сервис не найден, создает его
+// возвращает true, если сервис был создан
+func (s *Seeker) findOrCreateMailServer(event *ConnectionEvent) (*MailServer, bool) {
+	hostnameTo := event.Message.HostnameTo
+	seekerMutex.Lock()
+	mailServer, ok := mailServers[hostnameTo]
+	if !ok {
+		logger.By(event.Message.HostnameFrom).Debug("seeker#%d-%d create mail server for %s", event.connectorId, event.Message.Id, hostnameTo)
+		mailServer = newMailServer(event.connectorId)
+		mailServers[hostnameTo] = mailServer
 	}
+	seekerMutex.Unlock()
+	return mailServer, !ok
 }
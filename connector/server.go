@@ -3,6 +3,7 @@ package connector
 import (
 	"github.com/actionpay/postmanq/common"
 	"net"
+	"sync"
 )
 
 // статус почтового сервис
@@ -29,6 +30,83 @@ type MailServer struct {
 
 	// статус, говорящий о том, собранали ли информация о почтовом сервисе
 	status MailServerStatus
+
+	// канал закрывается, когда поиск информации о почтовом сервисе завершен
+	lookupDone chan struct{}
+
+	// сигналы о возврате клиентов в очереди, для каждого ip отправителя свой сигнал
+	// сигнал общий для всех серверов почтового сервиса
+	signals map[string]*common.Signal
+
+	// семафор, защищает статус и серверы почтового сервиса
+	mutex *sync.RWMutex
+}
+
+// создает новый почтовый сервис
+func newMailServer(connectorId int) *MailServer {
+	return &MailServer{
+		status:      LookupMailServerStatus,
+		connectorId: connectorId,
+		lookupDone:  make(chan struct{}),
+		signals:     make(map[string]*common.Signal),
+		mutex:       new(sync.RWMutex),
+	}
+}
+
+// сохраняет результат поиска информации о почтовом сервисе и будит ожидающих окончания поиска
+// серверы и сигналы почтового сервиса после этого не изменяются
+func (m *MailServer) complete(mxServers []*MxServer, status MailServerStatus) {
+	m.mutex.Lock()
+	m.mxServers = mxServers
+	m.status = status
+	m.mutex.Unlock()
+	close(m.lookupDone)
+}
+
+// возвращает статус почтового сервиса
+func (m *MailServer) getStatus() MailServerStatus {
+	m.mutex.RLock()
+	status := m.status
+	m.mutex.RUnlock()
+	return status
+}
+
+// возвращает серверы почтового сервиса
+func (m *MailServer) getMxServers() []*MxServer {
+	m.mutex.RLock()
+	mxServers := m.mxServers
+	m.mutex.RUnlock()
+	return mxServers
+}
+
+// возвращает сигнал о возврате клиентов в очереди для ip отправителя
+// вызывается только искателем во время поиска информации о почтовом сервисе
+func (m *MailServer) getSignal(address string) *common.Signal {
+	signal, ok := m.signals[address]
+	if !ok {
+		signal = common.NewSignal()
+		m.signals[address] = signal
+	}
+	return signal
+}
+
+// возвращает сигнал о возврате клиента в любую из очередей ip отправителя
+// если у почтового сервиса нет серверов, сигнала нет и возвращается nil
+func (m *MailServer) signal(address string) *common.Signal {
+	m.mutex.RLock()
+	signal := m.signals[address]
+	m.mutex.RUnlock()
+	return signal
+}
+
+// проверяет, что хотя бы один сервер почтового сервиса доступен по адресу семейства
+func (m *MailServer) hasFamily(family Family) bool {
+	for _, mxServer := range m.getMxServers() {
+		if mxServer.hasFamily(family) {
+			return true
+		}
+	}
+	return false
 }
 
 // почтовый сервер
@@ -48,15 +126,24 @@ type MxServer struct {
 	// использоватение TLS
 	useTLS bool
 
-	// очередь клиентов
+	// очередь клиентов, карта не изменяется после создания сервера
 	queues map[string]*common.LimitedQueue
+
+	// MX приоритет сервера, чем меньше, тем раньше используется сервер
+	preference uint16
+
+	// состояние сервера по семействам адресов
+	health map[Family]*MxHealth
+
+	// семафор, защищает признак использования TLS и состояние сервера
+	mutex *sync.Mutex
 }
 
 // создает новый почтовый сервер
-func newMxServer(hostname, hostnameFrom string) *MxServer {
+func newMxServer(mailServer *MailServer, hostname, hostnameFrom string) *MxServer {
 	queues := make(map[string]*common.LimitedQueue)
 	for _, address := range service.getAddresses(hostnameFrom) {
-		queues[address] = common.NewLimitQueue()
+		queues[address] = common.NewLimitQueue(mailServer.getSignal(address))
 	}
 
 	return &MxServer{
@@ -64,10 +151,32 @@ func newMxServer(hostname, hostnameFrom string) *MxServer {
 		ips:      make([]net.IP, 0),
 		useTLS:   true,
 		queues:   queues,
+		health:   make(map[Family]*MxHealth),
+		mutex:    new(sync.Mutex),
 	}
 }
 
+// проверяет, что у сервера есть адрес семейства
+func (m *MxServer) hasFamily(family Family) bool {
+	for _, ip := range m.ips {
+		if familyOf(ip) == family {
+			return true
+		}
+	}
+	return false
+}
+
+// сигнализирует, что к серверу можно создавать TLS соединения
+func (m *MxServer) isUseTLS() bool {
+	m.mutex.Lock()
+	useTLS := m.useTLS
+	m.mutex.Unlock()
+	return useTLS
+}
+
 // запрещает использовать TLS соединения
 func (m *MxServer) dontUseTLS() {
+	m.mutex.Lock()
 	m.useTLS = false
+	m.mutex.Unlock()
 }
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"net"
 	"strings"
+	"time"
 )
 
 var (
@@ -43,7 +44,22 @@ type Service struct {
 	// количество горутин устанавливающих соединения к почтовым сервисам
 	ConnectorsCount int `yaml:"workers"`
 
+	// путь до файла, в котором хранятся счетчики стратегий выбора ip
+	StateFilename string `yaml:"ipsState"`
+
+	// количество неудач подряд, после которого MX сервер перестает использоваться
+	MxFailures int `yaml:"mxFailures"`
+
+	// пауза, после которой к неисправному MX серверу делается пробная попытка
+	MxCooldown time.Duration `yaml:"mxCooldown"`
+
 	Configs map[string]*Config `yaml:"postmans"`
+
+	// состояние стратегий выбора ip для каждого отправителя
+	states map[string]*AddressState
+
+	// хранилище состояния стратегий выбора ip
+	storage *StateStorage
 }
 
 // создает новый сервис соединений
@@ -58,12 +74,20 @@ func Inst() *Service {
 func (s *Service) OnInit(event *common.ApplicationEvent) {
 	err := yaml.Unmarshal(event.Data, s)
 	if err == nil {
+		s.storage = newStateStorage(s.StateFilename)
+		s.states = s.storage.load()
 		for name, config := range s.Configs {
 			s.init(config, name)
 		}
 		if s.ConnectorsCount == 0 {
 			s.ConnectorsCount = common.DefaultWorkersCount
 		}
+		if s.MxFailures <= 0 {
+			s.MxFailures = defaultMxFailures
+		}
+		if s.MxCooldown == 0 {
+			s.MxCooldown = defaultMxCooldown
+		}
 	} else {
 		logger.All().FailExit("connection service can't unmarshal config, error - %v", err)
 	}
@@ -103,13 +127,88 @@ func (s *Service) init(conf *Config, hostname string) {
 	} else {
 		logger.By(hostname).Debug("connection service - certificate is not defined")
 	}
-	conf.addressesLen = len(conf.Addresses)
-	if conf.addressesLen == 0 {
+	if len(conf.Addresses) == 0 {
 		logger.By(hostname).FailExit("connection service - ips should be defined")
 	}
+	// раскладываем ip по семействам адресов
+	conf.pools = make(map[Family][]*Address)
+	for _, address := range conf.Addresses {
+		if net.ParseIP(address.IP) == nil {
+			logger.By(hostname).FailExit("connection service - invalid ip %s", address.IP)
+		}
+		family := familyOfAddress(address.IP)
+		conf.pools[family] = append(conf.pools[family], address)
+		if address.Warmup != nil {
+			err := address.Warmup.init()
+			if err != nil {
+				logger.By(hostname).FailExit("connection service can't parse warmup start date for %s, error - %v", address.IP, err)
+			}
+		}
+	}
+	// по умолчанию предпочитаем IPv4
+	if len(conf.FamilyPreference) == 0 {
+		conf.FamilyPreference = PreferIPv4FamilyPreference
+	}
+	if !conf.FamilyPreference.isValid() {
+		logger.By(hostname).FailExit("connection service - unknown address family preference %s", conf.FamilyPreference)
+	}
+	for domain, preference := range conf.FamilyPreferences {
+		if !preference.isValid() {
+			logger.By(hostname).FailExit("connection service - unknown address family preference %s for %s", preference, domain)
+		}
+	}
+	// если стратегия выбора ip не указана, ip выбирается по номеру заготовщика
+	if len(conf.StrategyName) == 0 {
+		conf.StrategyName = PreparerStrategyName
+	}
+	if factory, ok := strategyFactories[conf.StrategyName]; ok {
+		state, ok := s.states[hostname]
+		if !ok {
+			state = newAddressState()
+			s.states[hostname] = state
+		}
+		conf.strategy = factory()
+		conf.strategy.init(state)
+	} else {
+		logger.By(hostname).FailExit("connection service - unknown ip strategy %s", conf.StrategyName)
+	}
 	mxes, err := net.LookupMX(hostname)
 	if err == nil {
-		conf.hostname = strings.TrimRight(mxes[0].Host, ".")
+		// представляемся тем почтовым сервером, который резолвится в адрес нужного семейства,
+		// иначе HELO и PTR будут указывать на разные адреса
+		conf.hostnames = make(map[Family]string)
+		for _, mx := range mxes {
+			mxHostname := strings.TrimRight(mx.Host, ".")
+			ips, _ := net.LookupIP(mxHostname)
+			for _, ip := range ips {
+				family := familyOf(ip)
+				if _, ok := conf.hostnames[family]; !ok {
+					conf.hostnames[family] = mxHostname
+				}
+			}
+		}
+		for family := range conf.pools {
+			if _, ok := conf.hostnames[family]; !ok {
+				conf.hostnames[family] = strings.TrimRight(mxes[0].Host, ".")
+				logger.By(hostname).Warn("connection service - mx servers of %s have no %s address, helo %s may not match ptr", hostname, family, conf.hostnames[family])
+			}
+		}
+		// если для ip не указано имя, представляемся именем по семейству адресов ip
+		conf.helos = make(map[string]string)
+		for _, address := range conf.Addresses {
+			if len(address.Helo) > 0 {
+				conf.helos[address.IP] = address.Helo
+			} else {
+				conf.helos[address.IP] = conf.hostnames[familyOfAddress(address.IP)]
+			}
+			if conf.VerifyPtr {
+				if mismatch := address.verifyPtr(conf.helos[address.IP]); len(mismatch) > 0 {
+					logger.By(hostname).Warn("connection service - helo %s doesn't match dns: %s", conf.helos[address.IP], mismatch)
+				} else {
+					logger.By(hostname).Debug("connection service - helo %s matches ptr of %s", conf.helos[address.IP], address.IP)
+				}
+			}
+		}
 	} else {
 		logger.By(hostname).FailExit("connection service - can't lookup mx for %s", hostname)
 	}
@@ -123,6 +222,7 @@ func (s *Service) OnRun() {
 		go newSeeker(id)
 		go newConnector(id)
 	}
+	go s.storage.run(s.states)
 }
 
 // канал для приема событий отправки писем
@@ -133,6 +233,7 @@ func (s *Service) Events() chan *common.SendEvent {
 // завершает работу сервиса соединений
 func (s *Service) OnFinish() {
 	close(events)
+	s.storage.save(s.states)
 }
 
 func (s Service) getTlsConfig(hostname string) *tls.Config {
@@ -154,25 +255,61 @@ func (s Service) getTlsConfig(hostname string) *tls.Config {
 
 func (s Service) getAddresses(hostname string) []string {
 	if conf, ok := s.Configs[hostname]; ok {
-		return conf.Addresses
+		addresses := make([]string, len(conf.Addresses))
+		for i, address := range conf.Addresses {
+			addresses[i] = address.IP
+		}
+		return addresses
 	} else {
 		logger.By(hostname).Err("connection service can't find ips by %s", hostname)
 		return common.EmptyStrSlice
 	}
 }
 
-func (s Service) getAddress(hostname string, id int) string {
+// выбирает ip, с которого будет отправлено письмо, по стратегии отправителя
+// ip выбирается из ip семейства, выбранного для события
+func (s Service) getAddress(event *ConnectionEvent) string {
+	hostname := event.Message.HostnameFrom
 	if conf, ok := s.Configs[hostname]; ok {
-		return conf.Addresses[id%conf.addressesLen]
+		if pool, ok := conf.pools[event.family]; ok {
+			return conf.strategy.choose(event, pool)
+		} else {
+			return common.EmptyStr
+		}
 	} else {
 		logger.By(hostname).Err("connection service can't find ip by %s", hostname)
 		return common.EmptyStr
 	}
 }
 
-func (s Service) getHostname(hostname string) string {
+// учитывает письмо, отправленное с ip события, в стратегии выбора ip отправителя
+func (s Service) countAddress(event *ConnectionEvent) {
+	if conf, ok := s.Configs[event.Message.HostnameFrom]; ok {
+		conf.strategy.count(event.address)
+	}
+}
+
+// возвращает семейства адресов, доступные отправителю и почтовому сервису, в порядке предпочтения
+func (s Service) getFamilies(event *ConnectionEvent) []Family {
+	families := make([]Family, 0)
+	if conf, ok := s.Configs[event.Message.HostnameFrom]; ok {
+		preference, ok := conf.FamilyPreferences[event.Message.HostnameTo]
+		if !ok {
+			preference = conf.FamilyPreference
+		}
+		for _, family := range preference.families() {
+			if _, ok := conf.pools[family]; ok && event.server.hasFamily(family) {
+				families = append(families, family)
+			}
+		}
+	}
+	return families
+}
+
+// возвращает имя, которым необходимо представляться почтовому сервису при отправке с ip
+func (s Service) getHostname(hostname, address string) string {
 	if conf, ok := s.Configs[hostname]; ok {
-		return conf.hostname
+		return conf.helos[address]
 	} else {
 		logger.By(hostname).Err("connection service can't find hostname by %s", hostname)
 		return common.EmptyStr
@@ -194,6 +331,83 @@ type ConnectionEvent struct {
 
 	// адрес, с которого будет отправлено письмо
 	address string
+
+	// крайний срок ожидания свободного клиента
+	deadline time.Time
+
+	// семейство адресов, по которому устанавливается соединение
+	family Family
+
+	// семейства адресов, на которые можно переключиться, если не удалось установить соединение
+	families []Family
+
+	// сервер, через который отправляется письмо
+	mxServer *MxServer
+
+	// сервера, через которые письмо не удалось отправить в этой попытке
+	failedMxServers map[*MxServer]bool
+}
+
+// учитывает неудачу соединения или отправки письма через сервер по семейству адресов события
+func (c *ConnectionEvent) markFailure(mxServer *MxServer) {
+	if mxServer.failure(c.family) {
+		logger.By(c.Message.HostnameFrom).Warn("connection service - mx server %s is unhealthy by %s, pause it for %v", mxServer.hostname, c.family, service.MxCooldown)
+	}
+}
+
+// учитывает успешную отправку письма через сервер
+func (c *ConnectionEvent) Success() {
+	c.mxServer.success(c.family)
+	service.countAddress(c)
+}
+
+// учитывает неудачную отправку письма через сервер
+// и передает письмо соединителю, чтобы отправить его через следующий сервер почтового сервиса
+// возвращает false, если все сервера почтового сервиса уже опробованы
+func (c *ConnectionEvent) Failure(err error) bool {
+	c.markFailure(c.mxServer)
+	c.failedMxServers[c.mxServer] = true
+	for _, mxServer := range c.server.getMxServers() {
+		if !c.failedMxServers[mxServer] {
+			logger.By(c.Message.HostnameFrom).Info("connection service - mail#%d failed via %s, error - %v, try next mx server", c.Message.Id, c.mxServer.hostname, err)
+			c.Client = nil
+			c.Failover = nil
+			c.mxServer = nil
+			// отправитель не должен ждать соединителя
+			go func() {
+				connectorEvents <- c
+			}()
+			return true
+		}
+	}
+	return false
+}
+
+// переключает событие на следующее семейство адресов и выбирает ip этого семейства
+// возвращает false, если подходящих семейств не осталось
+func (c *ConnectionEvent) nextFamily() bool {
+	for len(c.families) > 0 {
+		c.family = c.families[0]
+		c.families = c.families[1:]
+		c.address = service.getAddress(c)
+		if len(c.address) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// проверяет ограничения для выбранного ip
+// возвращает false, если ограничение превышено
+func (c *ConnectionEvent) checkAddressLimit() bool {
+	return c.AddressLimit == nil || c.AddressLimit.Check(c.SendEvent, c.address)
+}
+
+// возвращает жетоны ограничений, взятые для выбранного ip
+func (c *ConnectionEvent) releaseAddressLimit() {
+	if c.AddressLimit != nil {
+		c.AddressLimit.Release(c.SendEvent)
+	}
 }
 
 type Config struct {
@@ -204,12 +418,31 @@ type Config struct {
 	CertFilename string `yaml:"certificate"`
 
 	// ip с которых будем рассылать письма
-	Addresses []string `yaml:"ips"`
+	Addresses []*Address `yaml:"ips"`
+
+	// название стратегии выбора ip
+	StrategyName StrategyName `yaml:"ipStrategy"`
+
+	// стратегия выбора ip
+	strategy AddressStrategy
 
-	// количество ip
-	addressesLen int
+	// предпочтение семейства адресов по умолчанию
+	FamilyPreference FamilyPreference `yaml:"family"`
+
+	// предпочтения семейства адресов для почтовых сервисов, в качестве ключа используется домен
+	FamilyPreferences map[string]FamilyPreference `yaml:"families"`
+
+	// ip, разложенные по семействам адресов
+	pools map[Family][]*Address
 
 	tlsConfig *tls.Config
 
-	hostname string
+	// проверять при запуске, что PTR записи ip совпадают с именами, которыми представляемся почтовым сервисам
+	VerifyPtr bool `yaml:"verifyPtr"`
+
+	// имена, которыми представляемся почтовым сервисам, для каждого семейства адресов
+	hostnames map[Family]string
+
+	// имена, которыми представляемся почтовым сервисам, для каждого ip
+	helos map[string]string
 }
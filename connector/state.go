@@ -0,0 +1,74 @@
+package connector
+
+import (
+	"encoding/json"
+	"github.com/actionpay/postmanq/common"
+	"github.com/actionpay/postmanq/logger"
+	"time"
+)
+
+// хранилище состояния стратегий выбора ip
+// состояние всех отправителей хранится в одном json файле, ключом является домен отправителя
+type StateStorage struct {
+	*common.StateFile
+}
+
+// создает хранилище состояния
+func newStateStorage(filename string) *StateStorage {
+	return &StateStorage{common.NewStateFile(filename)}
+}
+
+// читает состояние из файла
+// если файла нет, возвращает пустое состояние
+func (s *StateStorage) load() map[string]*AddressState {
+	states := make(map[string]*AddressState)
+	ok, err := s.Load(&states)
+	if err == nil {
+		for hostname, state := range states {
+			if state == nil {
+				delete(states, hostname)
+			} else {
+				state.init()
+			}
+		}
+		if ok {
+			logger.All().Debug("connection service read ips state from %s", s.Filename)
+		}
+	} else {
+		states = make(map[string]*AddressState)
+		logger.All().Warn("connection service can't read ips state %s, error - %v", s.Filename, err)
+	}
+	return states
+}
+
+// сохраняет состояние в файл
+// состояние сериализуется под семафорами, а пишется в файл уже без них
+func (s *StateStorage) save(states map[string]*AddressState) {
+	if len(s.Filename) == 0 {
+		return
+	}
+	for _, state := range states {
+		state.mutex.Lock()
+	}
+	bytes, err := json.Marshal(states)
+	for _, state := range states {
+		state.mutex.Unlock()
+	}
+	if err == nil {
+		err = s.Save(json.RawMessage(bytes))
+	}
+	if err != nil {
+		logger.All().Warn("connection service can't save ips state to %s, error - %v", s.Filename, err)
+	}
+}
+
+// периодически забывает устаревшие закрепленные ip и сохраняет состояние
+func (s *StateStorage) run(states map[string]*AddressState) {
+	s.Run(func() {
+		now := time.Now()
+		for _, state := range states {
+			state.expire(now)
+		}
+		s.save(states)
+	})
+}
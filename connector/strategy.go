@@ -0,0 +1,271 @@
+package connector
+
+import (
+	"sync"
+	"time"
+)
+
+// время, после которого забывается ip, закрепленный за доменом, если домену не отправлялись письма
+const stickyDomainLifetime = 30 * 24 * time.Hour
+
+// название стратегии выбора ip
+type StrategyName string
+
+const (
+	// ip выбирается по номеру заготовщика, используется по умолчанию
+	PreparerStrategyName StrategyName = "preparer"
+
+	// ip выбираются по очереди для каждого письма
+	RoundRobinStrategyName StrategyName = "roundRobin"
+
+	// ip выбираются пропорционально весам
+	WeightedStrategyName StrategyName = "weighted"
+
+	// за доменом получателя закрепляется один ip
+	StickyStrategyName StrategyName = "sticky"
+
+	// прогреваемые ip получают письма в пределах суточной квоты
+	WarmupStrategyName StrategyName = "warmup"
+)
+
+var (
+	// конструкторы стратегий по названию
+	strategyFactories = map[StrategyName]func() AddressStrategy{
+		PreparerStrategyName:   func() AddressStrategy { return new(PreparerStrategy) },
+		RoundRobinStrategyName: func() AddressStrategy { return new(RoundRobinStrategy) },
+		WeightedStrategyName:   func() AddressStrategy { return new(WeightedStrategy) },
+		StickyStrategyName:     func() AddressStrategy { return new(StickyStrategy) },
+		WarmupStrategyName:     func() AddressStrategy { return new(WarmupStrategy) },
+	}
+)
+
+// стратегия выбора ip, с которого будет отправлено письмо
+type AddressStrategy interface {
+	// инициализирует стратегию сохраненным состоянием
+	init(*AddressState)
+
+	// выбирает ip для письма из переданных, пустая строка означает, что свободных ip нет
+	choose(*ConnectionEvent, []*Address) string
+
+	// учитывает письмо, успешно отправленное с ip
+	count(string)
+}
+
+// состояние стратегий выбора ip, сохраняется между перезапусками
+type AddressState struct {
+	// количество выбранных ip
+	Position uint64 `json:"position"`
+
+	// количество отправленных писем для каждого ip
+	Counters map[string]int64 `json:"counters"`
+
+	// закрепленные ip за доменами получателей
+	Domains map[string]string `json:"domains"`
+
+	// даты последнего выбора закрепленных ip, по ним забываются домены, которым давно не отправлялись письма
+	DomainDates map[string]time.Time `json:"domainDates"`
+
+	// количество отправленных писем для каждого ip за сутки
+	Daily map[string]int64 `json:"daily"`
+
+	// сутки, за которые посчитано количество писем
+	Day string `json:"day"`
+
+	// семафор
+	mutex *sync.Mutex
+}
+
+// создает новое состояние
+func newAddressState() *AddressState {
+	state := new(AddressState)
+	state.init()
+	return state
+}
+
+// инициализирует состояние, в том числе прочитанное из файла
+func (a *AddressState) init() {
+	if a.Counters == nil {
+		a.Counters = make(map[string]int64)
+	}
+	if a.Domains == nil {
+		a.Domains = make(map[string]string)
+	}
+	if a.DomainDates == nil {
+		a.DomainDates = make(map[string]time.Time)
+	}
+	// у доменов из состояния прошлых версий нет дат, считаем, что их выбрали сейчас
+	for hostname := range a.Domains {
+		if _, ok := a.DomainDates[hostname]; !ok {
+			a.DomainDates[hostname] = time.Now()
+		}
+	}
+	if a.Daily == nil {
+		a.Daily = make(map[string]int64)
+	}
+	a.mutex = new(sync.Mutex)
+}
+
+// обнуляет суточные счетчики, если наступили новые сутки
+// вызывается под семафором
+func (a *AddressState) checkDay(now time.Time) {
+	day := now.Format(warmupDateLayout)
+	if a.Day != day {
+		a.Day = day
+		a.Daily = make(map[string]int64)
+	}
+}
+
+// учитывает письмо, отправленное с ip
+// вызывается под семафором
+func (a *AddressState) count(ip string) {
+	a.checkDay(time.Now())
+	a.Counters[ip]++
+	a.Daily[ip]++
+}
+
+// забывает ip, закрепленные за доменами, которым давно не отправлялись письма
+func (a *AddressState) expire(now time.Time) {
+	a.mutex.Lock()
+	for hostname, date := range a.DomainDates {
+		if now.Sub(date) > stickyDomainLifetime {
+			delete(a.Domains, hostname)
+			delete(a.DomainDates, hostname)
+		}
+	}
+	a.mutex.Unlock()
+}
+
+// базовая стратегия
+type baseStrategy struct {
+	state *AddressState
+}
+
+func (b *baseStrategy) init(state *AddressState) {
+	b.state = state
+}
+
+// счетчики увеличиваются только после отправки, поэтому письма, которые не удалось отправить с ip,
+// не расходуют квоту прогрева и не смещают распределение по весам
+func (b *baseStrategy) count(ip string) {
+	b.state.mutex.Lock()
+	b.state.count(ip)
+	b.state.mutex.Unlock()
+}
+
+// выбирает ip по номеру заготовщика
+type PreparerStrategy struct {
+	baseStrategy
+}
+
+func (p *PreparerStrategy) choose(event *ConnectionEvent, addresses []*Address) string {
+	return addresses[event.connectorId%len(addresses)].IP
+}
+
+// выбирает ip по очереди
+type RoundRobinStrategy struct {
+	baseStrategy
+}
+
+func (r *RoundRobinStrategy) choose(event *ConnectionEvent, addresses []*Address) string {
+	r.state.mutex.Lock()
+	ip := addresses[r.state.Position%uint64(len(addresses))].IP
+	r.state.Position++
+	r.state.mutex.Unlock()
+	return ip
+}
+
+// выбирает ip пропорционально весам
+// выбирается ip с наименьшим отношением количества писем к весу,
+// поэтому после перезапуска распределение продолжается с сохраненных счетчиков
+type WeightedStrategy struct {
+	baseStrategy
+}
+
+func (w *WeightedStrategy) choose(event *ConnectionEvent, addresses []*Address) string {
+	w.state.mutex.Lock()
+	ip := w.chooseWeighted(addresses)
+	w.state.mutex.Unlock()
+	return ip
+}
+
+// выбирает ip из переданных пропорционально весам
+// вызывается под семафором
+func (w *WeightedStrategy) chooseWeighted(addresses []*Address) string {
+	var target *Address
+	var targetRatio float64
+	for _, address := range addresses {
+		ratio := float64(w.state.Counters[address.IP]+1) / float64(address.Weight)
+		if target == nil || ratio < targetRatio {
+			target = address
+			targetRatio = ratio
+		}
+	}
+	if target == nil {
+		return ""
+	} else {
+		return target.IP
+	}
+}
+
+// закрепляет за доменом получателя один ip
+// новые домены распределяются по очереди, домены, которым давно не отправлялись письма, забываются
+type StickyStrategy struct {
+	baseStrategy
+}
+
+func (s *StickyStrategy) choose(event *ConnectionEvent, addresses []*Address) string {
+	hostnameTo := event.Message.HostnameTo
+	s.state.mutex.Lock()
+	ip, ok := s.state.Domains[hostnameTo]
+	// если ip удалили из настроек или у ip другое семейство адресов, закрепляем за доменом другой ip
+	if !ok || !s.hasAddress(addresses, ip) {
+		ip = addresses[s.state.Position%uint64(len(addresses))].IP
+		s.state.Position++
+		s.state.Domains[hostnameTo] = ip
+	}
+	s.state.DomainDates[hostnameTo] = time.Now()
+	s.state.mutex.Unlock()
+	return ip
+}
+
+// проверяет, что ip есть среди переданных
+func (s *StickyStrategy) hasAddress(addresses []*Address, ip string) bool {
+	for _, address := range addresses {
+		if address.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// отдает прогреваемым ip письма в пределах суточной квоты,
+// остальные письма распределяются по прогретым ip пропорционально весам
+type WarmupStrategy struct {
+	WeightedStrategy
+}
+
+func (w *WarmupStrategy) choose(event *ConnectionEvent, addresses []*Address) string {
+	now := time.Now()
+	w.state.mutex.Lock()
+	w.state.checkDay(now)
+	warmed := make([]*Address, 0, len(addresses))
+	warming := make([]*Address, 0)
+	for _, address := range addresses {
+		var quota int64 = -1
+		if address.Warmup != nil {
+			quota = address.Warmup.quota(now)
+		}
+		if quota < 0 {
+			warmed = append(warmed, address)
+		} else if w.state.Daily[address.IP] < quota {
+			warming = append(warming, address)
+		}
+	}
+	// сначала отдаем письма прогреваемым ip, иначе они не наберут нужный объем
+	ip := w.chooseWeighted(warming)
+	if len(ip) == 0 {
+		ip = w.chooseWeighted(warmed)
+	}
+	w.state.mutex.Unlock()
+	return ip
+}
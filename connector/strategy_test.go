@@ -0,0 +1,58 @@
+package connector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/actionpay/postmanq/common"
+)
+
+func newTestConnectionEvent(hostnameTo string) *ConnectionEvent {
+	message := &common.MailMessage{Envelope: "sender@example.com", Recipient: "user@" + hostnameTo}
+	message.Init()
+	return &ConnectionEvent{SendEvent: common.NewSendEvent(message)}
+}
+
+func TestWarmupStrategyCountsOnlySentMails(t *testing.T) {
+	now := time.Now()
+	warming := &Address{IP: "1.1.1.1", Weight: 1, Warmup: &Warmup{Start: now.Format(warmupDateLayout), Days: 10, Initial: 2, Target: 2}}
+	warming.Warmup.init()
+	warmed := &Address{IP: "2.2.2.2", Weight: 1}
+	addresses := []*Address{warming, warmed}
+	strategy := new(WarmupStrategy)
+	strategy.init(newAddressState())
+
+	// письма, которые не удалось отправить, не расходуют квоту
+	for i := 0; i < 5; i++ {
+		if ip := strategy.choose(newTestConnectionEvent("a.test"), addresses); ip != warming.IP {
+			t.Fatalf("expected warming ip, got %s", ip)
+		}
+	}
+	strategy.count(warming.IP)
+	strategy.count(warming.IP)
+	if ip := strategy.choose(newTestConnectionEvent("a.test"), addresses); ip != warmed.IP {
+		t.Fatalf("expected warmed ip after quota, got %s", ip)
+	}
+}
+
+func TestStickyStrategyExpiresDomains(t *testing.T) {
+	addresses := []*Address{{IP: "1.1.1.1", Weight: 1}, {IP: "2.2.2.2", Weight: 1}}
+	state := newAddressState()
+	strategy := new(StickyStrategy)
+	strategy.init(state)
+
+	first := strategy.choose(newTestConnectionEvent("a.test"), addresses)
+	if ip := strategy.choose(newTestConnectionEvent("a.test"), addresses); ip != first {
+		t.Fatalf("expected sticky ip %s, got %s", first, ip)
+	}
+	strategy.choose(newTestConnectionEvent("b.test"), addresses)
+
+	state.expire(time.Now().Add(stickyDomainLifetime / 2))
+	if len(state.Domains) != 2 {
+		t.Fatalf("domains shouldn't expire yet, got %v", state.Domains)
+	}
+	state.expire(time.Now().Add(stickyDomainLifetime + time.Hour))
+	if len(state.Domains) != 0 || len(state.DomainDates) != 0 {
+		t.Fatalf("domains should expire, got %v", state.Domains)
+	}
+}
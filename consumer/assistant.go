@@ -47,6 +47,7 @@ func (a *Assistant) publish(id int, channel *amqp.Channel, deliveries <-chan amq
 		message := new(common.MailMessage)
 		err := json.Unmarshal(delivery.Body, message)
 		if err == nil {
+			// письмо с невалидным адресом перекладывается как есть, получатель из очереди сам отправит его в очередь для ошибок
 			message.Init()
 			logger.
 				By(message.HostnameFrom).
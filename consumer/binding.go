@@ -32,6 +32,15 @@ const (
 
 	// неизвестная проблема
 	UnknownFailureBindingType
+
+	// письмо нарушает политику очереди
+	PolicyFailureBindingType
+
+	// письмо отозвано, например, получатель в списке подавления
+	RevokedFailureBindingType
+
+	// невалидный адрес отправителя или получателя
+	AddressFailureBindingType
 )
 
 var (
@@ -40,6 +49,9 @@ var (
 		TechnicalFailureBindingType:  "%s.failure.technical",
 		ConnectionFailureBindingType: "%s.failure.connection",
 		UnknownFailureBindingType:    "%s.failure.unknown",
+		PolicyFailureBindingType:     "%s.failure.policy",
+		RevokedFailureBindingType:    "%s.revoked",
+		AddressFailureBindingType:    "%s.failure.address",
 	}
 
 	// отложенные очереди вообще
@@ -63,8 +75,14 @@ var (
 	// отложенные очереди для лимитов
 	limitBindings = []common.DelayedBindingType{
 		common.SecondDelayedBinding,
+		common.ThirtySecondDelayedBinding,
 		common.MinuteDelayedBinding,
+		common.FiveMinutesDelayedBinding,
+		common.TenMinutesDelayedBinding,
+		common.TwentyMinutesDelayedBinding,
+		common.ThirtyMinutesDelayedBinding,
 		common.HourDelayedBinding,
+		common.SixHoursDelayedBinding,
 		common.DayDelayedBinding,
 	}
 
@@ -117,6 +135,9 @@ type Binding struct {
 	// количество сообщений, получаемых одновременно
 	PrefetchCount int `yaml:"prefetchCount"`
 
+	// в очередь попадают письма, пересылаемые из других систем, такие письма запечатываются ARC
+	Forwarding bool `yaml:"forwarding"`
+
 	// отложенные очереди
 	delayedBindings map[common.DelayedBindingType]*Binding
 
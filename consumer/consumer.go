@@ -7,15 +7,20 @@ import (
 	"github.com/actionpay/postmanq/logger"
 	"github.com/streadway/amqp"
 	"regexp"
+	"strconv"
 	"sync"
+	"time"
 )
 
 var (
 	// обработчики результата отправки письма
 	resultHandlers = map[common.SendEventResult]func(*Consumer, *amqp.Channel, *common.MailMessage){
-		common.ErrorSendEventResult:     (*Consumer).handleErrorSend,
-		common.DelaySendEventResult:     (*Consumer).handleDelaySend,
-		common.OverlimitSendEventResult: (*Consumer).handleOverlimitSend,
+		common.ErrorSendEventResult:          (*Consumer).handleErrorSend,
+		common.DelaySendEventResult:          (*Consumer).handleDelaySend,
+		common.OverlimitSendEventResult:      (*Consumer).handleOverlimitSend,
+		common.RejectSendEventResult:         (*Consumer).handleRejectSend,
+		common.RevokeSendEventResult:         (*Consumer).handleRevokeSend,
+		common.TechnicalErrorSendEventResult: (*Consumer).handleTechnicalErrorSend,
 	}
 )
 
@@ -25,14 +30,17 @@ type Consumer struct {
 	connect    *amqp.Connection
 	binding    *Binding
 	deliveries <-chan amqp.Delivery
+	// шаблоны писем по имени
+	templates map[string]*mailTemplate
 }
 
 // создает нового получателя
-func NewConsumer(id int, connect *amqp.Connection, binding *Binding) *Consumer {
+func NewConsumer(id int, connect *amqp.Connection, binding *Binding, templates map[string]*mailTemplate) *Consumer {
 	app := new(Consumer)
 	app.id = id
 	app.connect = connect
 	app.binding = binding
+	app.templates = templates
 	return app
 }
 
@@ -72,31 +80,42 @@ func (c *Consumer) consumeDeliveries(id int, channel *amqp.Channel, deliveries <
 		message := new(common.MailMessage)
 		err := json.Unmarshal(delivery.Body, message)
 		if err == nil {
-			// инициализируем параметры письма
-			message.Init()
-			logger.
-				By(message.HostnameFrom).
-				Info(
-				"consumer#%d-%d, handler#%d send mail#%d: envelope - %s, recipient - %s to mailer",
-				c.id,
-				message.Id,
-				id,
-				message.Id,
-				message.Envelope,
-				message.Recipient,
-			)
+			// инициализируем параметры письма, письмо с невалидным адресом отправить не получится
+			if err = message.Init(); err != nil {
+				logger.By(message.HostnameFrom).Warn("consumer#%d-%d can't send mail, error - %v", c.id, message.Id, err)
+				message.Error = &common.MailError{Message: fmt.Sprintf("553 5.1.3 %v", err), Code: 553}
+				c.publishFailureMessage(channel, c.binding.failureBindings[AddressFailureBindingType], message)
+			} else if err = c.render(message); err != nil {
+				logger.By(message.HostnameFrom).Err("consumer#%d-%d can't render template %s, error - %v", c.id, message.Id, message.Template, err)
+				message.Error = &common.MailError{Message: fmt.Sprintf("554 5.6.0 %v", err), Code: 554}
+				c.publishFailureMessage(channel, c.binding.failureBindings[TechnicalFailureBindingType], message)
+			} else {
+				logger.
+					By(message.HostnameFrom).
+					Info(
+					"consumer#%d-%d, handler#%d send mail#%d: envelope - %s, recipient - %s to mailer",
+					c.id,
+					message.Id,
+					id,
+					message.Id,
+					message.Envelope,
+					message.Recipient,
+				)
 
-			event := common.NewSendEvent(message)
-			logger.By(message.HostnameFrom).Debug("consumer#%d-%d send event", c.id, message.Id)
-			event.Iterator.Next().(common.SendingService).Events() <- event
-			// ждем результата,
-			// во время ожидания поток блокируется
-			// если этого не сделать, тогда невозможно будет подтвердить получение сообщения из очереди
-			if handler, ok := resultHandlers[<-event.Result]; ok {
-				handler(c, channel, message)
+				event := common.NewSendEvent(message)
+				event.Binding = c.binding.Queue
+				event.Forwarding = c.binding.Forwarding
+				logger.By(message.HostnameFrom).Debug("consumer#%d-%d send event", c.id, message.Id)
+				event.Iterator.Next().(common.SendingService).Events() <- event
+				// ждем результата,
+				// во время ожидания поток блокируется
+				// если этого не сделать, тогда невозможно будет подтвердить получение сообщения из очереди
+				if handler, ok := resultHandlers[<-event.Result]; ok {
+					handler(c, channel, message)
+				}
+				message = nil
+				event = nil
 			}
-			message = nil
-			event = nil
 		} else {
 			failureBinding := c.binding.failureBindings[TechnicalFailureBindingType]
 			err = channel.Publish(
@@ -119,6 +138,25 @@ func (c *Consumer) consumeDeliveries(id int, channel *amqp.Channel, deliveries <
 	}
 }
 
+// создает письмо из шаблона, письмо без шаблона не меняется
+// письмо создается до проверки политик и отправки, чтобы отправитель не держал соединение во время создания письма
+func (c *Consumer) render(message *common.MailMessage) error {
+	if len(message.Template) == 0 {
+		return nil
+	}
+	tpl, ok := c.templates[message.Template]
+	if !ok {
+		return fmt.Errorf("template %s is not found", message.Template)
+	}
+	body, err := tpl.render(message)
+	if err == nil {
+		logger.By(message.HostnameFrom).Debug("consumer#%d-%d success render template %s", c.id, message.Id, message.Template)
+		message.Body = body
+		message.Template = common.EmptyStr
+	}
+	return err
+}
+
 // обрабатывает письма, которые не удалось отправить
 func (c *Consumer) handleErrorSend(channel *amqp.Channel, message *common.MailMessage) {
 	// если есть ошибка при отправке, значит мы попали в серый список https://ru.wikipedia.org/wiki/%D0%A1%D0%B5%D1%80%D1%8B%D0%B9_%D1%81%D0%BF%D0%B8%D1%81%D0%BE%D0%BA
@@ -129,12 +167,37 @@ func (c *Consumer) handleErrorSend(channel *amqp.Channel, message *common.MailMe
 	// перекладываем письмо в очередь для плохих писем
 	// и пусть отправители сами с ними разбираются
 	if message.Error.Code >= 500 && message.Error.Code < 600 {
-		failureBinding = c.binding.failureBindings[errorSignsMap.BindingType(message)]
+		bindingType := errorSignsMap.BindingType(message)
+		failureBinding = c.binding.failureBindings[bindingType]
+		// на адрес, который не существует, больше не отправляем
+		if bindingType == RecipientFailureBindingType && common.Suppressions != nil {
+			common.Suppressions.SuppressBounce(message.Recipient, message.Error.Message)
+		}
 	} else if message.Error.Code == 450 || message.Error.Code == 451 { // мы точно попали в серый список, надо повторить отправку письма попозже
 		failureBinding = delayedBindings[common.ThirtyMinutesDelayedBinding]
 	} else {
 		failureBinding = c.binding.failureBindings[UnknownFailureBindingType]
 	}
+	c.publishFailureMessage(channel, failureBinding, message)
+}
+
+// обрабатывает письма, нарушившие политику очереди
+func (c *Consumer) handleRejectSend(channel *amqp.Channel, message *common.MailMessage) {
+	c.publishFailureMessage(channel, c.binding.failureBindings[PolicyFailureBindingType], message)
+}
+
+// обрабатывает отозванные письма, письма сохраняются, чтобы их можно было проверить и отправить повторно
+func (c *Consumer) handleRevokeSend(channel *amqp.Channel, message *common.MailMessage) {
+	c.publishFailureMessage(channel, c.binding.failureBindings[RevokedFailureBindingType], message)
+}
+
+// обрабатывает письма, которые не удалось отправить из-за ошибки на нашей стороне
+func (c *Consumer) handleTechnicalErrorSend(channel *amqp.Channel, message *common.MailMessage) {
+	c.publishFailureMessage(channel, c.binding.failureBindings[TechnicalFailureBindingType], message)
+}
+
+// кладет письмо в очередь для ошибок
+func (c *Consumer) publishFailureMessage(channel *amqp.Channel, failureBinding *Binding, message *common.MailMessage) {
 	jsonMessage, err := json.Marshal(message)
 	if err == nil {
 		// кладем в очередь
@@ -212,7 +275,7 @@ func (c *Consumer) handleDelaySend(channel *amqp.Channel, message *common.MailMe
 	if chainBinding, ok := bindingsChain[message.BindingType]; ok {
 		bindingType = chainBinding
 	}
-	c.publishDelayedMessage(channel, bindingType, message)
+	c.publishDelayedMessage(channel, bindingType, message, 0)
 }
 
 // обрабатывает письма, которые превысили лимит отправки
@@ -225,11 +288,13 @@ func (c *Consumer) handleOverlimitSend(channel *amqp.Channel, message *common.Ma
 			break
 		}
 	}
-	c.publishDelayedMessage(channel, bindingType, message)
+	// письмо лежит в очереди ровно столько, сколько ждать жетонов, время ожидания очереди ограничивает его сверху
+	c.publishDelayedMessage(channel, bindingType, message, message.Delay)
 }
 
 // кладет письмо обратно в одну из отложенных очередей
-func (c *Consumer) publishDelayedMessage(channel *amqp.Channel, bindingType common.DelayedBindingType, message *common.MailMessage) {
+// если указан срок жизни письма, письмо вернется из очереди по его истечении, не дожидаясь времени ожидания очереди
+func (c *Consumer) publishDelayedMessage(channel *amqp.Channel, bindingType common.DelayedBindingType, message *common.MailMessage, expiration time.Duration) {
 	// получаем очередь, проверяем, что она реально есть
 	// а что? а вдруг нет)
 	if delayedBinding, ok := c.binding.delayedBindings[bindingType]; ok {
@@ -246,6 +311,7 @@ func (c *Consumer) publishDelayedMessage(channel *amqp.Channel, bindingType comm
 					ContentType:  "text/plain",
 					Body:         []byte(jsonMessage),
 					DeliveryMode: amqp.Transient,
+					Expiration:   formatExpiration(expiration),
 				},
 			)
 			if err == nil {
@@ -261,6 +327,15 @@ func (c *Consumer) publishDelayedMessage(channel *amqp.Channel, bindingType comm
 	}
 }
 
+// возвращает срок жизни письма в миллисекундах, как его ожидает AMQP сервер, пустая строка означает, что срок не указан
+// срок округляется вверх, чтобы письмо не вернулось раньше, чем появятся жетоны
+func formatExpiration(expiration time.Duration) string {
+	if expiration <= 0 {
+		return common.EmptyStr
+	}
+	return strconv.FormatInt(int64((expiration+time.Millisecond-1)/time.Millisecond), 10)
+}
+
 // получает письма из всех очередей с ошибками
 func (c *Consumer) consumeFailureMessages(group *sync.WaitGroup) {
 	channel, err := c.connect.Channel()
@@ -0,0 +1,21 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatExpiration(t *testing.T) {
+	cases := map[time.Duration]string{
+		0:                                 "",
+		-time.Second:                      "",
+		31 * time.Second:                  "31000",
+		61*time.Minute + time.Microsecond: "3660001",
+		1500 * time.Microsecond:           "2",
+	}
+	for expiration, expected := range cases {
+		if formatted := formatExpiration(expiration); formatted != expected {
+			t.Errorf("expiration %v: expected %q, got %q", expiration, expected, formatted)
+		}
+	}
+}
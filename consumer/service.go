@@ -30,6 +30,12 @@ type Service struct {
 	consumers map[string][]*Consumer
 
 	assistants map[string][]*Assistant
+
+	// папка с шаблонами писем
+	TemplatesDir string `yaml:"templates"`
+
+	// шаблоны писем по имени
+	templates map[string]*mailTemplate
 }
 
 // создает новый сервис получения сообщений
@@ -50,6 +56,15 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 	// получаем настройки
 	err := yaml.Unmarshal(event.Data, s)
 	if err == nil {
+		// письмо из шаблона создается до проверки политик, которые проверяют заголовки письма
+		if len(s.TemplatesDir) > 0 {
+			s.templates, err = loadTemplates(s.TemplatesDir)
+			if err == nil {
+				logger.All().Debug("consumer service read %d templates from %s", len(s.templates), s.TemplatesDir)
+			} else {
+				logger.All().FailExitWithErr(err)
+			}
+		}
 		consumersCount := 0
 		assistantsCount := 0
 		for _, config := range s.Configs {
@@ -81,7 +96,7 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 						}
 
 						consumersCount++
-						consumers[i] = NewConsumer(consumersCount, connect, binding)
+						consumers[i] = NewConsumer(consumersCount, connect, binding, s.templates)
 					}
 					assistants := make([]*Assistant, len(config.Assistants))
 					for i, assistantBinding := range config.Assistants {
@@ -0,0 +1,142 @@
+package consumer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/actionpay/postmanq/common"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// шаблон письма, состоит из текстовой и html части, одна из частей может отсутствовать
+type mailTemplate struct {
+	// текстовая часть, файл name.txt
+	text *texttemplate.Template
+
+	// html часть, файл name.html
+	html *htmltemplate.Template
+}
+
+// читает шаблоны писем из папки
+// имя шаблона - имя файла без расширения, текстовая часть читается из name.txt, html часть из name.html
+func loadTemplates(dir string) (map[string]*mailTemplate, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	templates := make(map[string]*mailTemplate)
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || ext != ".txt" && ext != ".html" {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ext)
+		tpl, ok := templates[name]
+		if !ok {
+			tpl = new(mailTemplate)
+			templates[name] = tpl
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err == nil {
+			// отсутствующая переменная скорее всего ошибка в письме, поэтому такое письмо не отправляем
+			if ext == ".txt" {
+				tpl.text, err = texttemplate.New(name).Option("missingkey=error").Parse(string(data))
+			} else {
+				tpl.html, err = htmltemplate.New(name).Option("missingkey=error").Parse(string(data))
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read template %s, error - %v", file.Name(), err)
+		}
+	}
+	return templates, nil
+}
+
+// создает из шаблона MIME письмо с текстовой и html частями в quoted-printable
+func (t *mailTemplate) render(message *common.MailMessage) (string, error) {
+	headers := new(bytes.Buffer)
+	for _, header := range []struct {
+		name, value, fallback string
+	}{
+		{"From", message.From, message.Envelope},
+		{"To", message.To, message.Recipient},
+	} {
+		if len(header.value) == 0 {
+			header.value = header.fallback
+		}
+		address, err := mail.ParseAddress(header.value)
+		if err != nil {
+			return common.EmptyStr, fmt.Errorf("invalid %s %s, error - %v", header.name, header.value, err)
+		}
+		// имя кодируется по RFC 2047
+		headers.WriteString(common.FoldHeader(fmt.Sprintf("%s: %s\r\n", header.name, address.String()), common.RecommendedLineLen))
+	}
+	headers.WriteString(common.FoldHeader(fmt.Sprintf("Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject)), common.RecommendedLineLen))
+	headers.WriteString("MIME-Version: 1.0\r\n")
+
+	parts := make([]*bytes.Buffer, 0, 2)
+	contentTypes := make([]string, 0, 2)
+	if t.text != nil {
+		part := new(bytes.Buffer)
+		if err := t.text.Execute(part, message.Vars); err != nil {
+			return common.EmptyStr, err
+		}
+		parts = append(parts, part)
+		contentTypes = append(contentTypes, "text/plain; charset=utf-8")
+	}
+	if t.html != nil {
+		part := new(bytes.Buffer)
+		if err := t.html.Execute(part, message.Vars); err != nil {
+			return common.EmptyStr, err
+		}
+		parts = append(parts, part)
+		contentTypes = append(contentTypes, "text/html; charset=utf-8")
+	}
+
+	body := new(bytes.Buffer)
+	if len(parts) == 1 {
+		fmt.Fprintf(headers, "Content-Type: %s\r\n", contentTypes[0])
+		headers.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+		if err := writeQuotedPrintable(body, parts[0]); err != nil {
+			return common.EmptyStr, err
+		}
+	} else {
+		writer := multipart.NewWriter(body)
+		headers.WriteString(common.FoldHeader(fmt.Sprintf("Content-Type: multipart/alternative; boundary=\"%s\"\r\n", writer.Boundary()), common.RecommendedLineLen))
+		for i, part := range parts {
+			partWriter, err := writer.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {contentTypes[i]},
+				"Content-Transfer-Encoding": {"quoted-printable"},
+			})
+			if err == nil {
+				err = writeQuotedPrintable(partWriter, part)
+			}
+			if err != nil {
+				return common.EmptyStr, err
+			}
+		}
+		if err := writer.Close(); err != nil {
+			return common.EmptyStr, err
+		}
+	}
+	return headers.String() + "\r\n" + body.String(), nil
+}
+
+// кодирует часть письма в quoted-printable
+func writeQuotedPrintable(w io.Writer, part *bytes.Buffer) error {
+	writer := quotedprintable.NewWriter(w)
+	_, err := writer.Write(part.Bytes())
+	if err == nil {
+		err = writer.Close()
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package consumer
+
+import (
+	"github.com/actionpay/postmanq/common"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tpl")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "welcome.txt"), []byte("Привет, {{.name}}!\n"+strings.Repeat("длинная строка ", 20)+"\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "welcome.html"), []byte("<p>Привет, {{.name}}!</p>"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "only.txt"), []byte("hi {{.name}}"), 0644)
+	tpls, err := loadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &common.MailMessage{Envelope: "a@b.example", Recipient: "c@d.example", From: "Отдел <a@b.example>", Subject: "Тема письма", Vars: map[string]interface{}{"name": "<Вася>"}}
+	body, err := tpls["welcome"].render(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := new(mime.WordDecoder)
+	if s, _ := dec.DecodeHeader(msg.Header.Get("Subject")); s != "Тема письма" {
+		t.Fatal(s)
+	}
+	if a, _ := msg.Header.AddressList("From"); a[0].Name != "Отдел" {
+		t.Fatal(a)
+	}
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	p1, _ := r.NextPart()
+	b1, _ := ioutil.ReadAll(p1)
+	p2, _ := r.NextPart()
+	b2, _ := ioutil.ReadAll(p2)
+	if !strings.HasPrefix(string(b1), "Привет, <Вася>!\r\n") || string(b2) != "<p>Привет, &lt;Вася&gt;!</p>" {
+		t.Fatalf("%q %q", b1, b2)
+	}
+	for _, l := range strings.Split(body, "\r\n") {
+		if len(l) > 78 {
+			t.Fatal(l)
+		}
+	}
+	if _, err := tpls["only"].render(&common.MailMessage{Envelope: "a@b.example", Recipient: "c@d.example"}); err == nil {
+		t.Fatal("missing key")
+	}
+	body, _ = tpls["only"].render(&common.MailMessage{Envelope: "a@b.example", Recipient: "c@d.example", Vars: map[string]interface{}{"name": "x"}})
+	if !strings.Contains(body, "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nhi x") {
+		t.Fatalf("%q", body)
+	}
+}
@@ -1,11 +1,13 @@
 package guardian
 
 import (
+	"fmt"
 	"github.com/actionpay/postmanq/common"
 	"github.com/actionpay/postmanq/logger"
+	"time"
 )
 
-// защитник, блокирует отправку на указанные почтовые сервисы
+// защитник, блокирует отправку на указанные почтовые сервисы и адреса из списка подавления
 type Guardian struct {
 	// идентификатор для логов
 	id int
@@ -28,18 +30,20 @@ func (g *Guardian) run() {
 func (g *Guardian) guard(event *common.SendEvent) {
 	logger.By(event.Message.HostnameFrom).Info("guardian#%d-%d check mail", g.id, event.Message.Id)
 
-	excludes := service.getExcludes(event.Message.HostnameFrom)
-	isExclude := false
-	for _, exclude := range excludes {
-		if exclude == event.Message.HostnameTo {
-			isExclude = true
-			break
+	message := event.Message
+	if action, err := service.checkPolicy(event); err != nil {
+		logger.By(message.HostnameFrom).Warn("guardian#%d-%d mail violates policy of %s - %v, %s mail", g.id, message.Id, event.Binding, err, action)
+		if action == RevokePolicyAction {
+			common.RevokeMail(event, fmt.Sprintf("policy of %s: %v", event.Binding, err))
+		} else {
+			common.RejectMail(event, 550, fmt.Sprintf("550 5.7.1 %v", err))
 		}
-	}
-
-	if isExclude {
-		logger.By(event.Message.HostnameFrom).Debug("guardian#%d-%d detect postal worker - %s, revoke sending mail", g.id, event.Message.Id, event.Message.HostnameTo)
-		event.Result <- common.RevokeSendEventResult
+	} else if service.isExclude(message.HostnameFrom, message.HostnameTo) {
+		logger.By(message.HostnameFrom).Debug("guardian#%d-%d detect postal worker - %s, revoke sending mail", g.id, message.Id, message.HostnameTo)
+		common.RevokeMail(event, fmt.Sprintf("recipient domain %s is excluded", message.HostnameTo))
+	} else if suppression := service.suppressions.Find(message.Recipient, time.Now()); suppression != nil {
+		logger.By(message.HostnameFrom).Debug("guardian#%d-%d detect suppressed recipient %s by %s, reason - %s, revoke sending mail", g.id, message.Id, message.Recipient, suppression.Pattern, suppression.Reason)
+		common.RevokeMail(event, fmt.Sprintf("recipient is suppressed by %s, reason - %s", suppression.Pattern, suppression.Reason))
 	} else {
 		logger.By(event.Message.HostnameFrom).Debug("guardian#%d-%d continue sending mail", g.id, event.Message.Id)
 		event.Iterator.Next().(common.SendingService).Events() <- event
@@ -0,0 +1,234 @@
+package guardian
+
+import (
+	"errors"
+	"fmt"
+	"github.com/actionpay/postmanq/common"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// тип правила политики
+type PolicyRuleKind string
+
+const (
+	// отправитель должен быть из указанных доменов
+	EnvelopePolicyRuleKind PolicyRuleKind = "envelope"
+
+	// размер письма не должен превышать указанный
+	SizePolicyRuleKind PolicyRuleKind = "size"
+
+	// в письме должны быть указанные заголовки
+	HeadersPolicyRuleKind PolicyRuleKind = "headers"
+
+	// домен из заголовка From должен совпадать с доменом отправителя или быть его поддоменом
+	AlignmentPolicyRuleKind PolicyRuleKind = "alignment"
+
+	// получатель должен подходить хотя бы под один шаблон
+	AllowRecipientsPolicyRuleKind PolicyRuleKind = "allowRecipients"
+
+	// получатель не должен подходить ни под один шаблон
+	DenyRecipientsPolicyRuleKind PolicyRuleKind = "denyRecipients"
+)
+
+// действие, выполняемое с письмом, нарушившим правило
+type PolicyAction string
+
+const (
+	// письмо не нарушает политику и отправляется дальше
+	PassPolicyAction PolicyAction = "pass"
+
+	// письмо отзывается
+	RevokePolicyAction PolicyAction = "revoke"
+
+	// письмо перекладывается в очередь для ошибок политики, используется по умолчанию
+	FailurePolicyAction PolicyAction = "failure"
+)
+
+// правило политики
+type PolicyRule struct {
+	// тип правила
+	Kind PolicyRuleKind `yaml:"rule"`
+
+	// действие при нарушении правила
+	Action PolicyAction `yaml:"action"`
+
+	// домены, заголовки или шаблоны получателей
+	Values []string `yaml:"values"`
+
+	// максимальный размер письма в байтах
+	Max int `yaml:"max"`
+
+	// домены или заголовки для быстрого поиска
+	values map[string]bool
+
+	// шаблоны получателей, записываются так же, как в списке подавления
+	recipients *SuppressionList
+}
+
+// проверяет настройки правила и готовит его к проверке писем
+func (r *PolicyRule) init() error {
+	if len(r.Action) == 0 {
+		r.Action = FailurePolicyAction
+	} else if r.Action != RevokePolicyAction && r.Action != FailurePolicyAction {
+		return fmt.Errorf("unknown policy action %s", r.Action)
+	}
+	switch r.Kind {
+	case EnvelopePolicyRuleKind, HeadersPolicyRuleKind:
+		r.values = make(map[string]bool, len(r.Values))
+		for _, value := range r.Values {
+			r.values[strings.ToLower(value)] = true
+		}
+	case AllowRecipientsPolicyRuleKind, DenyRecipientsPolicyRuleKind:
+		r.recipients = newSuppressionList(common.EmptyStr)
+		for _, value := range r.Values {
+			recipient, err := NewSuppression(value, string(r.Kind), 0)
+			if err != nil {
+				return err
+			}
+			r.recipients.put(recipient)
+		}
+	case SizePolicyRuleKind:
+		if r.Max <= 0 {
+			return errors.New("size policy requires max")
+		}
+	case AlignmentPolicyRuleKind:
+	default:
+		return fmt.Errorf("unknown policy rule %s", r.Kind)
+	}
+	return nil
+}
+
+// проверяет, что правилу нужны заголовки письма
+func (r *PolicyRule) needHeader() bool {
+	return r.Kind == HeadersPolicyRuleKind || r.Kind == AlignmentPolicyRuleKind
+}
+
+// проверяет письмо, возвращает описание нарушения или nil
+func (r *PolicyRule) check(message *common.MailMessage, header mail.Header, preprocess *Preprocess) error {
+	switch r.Kind {
+	case EnvelopePolicyRuleKind:
+		if !r.values[strings.ToLower(message.HostnameFrom)] {
+			return fmt.Errorf("envelope domain %s is not allowed", message.HostnameFrom)
+		}
+	case SizePolicyRuleKind:
+		if len(message.Body) > r.Max {
+			return fmt.Errorf("mail size %d exceeds %d bytes", len(message.Body), r.Max)
+		}
+	case HeadersPolicyRuleKind:
+		for _, value := range r.Values {
+			if len(header.Get(value)) == 0 && !preprocess.adds(message, header, value) {
+				return fmt.Errorf("header %s is required", value)
+			}
+		}
+	case AlignmentPolicyRuleKind:
+		from, err := mail.ParseAddress(header.Get("From"))
+		if err != nil {
+			return fmt.Errorf("invalid header From, error - %v", err)
+		}
+		domain := strings.ToLower(from.Address[strings.LastIndex(from.Address, "@")+1:])
+		if !isAligned(domain, strings.ToLower(message.HostnameFrom)) {
+			return fmt.Errorf("header From domain %s is not aligned with envelope domain %s", domain, message.HostnameFrom)
+		}
+	case AllowRecipientsPolicyRuleKind:
+		if r.recipients.Find(message.Recipient, time.Now()) == nil {
+			return fmt.Errorf("recipient %s is not allowed", message.Recipient)
+		}
+	case DenyRecipientsPolicyRuleKind:
+		if suppression := r.recipients.Find(message.Recipient, time.Now()); suppression != nil {
+			return fmt.Errorf("recipient %s is denied by %s", message.Recipient, suppression.Pattern)
+		}
+	}
+	return nil
+}
+
+// настройки подготовки письма, те же, что у mailer
+// guardian проверяет письмо раньше mailer, поэтому ему нужно знать, какие заголовки mailer добавит
+type Preprocess struct {
+	// добавлять Message-ID
+	MessageId bool `yaml:"messageId"`
+
+	// добавлять Date
+	Date bool `yaml:"date"`
+
+	// добавлять Return-Path
+	ReturnPath bool `yaml:"returnPath"`
+
+	// добавлять List-Unsubscribe и List-Unsubscribe-Post из ссылок для отписки письма
+	ListUnsubscribe bool `yaml:"listUnsubscribe"`
+
+	// идентификатор отправителя для заголовка Feedback-ID
+	FeedbackSenderId string `yaml:"feedbackId"`
+}
+
+// проверяет, что mailer добавит заголовок в письмо, если его там нет
+func (p *Preprocess) adds(message *common.MailMessage, header mail.Header, name string) bool {
+	if p == nil {
+		return false
+	}
+	switch strings.ToLower(name) {
+	case "message-id":
+		return p.MessageId
+	case "date":
+		return p.Date
+	case "return-path":
+		return p.ReturnPath
+	case "list-unsubscribe":
+		return p.ListUnsubscribe && len(message.Unsubscribe) > 0
+	case "list-unsubscribe-post":
+		// отписка в один клик возможна только по https ссылке и добавляется только вместе с List-Unsubscribe
+		if p.ListUnsubscribe && len(header.Get("List-Unsubscribe")) == 0 {
+			for _, link := range message.Unsubscribe {
+				if strings.HasPrefix(strings.ToLower(link), "https:") {
+					return true
+				}
+			}
+		}
+		return false
+	case "feedback-id":
+		return len(message.FeedbackId) > 0 || len(p.FeedbackSenderId) > 0
+	default:
+		return false
+	}
+}
+
+// проверяет, что домены совпадают или один является поддоменом другого
+func isAligned(domain, otherDomain string) bool {
+	return domain == otherDomain ||
+		strings.HasSuffix(domain, "."+otherDomain) ||
+		strings.HasSuffix(otherDomain, "."+domain)
+}
+
+// политика очереди, правила проверяются по порядку до первого нарушения
+type Policy []*PolicyRule
+
+// проверяет настройки правил
+func (p Policy) init() error {
+	for _, rule := range p {
+		if err := rule.init(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// проверяет письмо, возвращает нарушенное правило и описание нарушения
+// письмо проверяется до подготовки mailer, поэтому заголовки, которые он добавит, в письме не требуются
+func (p Policy) check(message *common.MailMessage, preprocess *Preprocess) (*PolicyRule, error) {
+	var header mail.Header
+	for _, rule := range p {
+		if rule.needHeader() && header == nil {
+			// заголовки разбираем один раз и только если они нужны
+			parsed, err := mail.ReadMessage(strings.NewReader(message.Body))
+			if err != nil {
+				return rule, fmt.Errorf("can't parse mail headers, error - %v", err)
+			}
+			header = parsed.Header
+		}
+		if err := rule.check(message, header, preprocess); err != nil {
+			return rule, err
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,112 @@
+package guardian
+
+import (
+	"github.com/actionpay/postmanq/common"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	p := Policy{
+		{Kind: EnvelopePolicyRuleKind, Values: []string{"example.com"}},
+		{Kind: SizePolicyRuleKind, Max: 1000},
+		{Kind: HeadersPolicyRuleKind, Values: []string{"From", "Message-ID"}},
+		{Kind: AlignmentPolicyRuleKind},
+		{Kind: DenyRecipientsPolicyRuleKind, Values: []string{"*.test"}, Action: RevokePolicyAction},
+	}
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	body := "From: A <a@news.example.com>\r\nMessage-ID: <1@x>\r\n\r\nhi"
+	m := &common.MailMessage{Envelope: "b@Example.com", Recipient: "c@d.com", Body: body}
+	m.Init()
+	if r, err := p.check(m, nil); err != nil {
+		t.Fatal(r, err)
+	}
+	m.Recipient = "c@x.test"
+	if r, err := p.check(m, nil); err == nil || r.Action != RevokePolicyAction {
+		t.Fatal("deny")
+	}
+	m.Body = "From: a@other.com\r\n\r\n"
+	if r, err := p.check(m, nil); err == nil || r.Kind != HeadersPolicyRuleKind {
+		t.Fatal("headers", err)
+	}
+	m.Body = "From: a@other.com\r\nMessage-ID: <1>\r\n\r\n"
+	if r, err := p.check(m, nil); err == nil || r.Kind != AlignmentPolicyRuleKind {
+		t.Fatal("align", err)
+	}
+}
+
+func TestCheckPolicyAction(t *testing.T) {
+	s := &Service{
+		Configs: map[string]*Config{"example.com": {}},
+		Policies: map[string]Policy{
+			common.AllDomains: {{Kind: DenyRecipientsPolicyRuleKind, Values: []string{"*.test"}, Action: RevokePolicyAction}},
+		},
+	}
+	if err := s.Policies[common.AllDomains].init(); err != nil {
+		t.Fatal(err)
+	}
+	m := &common.MailMessage{Envelope: "b@example.com", Recipient: "c@d.com", Body: "From: b@example.com\r\n\r\nhi"}
+	m.Init()
+	event := &common.SendEvent{Message: m, Binding: "news"}
+	if action, err := s.checkPolicy(event); err != nil || action != PassPolicyAction {
+		t.Fatal("pass", action, err)
+	}
+	m.Recipient = "c@x.test"
+	if action, err := s.checkPolicy(event); err == nil || action != RevokePolicyAction {
+		t.Fatal("revoke", action, err)
+	}
+	m.Envelope = "b@other.com"
+	m.Init()
+	if action, err := s.checkPolicy(event); err == nil || action != FailurePolicyAction {
+		t.Fatal("failure", action, err)
+	}
+}
+
+// заголовки, которые добавит mailer, политика не требует от письма
+func TestPolicyHeadersAddedByPreprocess(t *testing.T) {
+	p := Policy{{Kind: HeadersPolicyRuleKind, Values: []string{"Message-ID", "Date", "List-Unsubscribe", "List-Unsubscribe-Post", "Feedback-ID"}}}
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	m := &common.MailMessage{Envelope: "b@example.com", Recipient: "c@d.com", Body: "From: b@example.com\r\n\r\nhi"}
+	m.Init()
+	preprocess := &Preprocess{MessageId: true, Date: true, ListUnsubscribe: true, FeedbackSenderId: "example"}
+	if _, err := p.check(m, nil); err == nil {
+		t.Fatal("headers are required without preprocess")
+	}
+	if _, err := p.check(m, preprocess); err == nil {
+		t.Fatal("List-Unsubscribe isn't added without links")
+	}
+	m.Unsubscribe = []string{"mailto:u@example.com"}
+	if _, err := p.check(m, preprocess); err == nil {
+		t.Fatal("List-Unsubscribe-Post isn't added without https link")
+	}
+	m.Unsubscribe = append(m.Unsubscribe, "https://example.com/u")
+	if r, err := p.check(m, preprocess); err != nil {
+		t.Fatal(r, err)
+	}
+
+	// пересылаемое письмо не меняется, поэтому заголовки в нем обязательны
+	s := &Service{
+		Configs:  map[string]*Config{"example.com": {Preprocess: preprocess}},
+		Policies: map[string]Policy{common.AllDomains: p},
+	}
+	event := &common.SendEvent{Message: m, Binding: "news"}
+	if action, err := s.checkPolicy(event); err != nil || action != PassPolicyAction {
+		t.Fatal("pass", action, err)
+	}
+	event.Forwarding = true
+	if action, err := s.checkPolicy(event); err == nil || action != FailurePolicyAction {
+		t.Fatal("forwarded mail should keep required headers", action, err)
+	}
+}
+
+func TestRejectMail(t *testing.T) {
+	m := &common.MailMessage{Envelope: "b@example.com", Recipient: "c@d.com"}
+	event := common.NewSendEvent(m)
+	go common.RejectMail(event, 550, "550 5.7.1 header From is required")
+	if result := <-event.Result; result != common.RejectSendEventResult || m.Error == nil || m.Error.Code != 550 {
+		t.Fatal(result, m.Error)
+	}
+}
@@ -1,9 +1,12 @@
 package guardian
 
 import (
+	"fmt"
 	"github.com/actionpay/postmanq/common"
 	"github.com/actionpay/postmanq/logger"
 	yaml "gopkg.in/yaml.v2"
+	"strings"
+	"time"
 )
 
 var (
@@ -20,6 +23,21 @@ type Service struct {
 	GuardiansCount int `yaml:"workers"`
 
 	Configs map[string]*Config `yaml:"postmans"`
+
+	// политики очередей, в качестве ключа используется имя очереди, * - политика для остальных очередей
+	Policies map[string]Policy `yaml:"policies"`
+
+	// файл со списком подавления, необязательный параметр
+	SuppressionFilename string `yaml:"suppressionList"`
+
+	// сколько действует запись, добавленная после жесткого отказа, по умолчанию всегда
+	BounceTimeout time.Duration `yaml:"bounceSuppression"`
+
+	// сколько действует запись, добавленная после жалобы получателя, по умолчанию всегда
+	ComplaintTimeout time.Duration `yaml:"complaintSuppression"`
+
+	// список подавления
+	suppressions *SuppressionList
 }
 
 // создает новый сервис блокировок
@@ -38,6 +56,21 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 		if s.GuardiansCount == 0 {
 			s.GuardiansCount = common.DefaultWorkersCount
 		}
+		for _, conf := range s.Configs {
+			conf.init()
+		}
+		for queue, policy := range s.Policies {
+			if err := policy.init(); err != nil {
+				logger.All().FailExit("guardian can't init policy for %s, error - %v", queue, err)
+			}
+		}
+		s.suppressions = newSuppressionList(s.SuppressionFilename)
+		err = s.suppressions.Load()
+		if err == nil {
+			common.Suppressions = s
+		} else {
+			logger.All().FailExit("guardian can't read suppression list %s, error - %v", s.SuppressionFilename, err)
+		}
 	} else {
 		logger.All().FailExitWithErr(err)
 	}
@@ -48,6 +81,7 @@ func (s *Service) OnRun() {
 	for i := 0; i < s.GuardiansCount; i++ {
 		go newGuardian(i + 1)
 	}
+	go s.suppressions.sync()
 }
 
 // канал для приема событий отправки писем
@@ -58,17 +92,129 @@ func (s *Service) Events() chan *common.SendEvent {
 // завершает работу сервиса соединений
 func (s *Service) OnFinish() {
 	close(events)
+	if s.suppressions.hasPending() {
+		if err := s.suppressions.Save(); err != nil {
+			logger.All().Warn("guardian can't save suppression list to %s, error - %v", s.SuppressionFilename, err)
+		}
+	}
+}
+
+// добавляет адрес в список подавления после жесткого отказа
+func (s *Service) SuppressBounce(address, reason string) {
+	s.suppress(address, fmt.Sprintf("bounce: %s", reason), s.BounceTimeout)
+}
+
+// добавляет адрес в список подавления после жалобы получателя
+func (s *Service) SuppressComplaint(address, reason string) {
+	s.suppress(address, fmt.Sprintf("complaint: %s", reason), s.ComplaintTimeout)
+}
+
+// добавляет адрес в список подавления, если адрес еще не исключен
+func (s *Service) suppress(address, reason string, timeout time.Duration) {
+	if s.suppressions.Find(address, time.Now()) == nil {
+		suppression, err := NewSuppression(address, reason, timeout)
+		if err == nil {
+			s.suppressions.Add(suppression)
+			logger.All().Info("guardian suppress %s, reason - %s", suppression.Pattern, reason)
+		} else {
+			logger.All().Warn("guardian can't suppress %s, error - %v", address, err)
+		}
+	}
+}
+
+// управляет списком подавления из консоли
+func (s *Service) OnSuppress(event *common.ApplicationEvent) {
+	action := event.GetStringArg("action")
+	pattern := event.GetStringArg("pattern")
+	now := time.Now()
+	var err error
+	switch action {
+	case "list":
+		for _, suppression := range s.suppressions.All(now) {
+			fmt.Println(suppression)
+		}
+	case "check":
+		if suppression := s.suppressions.Find(pattern, now); suppression == nil {
+			fmt.Printf("%s is not suppressed\n", pattern)
+		} else {
+			fmt.Println(suppression)
+		}
+	case "add":
+		var suppression *Suppression
+		suppression, err = NewSuppression(pattern, event.GetStringArg("reason"), event.Args["timeout"].(time.Duration))
+		if err == nil {
+			s.suppressions.Add(suppression)
+			err = s.suppressions.Save()
+			if err == nil {
+				fmt.Printf("%s is suppressed\n", suppression.Pattern)
+			}
+		}
+	case "remove":
+		if s.suppressions.Remove(pattern) {
+			err = s.suppressions.Save()
+			if err == nil {
+				fmt.Printf("%s is removed\n", pattern)
+			}
+		} else {
+			fmt.Printf("%s is not found\n", pattern)
+		}
+	default:
+		err = fmt.Errorf("unknown action %s", action)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+	common.App.Events() <- common.NewApplicationEvent(common.FinishApplicationEventKind)
 }
 
-func (s Service) getExcludes(hostname string) []string {
+// проверяет письмо политикой очереди, из которой оно получено
+// возвращает действие и описание нарушения, если письмо нарушает политику
+func (s *Service) checkPolicy(event *common.SendEvent) (PolicyAction, error) {
+	message := event.Message
+	// письмо от неизвестного отправителя все равно не получится отправить, т.к. для него нет ip и настроек
+	if _, ok := s.Configs[message.HostnameFrom]; !ok {
+		return FailurePolicyAction, fmt.Errorf("envelope domain %s is not configured", message.HostnameFrom)
+	}
+	policy, ok := s.Policies[event.Binding]
+	if !ok {
+		policy = s.Policies[common.AllDomains]
+	}
+	// пересылаемое письмо отправляется без изменений, поэтому заголовки ему никто не добавит
+	preprocess := s.Configs[message.HostnameFrom].Preprocess
+	if event.Forwarding {
+		preprocess = nil
+	}
+	if rule, err := policy.check(message, preprocess); err == nil {
+		return PassPolicyAction, nil
+	} else {
+		return rule.Action, err
+	}
+}
+
+// проверяет, что отправка на почтовый сервис заблокирована
+func (s *Service) isExclude(hostname, hostnameTo string) bool {
 	if conf, ok := s.Configs[hostname]; ok {
-		return conf.Excludes
+		return conf.excludes[strings.ToLower(hostnameTo)]
 	} else {
-		return common.EmptyStrSlice
+		return false
 	}
 }
 
 type Config struct {
 	// хосты, на которую блокируется отправка писем
 	Excludes []string `yaml:"exclude"`
+
+	// подготовка письма перед отправкой, заголовки, которые добавит mailer, политика не требует от письма
+	Preprocess *Preprocess `yaml:"preprocess"`
+
+	// хосты для быстрого поиска
+	excludes map[string]bool
+}
+
+// заполняет хосты для быстрого поиска
+func (c *Config) init() {
+	c.excludes = make(map[string]bool, len(c.Excludes))
+	for _, exclude := range c.Excludes {
+		c.excludes[strings.ToLower(exclude)] = true
+	}
 }
@@ -0,0 +1,448 @@
+package guardian
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/actionpay/postmanq/logger"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// тип записи списка подавления
+type SuppressionKind int
+
+const (
+	// адрес, например user@example.com
+	AddressSuppressionKind SuppressionKind = iota
+
+	// домен, например example.com
+	DomainSuppressionKind
+
+	// поддомены, например *.example.com
+	SubdomainSuppressionKind
+
+	// маска адреса, например info@* или *-noreply@example.com
+	WildcardSuppressionKind
+
+	// регулярное выражение, например re:^test\d+@example\.com$
+	RegexpSuppressionKind
+)
+
+const (
+	// префикс регулярного выражения
+	regexpSuppressionPrefix = "re:"
+
+	// префикс поддоменов
+	subdomainSuppressionPrefix = "*."
+
+	// как часто список подавления сверяется с файлом
+	suppressionSyncInterval = 10 * time.Second
+)
+
+// запись списка подавления
+type Suppression struct {
+	// адрес, домен, маска или регулярное выражение
+	Pattern string `json:"pattern"`
+
+	// причина, по которой адрес исключен из рассылки
+	Reason string `json:"reason"`
+
+	// дата добавления
+	CreateDate time.Time `json:"createDate"`
+
+	// дата, после которой запись перестает действовать, нулевая дата означает, что запись действует всегда
+	ExpireDate time.Time `json:"expireDate"`
+
+	// тип записи
+	kind SuppressionKind
+
+	// регулярное выражение для масок и регулярных выражений
+	regexp *regexp.Regexp
+}
+
+// создает запись списка подавления
+// если ttl равен нулю, запись действует всегда
+func NewSuppression(pattern, reason string, ttl time.Duration) (*Suppression, error) {
+	suppression := &Suppression{
+		Pattern:    strings.ToLower(strings.TrimSpace(pattern)),
+		Reason:     reason,
+		CreateDate: time.Now(),
+	}
+	if ttl > 0 {
+		suppression.ExpireDate = suppression.CreateDate.Add(ttl)
+	}
+	return suppression, suppression.init()
+}
+
+// определяет тип записи и компилирует регулярное выражение
+func (s *Suppression) init() error {
+	var err error
+	if len(s.Pattern) == 0 {
+		err = errors.New("empty suppression pattern")
+	} else if strings.HasPrefix(s.Pattern, regexpSuppressionPrefix) {
+		s.kind = RegexpSuppressionKind
+		s.regexp, err = regexp.Compile(strings.TrimPrefix(s.Pattern, regexpSuppressionPrefix))
+	} else if strings.HasPrefix(s.Pattern, subdomainSuppressionPrefix) && !strings.ContainsAny(s.Pattern[2:], "*@") {
+		s.kind = SubdomainSuppressionKind
+	} else if strings.Contains(s.Pattern, "*") {
+		s.kind = WildcardSuppressionKind
+		parts := strings.Split(s.Pattern, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		s.regexp, err = regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+	} else if strings.Contains(s.Pattern, "@") {
+		s.kind = AddressSuppressionKind
+	} else {
+		s.kind = DomainSuppressionKind
+	}
+	return err
+}
+
+// проверяет, что запись действует
+func (s *Suppression) isActive(now time.Time) bool {
+	return s.ExpireDate.IsZero() || now.Before(s.ExpireDate)
+}
+
+// список подавления, адреса из него исключаются из рассылки
+// адреса, домены и поддомены ищутся по хешу, маски и регулярные выражения проверяются по очереди
+type SuppressionList struct {
+	// путь до файла со списком
+	filename string
+
+	// записи для адресов, в качестве ключа используется адрес
+	addresses map[string]*Suppression
+
+	// записи для доменов, в качестве ключа используется домен
+	domains map[string]*Suppression
+
+	// записи для поддоменов, в качестве ключа используется родительский домен
+	subdomains map[string]*Suppression
+
+	// маски и регулярные выражения
+	patterns []*Suppression
+
+	// записи, добавленные после последнего сохранения в файл
+	pending []*Suppression
+
+	// шаблоны, удаленные после последнего сохранения в файл
+	removed map[string]bool
+
+	// дата изменения файла при последнем чтении
+	modifyDate time.Time
+
+	// семафор
+	mutex *sync.RWMutex
+}
+
+// создает пустой список подавления
+func newSuppressionList(filename string) *SuppressionList {
+	list := &SuppressionList{
+		filename: filename,
+		removed:  make(map[string]bool),
+		mutex:    new(sync.RWMutex),
+	}
+	list.clear()
+	return list
+}
+
+// очищает список
+// вызывается под семафором
+func (s *SuppressionList) clear() {
+	s.addresses = make(map[string]*Suppression)
+	s.domains = make(map[string]*Suppression)
+	s.subdomains = make(map[string]*Suppression)
+	s.patterns = make([]*Suppression, 0)
+}
+
+// добавляет запись, запись с тем же шаблоном заменяется
+// вызывается под семафором
+func (s *SuppressionList) put(suppression *Suppression) {
+	switch suppression.kind {
+	case AddressSuppressionKind:
+		s.addresses[suppression.Pattern] = suppression
+	case DomainSuppressionKind:
+		s.domains[suppression.Pattern] = suppression
+	case SubdomainSuppressionKind:
+		s.subdomains[strings.TrimPrefix(suppression.Pattern, subdomainSuppressionPrefix)] = suppression
+	default:
+		for i, pattern := range s.patterns {
+			if pattern.Pattern == suppression.Pattern {
+				s.patterns[i] = suppression
+				return
+			}
+		}
+		s.patterns = append(s.patterns, suppression)
+	}
+}
+
+// удаляет запись по шаблону
+// удаление сохранится в файл при следующей сверке с файлом
+// возвращает false, если записи не было
+func (s *SuppressionList) Remove(pattern string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.remove(pattern) {
+		s.removed[pattern] = true
+		for i, suppression := range s.pending {
+			if suppression.Pattern == pattern {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				break
+			}
+		}
+		return true
+	} else {
+		return false
+	}
+}
+
+// удаляет запись по шаблону
+// вызывается под семафором
+func (s *SuppressionList) remove(pattern string) bool {
+	if _, ok := s.addresses[pattern]; ok {
+		delete(s.addresses, pattern)
+		return true
+	}
+	if _, ok := s.domains[pattern]; ok {
+		delete(s.domains, pattern)
+		return true
+	}
+	if _, ok := s.subdomains[strings.TrimPrefix(pattern, subdomainSuppressionPrefix)]; ok && strings.HasPrefix(pattern, subdomainSuppressionPrefix) {
+		delete(s.subdomains, strings.TrimPrefix(pattern, subdomainSuppressionPrefix))
+		return true
+	}
+	for i, suppression := range s.patterns {
+		if suppression.Pattern == pattern {
+			s.patterns = append(s.patterns[:i], s.patterns[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// добавляет запись в список
+// запись сохранится в файл при следующей сверке с файлом
+func (s *SuppressionList) Add(suppression *Suppression) {
+	s.mutex.Lock()
+	s.put(suppression)
+	s.pending = append(s.pending, suppression)
+	delete(s.removed, suppression.Pattern)
+	s.mutex.Unlock()
+}
+
+// ищет действующую запись для адреса
+// возвращает nil, если адрес не исключен из рассылки
+func (s *SuppressionList) Find(address string, now time.Time) *Suppression {
+	address = strings.ToLower(address)
+	domain := address[strings.LastIndex(address, "@")+1:]
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if suppression, ok := s.addresses[address]; ok && suppression.isActive(now) {
+		return suppression
+	}
+	if suppression, ok := s.domains[domain]; ok && suppression.isActive(now) {
+		return suppression
+	}
+	// поднимаемся по родительским доменам, a.b.example.com -> b.example.com -> example.com -> com
+	for parent := domain; strings.Contains(parent, "."); {
+		parent = parent[strings.Index(parent, ".")+1:]
+		if suppression, ok := s.subdomains[parent]; ok && suppression.isActive(now) {
+			return suppression
+		}
+	}
+	for _, suppression := range s.patterns {
+		if suppression.isActive(now) && suppression.regexp.MatchString(address) {
+			return suppression
+		}
+	}
+	return nil
+}
+
+// возвращает действующие записи, отсортированные по шаблону
+func (s *SuppressionList) All(now time.Time) []*Suppression {
+	s.mutex.RLock()
+	suppressions := s.all(now)
+	s.mutex.RUnlock()
+	sort.Slice(suppressions, func(i, j int) bool {
+		return suppressions[i].Pattern < suppressions[j].Pattern
+	})
+	return suppressions
+}
+
+// возвращает действующие записи
+// вызывается под семафором
+func (s *SuppressionList) all(now time.Time) []*Suppression {
+	suppressions := make([]*Suppression, 0, len(s.addresses)+len(s.domains)+len(s.subdomains)+len(s.patterns))
+	for _, group := range []map[string]*Suppression{s.addresses, s.domains, s.subdomains} {
+		for _, suppression := range group {
+			if suppression.isActive(now) {
+				suppressions = append(suppressions, suppression)
+			}
+		}
+	}
+	for _, suppression := range s.patterns {
+		if suppression.isActive(now) {
+			suppressions = append(suppressions, suppression)
+		}
+	}
+	return suppressions
+}
+
+// читает список из файла
+// изменения, которые еще не попали в файл, применяются поверх прочитанного списка
+// если файла нет, список не меняется
+func (s *SuppressionList) Load() error {
+	if len(s.filename) == 0 {
+		return nil
+	}
+	info, err := os.Stat(s.filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	bytes, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		return err
+	}
+	var suppressions []*Suppression
+	err = json.Unmarshal(bytes, &suppressions)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clear()
+	for _, suppression := range suppressions {
+		if err := suppression.init(); err == nil {
+			s.put(suppression)
+		} else {
+			logger.All().Warn("guardian skip invalid suppression %s, error - %v", suppression.Pattern, err)
+		}
+	}
+	// изменения, которые еще не попали в файл, не должны потеряться
+	for _, suppression := range s.pending {
+		s.put(suppression)
+	}
+	for pattern := range s.removed {
+		s.remove(pattern)
+	}
+	s.modifyDate = info.ModTime()
+	return nil
+}
+
+// сохраняет действующие записи в файл
+// файл меняют и сервис, и pmq-suppress, поэтому под блокировкой файла список сначала перечитывается,
+// а изменения, сделанные после последнего сохранения, применяются поверх него
+// сначала пишет во временный файл, чтобы при падении не потерять предыдущий список
+func (s *SuppressionList) Save() error {
+	if len(s.filename) == 0 {
+		return nil
+	}
+	lock, err := lockFile(s.filename)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+	err = s.Load()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bytes, err := json.MarshalIndent(s.all(time.Now()), "", "  ")
+	if err == nil {
+		tmpFilename := s.filename + ".tmp"
+		err = ioutil.WriteFile(tmpFilename, bytes, 0644)
+		if err == nil {
+			err = os.Rename(tmpFilename, s.filename)
+		}
+		if err == nil {
+			s.pending = nil
+			s.removed = make(map[string]bool)
+			if info, err := os.Stat(s.filename); err == nil {
+				s.modifyDate = info.ModTime()
+			}
+		}
+	}
+	return err
+}
+
+// блокирует файл, пока его меняет один процесс, другие ждут
+// блокируется отдельный файл, т.к. сам файл заменяется переименованием
+func lockFile(filename string) (*os.File, error) {
+	lock, err := os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err == nil {
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+	}
+	return lock, err
+}
+
+// снимает блокировку файла
+func unlockFile(lock *os.File) {
+	syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	lock.Close()
+}
+
+// проверяет, что файл изменили после последнего чтения, например, через pmq-suppress
+func (s *SuppressionList) isFileChanged() bool {
+	if len(s.filename) == 0 {
+		return false
+	}
+	info, err := os.Stat(s.filename)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return err == nil && !info.ModTime().Equal(s.modifyDate)
+}
+
+// проверяет, что есть изменения, которые еще не попали в файл
+func (s *SuppressionList) hasPending() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.pending) > 0 || len(s.removed) > 0
+}
+
+// периодически сверяет список с файлом:
+// перечитывает файл, если его изменили, и дописывает в файл новые записи
+func (s *SuppressionList) sync() {
+	for range time.Tick(suppressionSyncInterval) {
+		s.syncOnce()
+	}
+}
+
+// сверяет список с файлом
+func (s *SuppressionList) syncOnce() {
+	if s.isFileChanged() {
+		if err := s.Load(); err == nil {
+			logger.All().Info("guardian reload suppression list from %s", s.filename)
+		} else {
+			logger.All().Warn("guardian can't reload suppression list from %s, error - %v", s.filename, err)
+		}
+	}
+	if s.hasPending() {
+		if err := s.Save(); err != nil {
+			logger.All().Warn("guardian can't save suppression list to %s, error - %v", s.filename, err)
+		}
+	}
+}
+
+// возвращает описание записи для логов и консоли
+func (s *Suppression) String() string {
+	expire := "never"
+	if !s.ExpireDate.IsZero() {
+		expire = s.ExpireDate.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s", s.Pattern, s.CreateDate.Format(time.RFC3339), expire, s.Reason)
+}
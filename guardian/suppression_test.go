@@ -0,0 +1,90 @@
+package guardian
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSuppressionFind(t *testing.T) {
+	f := t.TempDir() + "/s.json"
+	l := newSuppressionList(f)
+	for _, p := range []string{"a@x.com", "y.com", "*.z.com", "info@*", `re:^test\d+@q\.com$`} {
+		s, err := NewSuppression(p, "r", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Add(s)
+	}
+	exp, _ := NewSuppression("old@x.com", "r", time.Nanosecond)
+	l.Add(exp)
+	time.Sleep(time.Millisecond)
+	now := time.Now()
+	for addr, want := range map[string]bool{"A@x.com": true, "b@x.com": false, "c@y.com": true, "c@sub.y.com": false, "c@a.b.z.com": true, "c@z.com": false, "info@k.org": true, "test12@q.com": true, "testx@q.com": false, "old@x.com": false} {
+		if (l.Find(addr, now) != nil) != want {
+			t.Errorf("%s want %v", addr, want)
+		}
+	}
+	if err := l.Save(); err != nil {
+		t.Fatal(err)
+	}
+	l2 := newSuppressionList(f)
+	if err := l2.Load(); err != nil || len(l2.All(now)) != 5 {
+		t.Fatal(err, len(l2.All(now)))
+	}
+	if !l2.Remove("*.z.com") || l2.Find("c@a.z.com", now) != nil || !l2.Remove("info@*") {
+		t.Fatal("remove")
+	}
+	os.Chtimes(f, now.Add(time.Hour), now.Add(time.Hour))
+	if !l.isFileChanged() {
+		t.Fatal("changed")
+	}
+}
+
+func TestSuppressionSaveMerge(t *testing.T) {
+	f := t.TempDir() + "/s.json"
+	initial := newSuppressionList(f)
+	for _, p := range []string{"z@x.com", "w@x.com"} {
+		s, _ := NewSuppression(p, "r", 0)
+		initial.Add(s)
+	}
+	if err := initial.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	daemon := newSuppressionList(f)
+	cli := newSuppressionList(f)
+	if err := daemon.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Load(); err != nil {
+		t.Fatal(err)
+	}
+	x, _ := NewSuppression("x@x.com", "r", 0)
+	daemon.Add(x)
+	y, _ := NewSuppression("y@x.com", "r", 0)
+	cli.Add(y)
+	if !cli.Remove("z@x.com") {
+		t.Fatal("remove")
+	}
+	if err := cli.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	result := newSuppressionList(f)
+	if err := result.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"x@x.com": true, "y@x.com": true, "w@x.com": true, "z@x.com": false} {
+		if (result.Find(addr, now) != nil) != want {
+			t.Errorf("%s want %v", addr, want)
+		}
+	}
+	if daemon.Find("y@x.com", now) == nil || daemon.Find("z@x.com", now) != nil || daemon.hasPending() {
+		t.Fatal("daemon list is not merged with file")
+	}
+}
@@ -29,7 +29,11 @@ go install cmd/postmanq.go
 go install cmd/pmq-grep.go
 go install cmd/pmq-publish.go
 go install cmd/pmq-report.go
+go install cmd/pmq-suppress.go
+go install cmd/pmq-dkim.go
 ln -s "$BASE_PATH/bin/postmanq" /usr/bin/
 ln -s "$BASE_PATH/bin/pmq-grep" /usr/bin/
 ln -s "$BASE_PATH/bin/pmq-publish" /usr/bin/
-ln -s "$BASE_PATH/bin/pmq-report" /usr/bin/
\ No newline at end of file
+ln -s "$BASE_PATH/bin/pmq-report" /usr/bin/
+ln -s "$BASE_PATH/bin/pmq-suppress" /usr/bin/
+ln -s "$BASE_PATH/bin/pmq-dkim" /usr/bin/
\ No newline at end of file
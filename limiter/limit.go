@@ -2,6 +2,7 @@ package limiter
 
 import (
 	"github.com/actionpay/postmanq/common"
+	"math"
 	"time"
 )
 
@@ -30,25 +31,54 @@ var (
 		HourKind:   common.HourDelayedBinding,
 		DayKind:    common.DayDelayedBinding,
 	}
+	// отложенные очереди для писем, превысивших ограничения, от самой короткой
+	// письмо возвращается из очереди по своему сроку жизни, а время ожидания очереди ограничивает его сверху
+	// AMQP сервер удаляет письма с истекшим сроком только из начала очереди, поэтому очереди разделены по срокам,
+	// и письмо с большим сроком задерживает письма за ним не дольше времени ожидания своей очереди
+	delayBindings = []common.DelayedBindingType{
+		common.SecondDelayedBinding,
+		common.ThirtySecondDelayedBinding,
+		common.MinuteDelayedBinding,
+		common.FiveMinutesDelayedBinding,
+		common.TenMinutesDelayedBinding,
+		common.TwentyMinutesDelayedBinding,
+		common.ThirtyMinutesDelayedBinding,
+		common.HourDelayedBinding,
+		common.SixHoursDelayedBinding,
+		common.DayDelayedBinding,
+	}
+	// время ожидания в отложенных очередях
+	delayBindingDurations = map[common.DelayedBindingType]time.Duration{
+		common.SecondDelayedBinding:        time.Second,
+		common.ThirtySecondDelayedBinding:  time.Second * 30,
+		common.MinuteDelayedBinding:        time.Minute,
+		common.FiveMinutesDelayedBinding:   time.Minute * 5,
+		common.TenMinutesDelayedBinding:    time.Minute * 10,
+		common.TwentyMinutesDelayedBinding: time.Minute * 20,
+		common.ThirtyMinutesDelayedBinding: time.Minute * 30,
+		common.HourDelayedBinding:          time.Hour,
+		common.SixHoursDelayedBinding:      time.Hour * 6,
+		common.DayDelayedBinding:           time.Hour * 24,
+	}
 )
 
 // ограничение
+// ограничение работает как ведро с жетонами: ведро вмещает burst жетонов,
+// жетоны пополняются равномерно, value жетонов за промежуток времени,
+// поэтому на границе промежутков нельзя отправить больше писем, чем разрешено
 type Limit struct {
 	// максимально допустимое количество писем
-	Value int32 `json:"value"`
+	Value int32 `yaml:"value" json:"value"`
 
 	// тип ограничения
-	Kind Kind `json:"type"`
+	Kind Kind `yaml:"type" json:"type"`
 
-	// текущее количество писем
-	currentValue int32
+	// количество писем, которое можно отправить разом, по умолчанию равно value
+	Burst int32 `yaml:"burst" json:"burst"`
 
 	// промежуток времени, за который проверяется количество отправленных писем
 	duration time.Duration
 
-	// дата последнего обнуления количества отправленных писем
-	modifyDate time.Time
-
 	// тип очереди, в которую необходимо положить письмо, если превышено количество отправленных писем
 	bindingType common.DelayedBindingType
 }
@@ -61,11 +91,181 @@ func (l *Limit) init() {
 	if bindingType, ok := limitBindingTypes[l.Kind]; ok {
 		l.bindingType = bindingType
 	}
+	if l.Burst <= 0 {
+		l.Burst = l.Value
+	}
+}
+
+// проверяет, что тип ограничения известен, а количество писем положительно
+func (l *Limit) isValid() bool {
+	return l.duration > 0 && l.Value > 0
+}
+
+// возвращает количество жетонов в секунду
+func (l *Limit) rate() float64 {
+	return float64(l.Value) / l.duration.Seconds()
+}
+
+// создает полное ведро жетонов
+func (l *Limit) newState(now time.Time) *LimitState {
+	return &LimitState{
+		Tokens:     float64(l.Burst),
+		RefillDate: now,
+	}
+}
+
+// пополняет жетоны пропорционально прошедшему времени
+func (l *Limit) refill(state *LimitState, now time.Time) {
+	if now.After(state.RefillDate) {
+		state.Tokens = math.Min(float64(l.Burst), state.Tokens+now.Sub(state.RefillDate).Seconds()*l.rate())
+		state.RefillDate = now
+	}
+}
+
+// возвращает время, через которое станет доступен жетон, нулевое время означает, что жетон есть
+func (l *Limit) wait(state *LimitState) time.Duration {
+	if state.Tokens >= 1 {
+		return 0
+	} else {
+		return time.Duration((1 - state.Tokens) / l.rate() * float64(time.Second))
+	}
+}
+
+// состояние ограничения, хранится в хранилище ограничений
+type LimitState struct {
+	// количество жетонов
+	Tokens float64 `json:"tokens"`
+
+	// дата последнего пополнения жетонов
+	RefillDate time.Time `json:"refillDate"`
+}
+
+// ограничения почтового сервиса, проверяются вместе,
+// например, не больше 10 писем в секунду, 1000 в час и 10000 в сутки
+// в настройках может быть указано одно ограничение или список ограничений
+type Limits struct {
+	// ключ, по которому состояние ограничений лежит в хранилище
+	key string
+
+	// ограничения
+	items []*Limit
+}
+
+// разбирает ограничения из настроек
+func (l *Limits) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items []*Limit
+	err := unmarshal(&items)
+	if err != nil {
+		limit := new(Limit)
+		err = unmarshal(limit)
+		if err == nil {
+			items = []*Limit{limit}
+		}
+	}
+	l.items = items
+	return err
+}
+
+// инициализирует ограничения
+func (l *Limits) init(key string) {
+	l.key = key
+	for _, limit := range l.items {
+		limit.init()
+	}
+}
+
+// создает полные ведра жетонов для всех ограничений
+func (l *Limits) newStates(now time.Time) []*LimitState {
+	states := make([]*LimitState, len(l.items))
+	for i, limit := range l.items {
+		states[i] = limit.newState(now)
+	}
+	return states
 }
 
-// сигнализирует о том, что надо ли обнулять текущее количество отправленных писем
-// если вернулось true, текущее количество отправленных писем не обнуляется
-// если вернулось false, текущее количество отправленных писем обнуляется
-func (l *Limit) isValidDuration(now time.Time) bool {
-	return now.Sub(l.modifyDate) <= l.duration
+// берет жетоны всех ограничений и возвращает время, через которое письмо можно будет отправить
+// нулевое время означает, что письмо можно отправить сейчас
+// жетоны берутся, только если они есть во всех ведрах, иначе отложенное письмо расходовало бы жетоны
+// ограничений, которые не превышены
+// вызывается хранилищем под блокировкой ключа, поэтому ограничения проверяются атомарно
+// если количество состояний не совпадает с количеством ограничений, значит изменились настройки, и ведра создаются заново
+func (l *Limits) take(states []*LimitState, now time.Time) ([]*LimitState, time.Duration) {
+	if len(states) != len(l.items) {
+		states = l.newStates(now)
+	}
+	var delay time.Duration
+	for i, limit := range l.items {
+		limit.refill(states[i], now)
+		if limitDelay := limit.wait(states[i]); limitDelay > delay {
+			delay = limitDelay
+		}
+	}
+	if delay == 0 {
+		for _, state := range states {
+			state.Tokens--
+		}
+	}
+	return states, delay
+}
+
+// возвращает жетоны всех ограничений, например, если письмо отправится с другого ip
+// если изменились настройки, возвращать нечего, т.к. ведра создаются заново
+func (l *Limits) give(states []*LimitState, now time.Time) []*LimitState {
+	if len(states) == len(l.items) {
+		for i, limit := range l.items {
+			limit.refill(states[i], now)
+			states[i].Tokens = math.Min(float64(limit.Burst), states[i].Tokens+1)
+		}
+	}
+	return states
+}
+
+// возвращает время, за которое полностью пополнятся жетоны всех ограничений,
+// после этого состояние ограничений можно не хранить
+func (l *Limits) lifetime(states []*LimitState) time.Duration {
+	var lifetime time.Duration
+	for i, limit := range l.items {
+		missing := float64(limit.Burst) - states[i].Tokens
+		if duration := time.Duration(missing / limit.rate() * float64(time.Second)); duration > lifetime {
+			lifetime = duration
+		}
+	}
+	return lifetime
+}
+
+// проверяет, что сохраненное состояние еще нужно хранить
+// состояние не нужно, если изменилось количество ограничений или жетоны всех ограничений уже пополнились
+func (l *Limits) isAlive(states []*LimitState, now time.Time) bool {
+	if len(states) != len(l.items) {
+		return false
+	}
+	for i, state := range states {
+		if state == nil {
+			return false
+		}
+		missing := float64(l.items[i].Burst) - state.Tokens
+		refillDate := state.RefillDate.Add(time.Duration(missing / l.items[i].rate() * float64(time.Second)))
+		if refillDate.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// откладывает письмо ровно до появления жетонов
+// письмо кладется в самую короткую отложенную очередь, время ожидания в которой не меньше задержки,
+// а срок жизни письма в очереди равен задержке, поэтому письмо не ждет до конца времени ожидания очереди
+func delayMail(message *common.MailMessage, delay time.Duration) {
+	message.BindingType = delayBindingType(delay)
+	message.Delay = delay
+}
+
+// возвращает самую короткую отложенную очередь, время ожидания в которой не меньше указанного
+func delayBindingType(delay time.Duration) common.DelayedBindingType {
+	for _, bindingType := range delayBindings {
+		if delay <= delayBindingDurations[bindingType] {
+			return bindingType
+		}
+	}
+	return common.DayDelayedBinding
 }
@@ -0,0 +1,59 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/actionpay/postmanq/common"
+)
+
+func TestLimitsTakeAllOrNothing(t *testing.T) {
+	limits := &Limits{items: []*Limit{{Value: 10, Kind: SecondKind}, {Value: 2, Kind: DayKind}}}
+	limits.init("example.com:a.test")
+	now := time.Now()
+
+	states, delay := limits.take(nil, now)
+	if delay != 0 {
+		t.Fatalf("expected token, got delay %v", delay)
+	}
+	states, delay = limits.take(states, now)
+	if delay != 0 {
+		t.Fatalf("expected token, got delay %v", delay)
+	}
+	// суточное ограничение исчерпано, жетон секундного ограничения не расходуется
+	states, delay = limits.take(states, now)
+	if delay < time.Hour {
+		t.Fatalf("expected day delay, got %v", delay)
+	}
+	if states[0].Tokens != 8 || states[1].Tokens != 0 {
+		t.Fatalf("delayed mail shouldn't take tokens, got %v and %v", states[0].Tokens, states[1].Tokens)
+	}
+}
+
+func TestDelayBindingType(t *testing.T) {
+	cases := map[time.Duration]common.DelayedBindingType{
+		100 * time.Millisecond: common.SecondDelayedBinding,
+		2 * time.Second:        common.ThirtySecondDelayedBinding,
+		4 * time.Minute:        common.FiveMinutesDelayedBinding,
+		2 * time.Hour:          common.SixHoursDelayedBinding,
+		48 * time.Hour:         common.DayDelayedBinding,
+	}
+	for delay, expected := range cases {
+		if bindingType := delayBindingType(delay); bindingType != expected {
+			t.Errorf("delay %v: expected binding %v, got %v", delay, expected, bindingType)
+		}
+	}
+}
+
+// письмо откладывается ровно до появления жетонов, а не до конца времени ожидания очереди
+func TestDelayMail(t *testing.T) {
+	message := new(common.MailMessage)
+	delayMail(message, 61*time.Minute)
+	if message.BindingType != common.SixHoursDelayedBinding || message.Delay != 61*time.Minute {
+		t.Fatalf("expected 61m delay in six hours queue, got %v in %v", message.Delay, message.BindingType)
+	}
+	delayMail(message, 31*time.Second)
+	if message.BindingType != common.MinuteDelayedBinding || message.Delay != 31*time.Second {
+		t.Fatalf("expected 31s delay in minute queue, got %v in %v", message.Delay, message.BindingType)
+	}
+}
@@ -3,7 +3,7 @@ package limiter
 import (
 	"github.com/actionpay/postmanq/common"
 	"github.com/actionpay/postmanq/logger"
-	"sync/atomic"
+	"time"
 )
 
 // ограничитель, проверяет количество отправленных писем почтовому сервису
@@ -29,30 +29,39 @@ func (l *Limiter) run() {
 // если количество превышено, отправляет письмо в отложенную очередь
 func (l *Limiter) check(event *common.SendEvent) {
 	logger.By(event.Message.HostnameFrom).Info("limiter#%d-%d check limit for mail", l.id, event.Message.Id)
-	limit := service.getLimit(event.Message.HostnameFrom, event.Message.HostnameTo)
-	// пытаемся найти ограничения для почтового сервиса
-	if limit == nil {
-		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d not found limit for %s", l.id, event.Message.Id, event.Message.HostnameTo)
-	} else {
-		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d found limit for %s", l.id, event.Message.Id, event.Message.HostnameTo)
-		// если оно нашлось, проверяем, что отправка нового письма происходит в тот промежуток времени,
-		// в который нам необходимо следить за ограничениями
-		if limit.isValidDuration(event.Message.CreatedDate) {
-			atomic.AddInt32(&limit.currentValue, 1)
-			currentValue := atomic.LoadInt32(&limit.currentValue)
-			logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d detect current value %d, const value %d", l.id, event.Message.Id, currentValue, limit.Value)
-			// если ограничение превышено
-			if currentValue > limit.Value {
-				logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d current value is exceeded for %s", l.id, event.Message.Id, event.Message.HostnameTo)
-				// определяем очередь, в которое переложем письмо
-				event.Message.BindingType = limit.bindingType
-				// говорим получателю, что у нас превышение ограничения,
-				// разблокируем поток получателя
-				event.Result <- common.OverlimitSendEventResult
-				return
-			}
+	// сначала проверяем адаптивное ограничение, чтобы не учитывать в лимитах письма, которые не будут отправлены
+	throttle := service.getThrottle(event.Message.HostnameTo)
+	if throttle != nil {
+		if delay, ok := throttle.acquire(time.Now()); ok {
+			event.Feedback = throttle
 		} else {
-			logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d duration great then %v", l.id, event.Message.Id, limit.duration)
+			logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d throttle %s is exceeded, delay %v", l.id, event.Message.Id, throttle.Provider, delay)
+			delayMail(event.Message, delay)
+			common.OverlimitMail(event)
+			return
+		}
+	}
+	rules := service.getRules(event.Message.HostnameFrom)
+	hostnameTo := event.Message.HostnameTo
+	// провайдера ищем, только если для него есть правила, т.к. это требует запросов к DNS
+	var provider string
+	if rules.hasProviderRules() {
+		provider = service.getProvider(hostnameTo)
+	}
+	if rules.hasAddressRules(hostnameTo, provider) {
+		// самое точное правило зависит от ip отправителя, поэтому проверку выполнит соединитель после выбора ip
+		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d found ip limits for %s, check them after ip selection", l.id, event.Message.Id, hostnameTo)
+		event.AddressLimit = &AddressLimit{rules: rules, provider: provider}
+	} else if rule := rules.find(hostnameTo, provider, common.EmptyStr); rule == nil {
+		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d not found limit for %s", l.id, event.Message.Id, hostnameTo)
+	} else {
+		logger.By(event.Message.HostnameFrom).Debug("limiter#%d-%d found limit %s for %s", l.id, event.Message.Id, rule.limits.key, hostnameTo)
+		// если ограничение превышено
+		if !takeRule(event, rule) {
+			// говорим получателю, что у нас превышение ограничения, место одновременной отправки письму больше не нужно,
+			// разблокируем поток получателя
+			common.OverlimitMail(event)
+			return
 		}
 	}
 	event.Iterator.Next().(common.SendingService).Events() <- event
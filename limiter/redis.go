@@ -0,0 +1,300 @@
+package limiter
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/actionpay/postmanq/logger"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// снимает блокировку, только если она принадлежит экземпляру, т.е. в ней лежит его метка
+// блокировка могла истечь и достаться другому экземпляру, ее нельзя удалять
+const redisUnlockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// хранилище ограничений в redis
+// состояние ограничений меняется под блокировкой ключа, поэтому экземпляры postmanq не берут одни и те же жетоны
+// если redis недоступен, ограничения временно проверяются в памяти процесса
+type RedisStore struct {
+	// настройки
+	conf *StoreConfig
+
+	// простаивающие соединения
+	conns chan *redisConn
+
+	// хранилище на случай недоступности redis
+	fallback *MemoryStore
+
+	// хранилище закрыто, соединения больше не возвращаются в пул
+	closed bool
+
+	// семафор, защищает возврат соединений в пул от закрытия хранилища
+	mutex *sync.Mutex
+}
+
+// создает хранилище ограничений в redis
+func newRedisStore(conf *StoreConfig) (*RedisStore, error) {
+	store := &RedisStore{
+		conf:     conf,
+		conns:    make(chan *redisConn, conf.Connections),
+		fallback: newMemoryStore(),
+		mutex:    new(sync.Mutex),
+	}
+	// проверяем, что redis доступен
+	conn, err := store.get()
+	if err == nil {
+		_, err = conn.do("PING")
+		store.put(conn, err)
+	}
+	return store, err
+}
+
+func (r *RedisStore) take(limits *Limits, now time.Time) time.Duration {
+	var delay time.Duration
+	err := r.modify(limits, func(states []*LimitState) []*LimitState {
+		states, delay = limits.take(states, now)
+		return states
+	})
+	if err == nil {
+		return delay
+	} else {
+		logger.All().Warn("limiter can't take tokens for %s from redis %s, error - %v, use local limits", limits.key, r.conf.Address, err)
+		return r.fallback.take(limits, now)
+	}
+}
+
+func (r *RedisStore) give(limits *Limits, now time.Time) {
+	err := r.modify(limits, func(states []*LimitState) []*LimitState {
+		return limits.give(states, now)
+	})
+	if err != nil {
+		logger.All().Warn("limiter can't give tokens for %s to redis %s, error - %v, use local limits", limits.key, r.conf.Address, err)
+		r.fallback.give(limits, now)
+	}
+}
+
+// изменяет состояние ограничений под блокировкой ключа
+func (r *RedisStore) modify(limits *Limits, modify func([]*LimitState) []*LimitState) error {
+	conn, err := r.get()
+	if err == nil {
+		lockKey := fmt.Sprintf("%s:lock:%s", r.conf.Prefix, limits.key)
+		stateKey := fmt.Sprintf("%s:state:%s", r.conf.Prefix, limits.key)
+		var token string
+		token, err = conn.lock(lockKey, r.conf.LockTimeout)
+		if err == nil {
+			var reply interface{}
+			reply, err = conn.do("GET", stateKey)
+			if err == nil {
+				var states []*LimitState
+				if value, ok := reply.(string); ok {
+					// испорченное состояние заменяем полными ведрами
+					if json.Unmarshal([]byte(value), &states) != nil {
+						states = nil
+					}
+				}
+				states = modify(states)
+				// состояние, которое не соответствует ограничениям, не сохраняется, например, если возвращать нечего
+				if len(states) == len(limits.items) {
+					data, _ := json.Marshal(states)
+					ttl := limits.lifetime(states) + time.Second
+					_, err = conn.do("SET", stateKey, string(data), "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+				}
+			}
+			conn.unlock(lockKey, token)
+		}
+		r.put(conn, err)
+	}
+	return err
+}
+
+// возвращает простаивающее соединение или создает новое
+func (r *RedisStore) get() (*redisConn, error) {
+	select {
+	case conn := <-r.conns:
+		return conn, nil
+	default:
+		return dialRedis(r.conf.Address, r.conf.Password)
+	}
+}
+
+// возвращает соединение в пул, соединение с сетевой ошибкой закрывается
+// после закрытия хранилища соединения тоже закрываются
+func (r *RedisStore) put(conn *redisConn, err error) {
+	if _, isReplyErr := err.(redisError); err != nil && !isReplyErr {
+		conn.conn.Close()
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		conn.conn.Close()
+		return
+	}
+	select {
+	case r.conns <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// redis сам хранит состояние между перезапусками
+func (r *RedisStore) snapshot() map[string][]*LimitState {
+	return nil
+}
+
+func (r *RedisStore) restore(states map[string][]*LimitState) {}
+
+// закрывает простаивающие соединения
+// канал пула не закрывается, т.к. ограничители еще могут взять из него соединение
+func (r *RedisStore) close() {
+	r.mutex.Lock()
+	r.closed = true
+	for {
+		select {
+		case conn := <-r.conns:
+			conn.conn.Close()
+		default:
+			r.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// ошибка, которую вернул redis
+type redisError string
+
+func (r redisError) Error() string {
+	return string(r)
+}
+
+// соединение с redis
+type redisConn struct {
+	// соединение
+	conn net.Conn
+
+	// буферизированное чтение ответов
+	reader *bufio.Reader
+}
+
+// устанавливает соединение с redis
+func dialRedis(address, password string) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err == nil {
+		redis := &redisConn{conn, bufio.NewReader(conn)}
+		if len(password) > 0 {
+			_, err = redis.do("AUTH", password)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return redis, nil
+	} else {
+		return nil, err
+	}
+}
+
+// отправляет команду и читает ответ
+func (r *redisConn) do(args ...string) (interface{}, error) {
+	r.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := r.conn.Write(encodeRedisCommand(args))
+	if err == nil {
+		return readRedisReply(r.reader)
+	} else {
+		return nil, err
+	}
+}
+
+// блокирует ключ и возвращает метку блокировки, блокировка снимается сама, если экземпляр упал, не сняв ее
+func (r *redisConn) lock(key string, timeout time.Duration) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	deadline := time.Now().Add(timeout)
+	for {
+		reply, err := r.do("SET", key, token, "NX", "PX", strconv.FormatInt(int64(timeout/time.Millisecond), 10))
+		if err != nil {
+			return "", err
+		} else if reply != nil {
+			return token, nil
+		} else if time.Now().After(deadline) {
+			return "", errors.New("lock timeout")
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+// снимает блокировку ключа, если она еще принадлежит метке
+func (r *redisConn) unlock(key, token string) error {
+	_, err := r.do("EVAL", redisUnlockScript, "1", key, token)
+	return err
+}
+
+// кодирует команду в массив строк протокола redis
+func encodeRedisCommand(args []string) []byte {
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	return buf
+}
+
+// читает ответ протокола redis
+// простые строки и строки возвращаются как string, числа как int64, отсутствующее значение как nil
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.New("invalid redis reply")
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(reader, buf)
+		if err == nil {
+			return string(buf[:size]), nil
+		} else {
+			return nil, err
+		}
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			items[i], err = readRedisReply(reader)
+			if err != nil {
+				if _, isReplyErr := err.(redisError); !isReplyErr {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	default:
+		return nil, errors.New("invalid redis reply")
+	}
+}
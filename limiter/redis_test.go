@@ -0,0 +1,339 @@
+package limiter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/actionpay/postmanq/logger"
+)
+
+// сервер redis внутри процесса
+// понимает только команды, которые использует хранилище ограничений: AUTH, PING, GET, SET с NX и PX, DEL
+// и EVAL скрипта снятия блокировки
+type LocalRedis struct {
+	// слушатель соединений
+	listener net.Listener
+
+	// пароль, пустая строка означает, что пароль не нужен
+	password string
+
+	// значения
+	values map[string]*localRedisValue
+
+	// семафор
+	mutex *sync.Mutex
+}
+
+// значение сервера redis внутри процесса
+type localRedisValue struct {
+	// значение
+	value string
+
+	// дата истечения, нулевая дата означает, что значение не истекает
+	expireDate time.Time
+}
+
+// запускает сервер redis внутри процесса
+func newLocalRedis(address, password string) (*LocalRedis, error) {
+	listener, err := net.Listen("tcp", address)
+	if err == nil {
+		local := &LocalRedis{
+			listener: listener,
+			password: password,
+			values:   make(map[string]*localRedisValue),
+			mutex:    new(sync.Mutex),
+		}
+		go local.serve()
+		return local, nil
+	} else {
+		return nil, err
+	}
+}
+
+// возвращает адрес, на котором запущен сервер
+func (l *LocalRedis) address() string {
+	return l.listener.Addr().String()
+}
+
+// останавливает сервер
+func (l *LocalRedis) close() {
+	l.listener.Close()
+}
+
+// принимает соединения
+func (l *LocalRedis) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err == nil {
+			go l.handle(conn)
+		} else {
+			return
+		}
+	}
+}
+
+// выполняет команды соединения
+func (l *LocalRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authorized := len(l.password) == 0
+	for {
+		args, err := readLocalRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		var reply string
+		command := strings.ToUpper(args[0])
+		if command == "AUTH" {
+			if len(args) == 2 && args[1] == l.password {
+				authorized = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-ERR invalid password\r\n"
+			}
+		} else if !authorized {
+			reply = "-NOAUTH Authentication required.\r\n"
+		} else {
+			reply = l.execute(command, args[1:])
+		}
+		_, err = io.WriteString(conn, reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// выполняет команду и возвращает ответ
+func (l *LocalRedis) execute(command string, args []string) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	switch {
+	case command == "PING":
+		return "+PONG\r\n"
+	case command == "GET" && len(args) == 1:
+		if value := l.get(args[0], now); value != nil {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(value.value), value.value)
+		} else {
+			return "$-1\r\n"
+		}
+	case command == "SET" && len(args) >= 2:
+		value := &localRedisValue{value: args[1]}
+		onlyNew := false
+		for i := 2; i < len(args); i++ {
+			option := strings.ToUpper(args[i])
+			if option == "NX" {
+				onlyNew = true
+			} else if option == "PX" && i+1 < len(args) {
+				ttl, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil {
+					return "-ERR value is not an integer or out of range\r\n"
+				}
+				value.expireDate = now.Add(time.Duration(ttl) * time.Millisecond)
+				i++
+			} else {
+				return "-ERR syntax error\r\n"
+			}
+		}
+		if onlyNew && l.get(args[0], now) != nil {
+			return "$-1\r\n"
+		}
+		l.values[args[0]] = value
+		return "+OK\r\n"
+	case command == "EVAL" && len(args) == 4 && args[0] == redisUnlockScript && args[1] == "1":
+		if value := l.get(args[2], now); value != nil && value.value == args[3] {
+			delete(l.values, args[2])
+			return ":1\r\n"
+		} else {
+			return ":0\r\n"
+		}
+	case command == "DEL":
+		count := 0
+		for _, key := range args {
+			if l.get(key, now) != nil {
+				delete(l.values, key)
+				count++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", count)
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", command)
+	}
+}
+
+// возвращает значение, истекшие значения удаляются
+// вызывается под семафором
+func (l *LocalRedis) get(key string, now time.Time) *localRedisValue {
+	value, ok := l.values[key]
+	if ok && !value.expireDate.IsZero() && !now.Before(value.expireDate) {
+		delete(l.values, key)
+		return nil
+	}
+	return value
+}
+
+// читает команду, отправленную массивом строк протокола redis
+func readLocalRedisCommand(reader *bufio.Reader) ([]string, error) {
+	reply, err := readRedisReply(reader)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, errors.New("invalid redis command")
+	}
+	args := make([]string, len(items))
+	for i, item := range items {
+		if args[i], ok = item.(string); !ok {
+			return nil, errors.New("invalid redis command")
+		}
+	}
+	return args, nil
+}
+
+// создает хранилище, подключенное к серверу redis внутри процесса
+func newTestRedisStore(t *testing.T, local *LocalRedis) *RedisStore {
+	store, err := newRedisStore(&StoreConfig{
+		Type:        RedisStoreType,
+		Address:     local.address(),
+		Password:    "secret",
+		Prefix:      "postmanq",
+		Connections: 4,
+		LockTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// два экземпляра берут жетоны одних ограничений одновременно и не берут лишних
+func TestRedisStoreSharesLimits(t *testing.T) {
+	logger.Inst()
+	local, err := newLocalRedis("127.0.0.1:0", "secret")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer local.close()
+	first := newTestRedisStore(t, local)
+	defer first.close()
+	second := newTestRedisStore(t, local)
+	defer second.close()
+
+	limits := &Limits{items: []*Limit{{Value: 5, Kind: SecondKind}, {Value: 7, Kind: DayKind}}}
+	limits.init("example.com:a.test")
+	now := time.Now()
+	delays := make(chan time.Duration)
+	for i := 0; i < 20; i++ {
+		var store Store = first
+		if i%2 == 1 {
+			store = second
+		}
+		go func(store Store) {
+			delays <- store.take(limits, now)
+		}(store)
+	}
+	taken := 0
+	for i := 0; i < 20; i++ {
+		if <-delays == 0 {
+			taken++
+		}
+	}
+	if taken != 5 {
+		t.Fatalf("expected 5 tokens, taken %d", taken)
+	}
+}
+
+// блокировку снимает только ее владелец
+func TestRedisLockContention(t *testing.T) {
+	local, err := newLocalRedis("127.0.0.1:0", "")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer local.close()
+	first, err := dialRedis(local.address(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := dialRedis(local.address(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := first.lock("lock", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.lock("lock", 20*time.Millisecond); err == nil {
+		t.Fatalf("lock should be held by first connection")
+	}
+	// чужая метка не снимает блокировку
+	second.unlock("lock", "other")
+	if _, err := second.lock("lock", 20*time.Millisecond); err == nil {
+		t.Fatalf("lock shouldn't be released by other token")
+	}
+	first.unlock("lock", token)
+	if _, err := second.lock("lock", 20*time.Millisecond); err != nil {
+		t.Fatalf("lock should be released by owner, error - %v", err)
+	}
+}
+
+// блокировка, истекшая и доставшаяся другому экземпляру, не снимается прежним владельцем
+func TestRedisExpiredLockIsNotReleased(t *testing.T) {
+	local, err := newLocalRedis("127.0.0.1:0", "")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer local.close()
+	first, _ := dialRedis(local.address(), "")
+	second, _ := dialRedis(local.address(), "")
+
+	token, err := first.lock("lock", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := second.lock("lock", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	first.unlock("lock", token)
+	if _, err := first.lock("lock", 20*time.Millisecond); err == nil {
+		t.Fatalf("lock of second connection was released by first")
+	}
+}
+
+// закрытие хранилища не мешает ограничителям, которые еще возвращают соединения
+func TestRedisStoreCloseWhilePut(t *testing.T) {
+	local, err := newLocalRedis("127.0.0.1:0", "secret")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer local.close()
+	store := newTestRedisStore(t, local)
+	limits := &Limits{items: []*Limit{{Value: 1000, Kind: SecondKind}}}
+	limits.init("example.com:a.test")
+	group := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for j := 0; j < 20; j++ {
+				store.take(limits, time.Now())
+			}
+		}()
+	}
+	time.Sleep(5 * time.Millisecond)
+	store.close()
+	group.Wait()
+	if len(store.conns) != 0 {
+		t.Fatalf("closed store shouldn't keep connections, got %d", len(store.conns))
+	}
+}
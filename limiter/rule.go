@@ -0,0 +1,190 @@
+package limiter
+
+import (
+	"fmt"
+	"github.com/actionpay/postmanq/common"
+	"github.com/actionpay/postmanq/logger"
+	"sort"
+	"strings"
+	"time"
+)
+
+// тип правила ограничений
+type RuleKind int
+
+const (
+	// правило для почтового провайдера, ключ правила mx:google.com
+	ProviderRuleKind RuleKind = iota
+
+	// правило для доменов по маске, ключ правила *.yandex.ru, маске подходят сам домен yandex.ru и его поддомены
+	WildcardRuleKind
+
+	// правило для домена
+	DomainRuleKind
+)
+
+const (
+	// префикс правила для почтового провайдера
+	providerRulePrefix = "mx:"
+
+	// префикс правила для доменов по маске
+	wildcardRulePrefix = "*."
+)
+
+// правило ограничений, связывает ограничения с почтовыми сервисами, которым они применяются
+type Rule struct {
+	// ip отправителя, пустая строка означает, что правило действует для всех ip
+	ip string
+
+	// тип правила
+	kind RuleKind
+
+	// домен, суффикс домена или почтовый провайдер
+	pattern string
+
+	// ограничения
+	limits *Limits
+}
+
+// создает правило по ключу из настроек
+func newRule(ip, key string, limits *Limits) *Rule {
+	rule := &Rule{ip: ip, limits: limits}
+	if strings.HasPrefix(key, providerRulePrefix) {
+		rule.kind = ProviderRuleKind
+		rule.pattern = strings.TrimPrefix(key, providerRulePrefix)
+	} else if strings.HasPrefix(key, wildcardRulePrefix) {
+		rule.kind = WildcardRuleKind
+		rule.pattern = strings.TrimPrefix(key, "*")
+	} else {
+		rule.kind = DomainRuleKind
+		rule.pattern = key
+	}
+	return rule
+}
+
+// проверяет, что правило подходит почтовому сервису
+func (r *Rule) match(hostnameTo, provider string) bool {
+	switch r.kind {
+	case DomainRuleKind:
+		return hostnameTo == r.pattern
+	case WildcardRuleKind:
+		// шаблон хранится с точкой, .yandex.ru, поэтому маске не подходит myyandex.ru
+		return strings.HasSuffix(hostnameTo, r.pattern) || hostnameTo == r.pattern[1:]
+	default:
+		return provider == r.pattern
+	}
+}
+
+// проверяет, что правило точнее другого
+// правило для ip точнее правила для всех ip, затем домен точнее маски, а маска точнее провайдера,
+// из двух масок точнее более длинная
+func (r *Rule) isMoreSpecific(other *Rule) bool {
+	if (len(r.ip) > 0) != (len(other.ip) > 0) {
+		return len(r.ip) > 0
+	} else if r.kind != other.kind {
+		return r.kind > other.kind
+	} else {
+		return len(r.pattern) > len(other.pattern)
+	}
+}
+
+// правила ограничений отправителя, отсортированные от самого точного
+type Rules []*Rule
+
+// создает правила из ограничений отправителя
+func newRules(hostname string, limits map[string]*Limits, addressLimits map[string]map[string]*Limits) Rules {
+	rules := make(Rules, 0)
+	for key, keyLimits := range limits {
+		keyLimits.init(fmt.Sprintf("%s:%s", hostname, key))
+		rules = append(rules, newRule(common.EmptyStr, key, keyLimits))
+	}
+	for ip, ipLimits := range addressLimits {
+		for key, keyLimits := range ipLimits {
+			keyLimits.init(fmt.Sprintf("%s:%s:%s", hostname, ip, key))
+			rules = append(rules, newRule(ip, key, keyLimits))
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].isMoreSpecific(rules[j])
+	})
+	return rules
+}
+
+// проверяет, что среди правил есть правила для почтовых провайдеров
+func (r Rules) hasProviderRules() bool {
+	for _, rule := range r {
+		if rule.kind == ProviderRuleKind {
+			return true
+		}
+	}
+	return false
+}
+
+// ищет самое точное правило для почтового сервиса и ip
+// если ip не указан, правила для ip не рассматриваются
+func (r Rules) find(hostnameTo, provider, ip string) *Rule {
+	for _, rule := range r {
+		if (len(rule.ip) == 0 || rule.ip == ip) && rule.match(hostnameTo, provider) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// проверяет, что почтовому сервису подходит хотя бы одно правило для ip
+// в этом случае проверка откладывается до выбора ip отправителя
+func (r Rules) hasAddressRules(hostnameTo, provider string) bool {
+	for _, rule := range r {
+		if len(rule.ip) > 0 && rule.match(hostnameTo, provider) {
+			return true
+		}
+	}
+	return false
+}
+
+// ограничения, которые проверяются соединителем после выбора ip отправителя
+type AddressLimit struct {
+	// правила отправителя
+	rules Rules
+
+	// почтовый провайдер получателя
+	provider string
+
+	// правило, жетоны которого взяты для письма
+	taken *Rule
+}
+
+func (a *AddressLimit) Check(event *common.SendEvent, ip string) bool {
+	rule := a.rules.find(event.Message.HostnameTo, a.provider, ip)
+	if rule == nil {
+		return true
+	} else if takeRule(event, rule) {
+		a.taken = rule
+		return true
+	} else {
+		return false
+	}
+}
+
+func (a *AddressLimit) Release(event *common.SendEvent) {
+	if a.taken != nil {
+		logger.By(event.Message.HostnameFrom).Debug("limiter-%d release tokens of limit %s", event.Message.Id, a.taken.limits.key)
+		service.store.give(a.taken.limits, time.Now())
+		a.taken = nil
+	}
+}
+
+// берет жетоны ограничений правила для письма
+// возвращает false, если ограничение превышено, в этом случае в письме указывается очередь, через которую его отправить
+func takeRule(event *common.SendEvent, rule *Rule) bool {
+	message := event.Message
+	delay := service.store.take(rule.limits, time.Now())
+	if delay > 0 {
+		logger.By(message.HostnameFrom).Debug("limiter-%d limit %s is exceeded, delay %v", message.Id, rule.limits.key, delay)
+		// письмо вернется, как только появятся жетоны
+		delayMail(message, delay)
+		return false
+	} else {
+		return true
+	}
+}
@@ -0,0 +1,121 @@
+package limiter
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/actionpay/postmanq/common"
+	"github.com/actionpay/postmanq/logger"
+)
+
+// при переключении на другой ip жетоны прежнего ip возвращаются
+func TestAddressLimitRelease(t *testing.T) {
+	logger.Inst()
+	Inst()
+	service.store = newMemoryStore()
+	limits := map[string]map[string]*Limits{
+		"1.1.1.1": {"a.test": {items: []*Limit{{Value: 1, Kind: DayKind}}}},
+		"2.2.2.2": {"a.test": {items: []*Limit{{Value: 1, Kind: DayKind}}}},
+	}
+	rules := newRules("example.com", nil, limits)
+	message := &common.MailMessage{Envelope: "sender@example.com", Recipient: "user@a.test"}
+	message.Init()
+	event := common.NewSendEvent(message)
+
+	addressLimit := &AddressLimit{rules: rules}
+	if !addressLimit.Check(event, "1.1.1.1") {
+		t.Fatalf("expected token for first ip")
+	}
+	addressLimit.Release(event)
+	if !addressLimit.Check(event, "2.2.2.2") {
+		t.Fatalf("expected token for second ip")
+	}
+	// жетон первого ip возвращен и достанется следующему письму
+	if !(&AddressLimit{rules: rules}).Check(event, "1.1.1.1") {
+		t.Fatalf("token of first ip should be released")
+	}
+	if (&AddressLimit{rules: rules}).Check(event, "2.2.2.2") {
+		t.Fatalf("token of second ip should be taken")
+	}
+}
+
+// маске *.yandex.ru подходят сам домен и поддомены, но не домены, которые только заканчиваются так же
+func TestWildcardRuleMatchesApex(t *testing.T) {
+	rule := newRule(common.EmptyStr, "*.yandex.ru", nil)
+	for hostname, expected := range map[string]bool{
+		"yandex.ru":      true,
+		"mail.yandex.ru": true,
+		"a.b.yandex.ru":  true,
+		"myyandex.ru":    false,
+		"yandex.ru.net":  false,
+	} {
+		if rule.match(hostname, common.EmptyStr) != expected {
+			t.Errorf("%s: expected match %v", hostname, expected)
+		}
+	}
+}
+
+// провайдер запоминается на время, а ошибка поиска не запоминается надолго
+func TestProviderCache(t *testing.T) {
+	logger.Inst()
+	service = &Service{providers: make(map[string]*MailProvider), throttlesMutex: new(sync.RWMutex)}
+	lookups := int32(0)
+	fail := true
+	mutex := new(sync.Mutex)
+	providerLookup = func(hostname string) ([]*net.MX, error) {
+		atomic.AddInt32(&lookups, 1)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if fail {
+			return nil, errors.New("timeout")
+		}
+		return []*net.MX{{Host: "mx1.provider.test.", Pref: 10}}, nil
+	}
+	defer func() { providerLookup = net.LookupMX }()
+
+	if provider := service.getProvider("a.test"); provider != "a.test" {
+		t.Fatalf("expected domain as provider after failure, got %s", provider)
+	}
+	service.getProvider("a.test")
+	if atomic.LoadInt32(&lookups) != 1 {
+		t.Fatalf("failure should be remembered for a while, got %d lookups", lookups)
+	}
+
+	// после паузы провайдер ищется заново, а пока он ищется, используется прежний
+	mutex.Lock()
+	fail = false
+	mutex.Unlock()
+	service.throttlesMutex.Lock()
+	service.providers["a.test"].expireDate = time.Now()
+	service.throttlesMutex.Unlock()
+	service.getProvider("a.test")
+	deadline := time.Now().Add(time.Second)
+	for service.getProvider("a.test") != "provider.test" {
+		if time.Now().After(deadline) {
+			t.Fatalf("provider isn't resolved after failure")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&lookups) != 2 {
+		t.Fatalf("expected one lookup after expiration, got %d", lookups)
+	}
+
+	// ошибка при обновлении не забывает найденного провайдера
+	mutex.Lock()
+	fail = true
+	mutex.Unlock()
+	service.throttlesMutex.Lock()
+	service.providers["a.test"].expireDate = time.Now()
+	service.throttlesMutex.Unlock()
+	service.getProvider("a.test")
+	for atomic.LoadInt32(&lookups) != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if provider := service.getProvider("a.test"); provider != "provider.test" {
+		t.Fatalf("expected provider to be kept, got %s", provider)
+	}
+}
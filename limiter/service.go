@@ -4,15 +4,28 @@ import (
 	"github.com/actionpay/postmanq/common"
 	"github.com/actionpay/postmanq/logger"
 	yaml "gopkg.in/yaml.v2"
+	"net"
+	"sync"
 	"time"
 )
 
+const (
+	// сколько используется найденный почтовый провайдер домена
+	providerTimeout = time.Hour
+
+	// через сколько повторяется поиск провайдера, если MX записи домена не удалось получить
+	providerFailureTimeout = time.Minute
+
+	// сколько письмо ждет первого поиска провайдера, после этого письмо проверяется по ограничениям домена
+	providerWaitTimeout = 3 * time.Second
+)
+
 var (
 	// сервис ограничений
 	service *Service
 
-	// таймер, работает каждую секунду
-	ticker *time.Ticker
+	// получает MX записи домена
+	providerLookup = net.LookupMX
 
 	// канал для приема событий отправки писем
 	events = make(chan *common.SendEvent)
@@ -24,13 +37,36 @@ type Service struct {
 	LimitersCount int `yaml:"workers"`
 
 	Configs map[string]*Config `yaml:"postmans"`
+
+	// настройки хранилища ограничений, по умолчанию ограничения хранятся в памяти процесса
+	StoreConfig *StoreConfig `yaml:"limitsStore"`
+
+	// хранилище ограничений
+	store Store
+
+	// путь до файла, в котором хранится состояние ограничений между перезапусками
+	StateFilename string `yaml:"limitsState"`
+
+	// хранилище состояния ограничений
+	storage *StateStorage
+
+	// настройки адаптивного ограничения, если не указаны, адаптивное ограничение не используется
+	Throttle *ThrottleConfig `yaml:"throttle"`
+
+	// адаптивные ограничения, в качестве ключа используется почтовый провайдер или домен почтового сервиса
+	throttles map[string]*Throttle
+
+	// почтовые провайдеры, в качестве ключа используется домен почтового сервиса
+	providers map[string]*MailProvider
+
+	// семафор, защищает адаптивные ограничения и почтовых провайдеров
+	throttlesMutex *sync.RWMutex
 }
 
 // создает сервис ограничений
 func Inst() common.SendingService {
 	if service == nil {
 		service = new(Service)
-		ticker = time.NewTicker(time.Second)
 	}
 	return service
 }
@@ -46,6 +82,15 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 		if s.LimitersCount == 0 {
 			s.LimitersCount = common.DefaultWorkersCount
 		}
+		s.initStore()
+		s.storage = newStateStorage(s.StateFilename)
+		s.store.restore(s.storage.load(s.getAllLimits(), time.Now()))
+		s.providers = make(map[string]*MailProvider)
+		s.throttlesMutex = new(sync.RWMutex)
+		if s.Throttle != nil {
+			s.Throttle.init()
+			s.throttles = make(map[string]*Throttle)
+		}
 	} else {
 		logger.All().FailExitWithErr(err)
 	}
@@ -53,19 +98,62 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 
 func (s *Service) init(conf *Config, hostname string) {
 	// инициализируем ограничения
-	for host, limit := range conf.Limits {
-		limit.init()
-		logger.By(hostname).Debug("create limit for %s with type %v and duration %v", host, limit.bindingType, limit.duration)
+	conf.rules = newRules(hostname, conf.Limits, conf.AddressLimits)
+	for _, rule := range conf.rules {
+		for _, limit := range rule.limits.items {
+			if !limit.isValid() {
+				logger.By(hostname).FailExit("limiter - invalid limit %s, type %s, value %d", rule.limits.key, limit.Kind, limit.Value)
+			}
+			logger.By(hostname).Debug("create limit %s with type %v, duration %v, value %d and burst %d", rule.limits.key, limit.bindingType, limit.duration, limit.Value, limit.Burst)
+		}
 	}
 }
 
-// запускает проверку ограничений и очистку значений лимитов
+// создает хранилище ограничений
+func (s *Service) initStore() {
+	if s.StoreConfig == nil {
+		s.StoreConfig = new(StoreConfig)
+	}
+	conf := s.StoreConfig
+	if len(conf.Type) == 0 {
+		conf.Type = MemoryStoreType
+	}
+	switch conf.Type {
+	case MemoryStoreType:
+		s.store = newMemoryStore()
+	case RedisStoreType:
+		if len(conf.Prefix) == 0 {
+			conf.Prefix = "postmanq"
+		}
+		if conf.Connections <= 0 {
+			conf.Connections = s.LimitersCount
+		}
+		if conf.LockTimeout == 0 {
+			conf.LockTimeout = time.Second
+		}
+		store, err := newRedisStore(conf)
+		if err == nil {
+			s.store = store
+		} else {
+			logger.All().FailExit("limiter can't connect to redis %s, error - %v", conf.Address, err)
+		}
+	default:
+		logger.All().FailExit("limiter - unknown limits store %s", conf.Type)
+	}
+}
+
+// запускает проверку ограничений
 func (s *Service) OnRun() {
-	// сразу запускаем проверку значений ограничений
-	go newCleaner()
 	for i := 0; i < s.LimitersCount; i++ {
 		go newLimiter(i + 1)
 	}
+	go s.storage.run(s.store)
+	if s.Throttle != nil {
+		go s.logThrottles()
+		if len(s.Throttle.Status) > 0 {
+			go s.serveStatus()
+		}
+	}
 }
 
 // канал для приема событий отправки писем
@@ -76,21 +164,152 @@ func (s *Service) Events() chan *common.SendEvent {
 // завершает работу сервиса соединений
 func (s *Service) OnFinish() {
 	close(events)
+	s.storage.save(s.store)
+	s.store.close()
 }
 
-func (s Service) getLimit(hostnameFrom, hostnameTo string) *Limit {
+// возвращает правила ограничений отправителя
+func (s Service) getRules(hostnameFrom string) Rules {
 	if config, ok := service.Configs[hostnameFrom]; ok {
-		if limit, has := config.Limits[hostnameTo]; has {
-			return limit
-		} else {
-			return nil
-		}
+		return config.rules
 	} else {
 		return nil
 	}
 }
 
+// возвращает ограничения всех отправителей, в качестве ключа используется ключ ограничений
+func (s Service) getAllLimits() map[string]*Limits {
+	limits := make(map[string]*Limits)
+	for _, config := range s.Configs {
+		for _, rule := range config.rules {
+			limits[rule.limits.key] = rule.limits
+		}
+	}
+	return limits
+}
+
+// почтовый провайдер домена
+type MailProvider struct {
+	// провайдер, до первого успешного поиска - сам домен
+	name string
+
+	// дата, после которой провайдер ищется заново
+	expireDate time.Time
+
+	// провайдер ищется
+	resolving bool
+
+	// закрывается после первого поиска
+	ready chan struct{}
+
+	// первый поиск завершен
+	resolved bool
+}
+
+// возвращает почтового провайдера домена
+// провайдер определяется по первому MX серверу домена и запоминается на время, поиск выполняется в отдельной горутине,
+// поэтому письмо ждет только первого поиска, и не дольше providerWaitTimeout, а после устаревания используется старый провайдер,
+// пока ищется новый
+func (s *Service) getProvider(hostnameTo string) string {
+	s.throttlesMutex.Lock()
+	provider, ok := s.providers[hostnameTo]
+	if !ok {
+		provider = &MailProvider{name: hostnameTo, ready: make(chan struct{})}
+		s.providers[hostnameTo] = provider
+	}
+	if !provider.resolving && !time.Now().Before(provider.expireDate) {
+		provider.resolving = true
+		go s.resolveProvider(hostnameTo, provider)
+	}
+	s.throttlesMutex.Unlock()
+	common.WaitSignal(provider.ready, providerWaitTimeout)
+	s.throttlesMutex.RLock()
+	name := provider.name
+	s.throttlesMutex.RUnlock()
+	return name
+}
+
+// ищет почтового провайдера домена по первому MX серверу
+// если MX записи не удалось получить, остается прежний провайдер, и поиск повторяется через providerFailureTimeout,
+// поэтому одна ошибка DNS не оставляет домен без провайдера до перезапуска
+func (s *Service) resolveProvider(hostnameTo string, provider *MailProvider) {
+	mxes, err := providerLookup(hostnameTo)
+	s.throttlesMutex.Lock()
+	if err == nil && len(mxes) > 0 {
+		provider.name = common.RealServerName(mxes[0].Host)
+		provider.expireDate = time.Now().Add(providerTimeout)
+	} else {
+		provider.expireDate = time.Now().Add(providerFailureTimeout)
+		logger.All().Warn("limiter can't look up mx of %s, use %s as provider, error - %v", hostnameTo, provider.name, err)
+	}
+	provider.resolving = false
+	if !provider.resolved {
+		provider.resolved = true
+		close(provider.ready)
+	}
+	s.throttlesMutex.Unlock()
+}
+
 type Config struct {
-	// ограничения для почтовых сервисов, в качестве ключа используется домен
-	Limits map[string]*Limit `yaml:"limits"`
+	// ограничения для почтовых сервисов
+	// в качестве ключа используется домен, маска домена, например *.yandex.ru, или почтовый провайдер, например mx:google.com
+	Limits map[string]*Limits `yaml:"limits"`
+
+	// ограничения для почтовых сервисов при отправке с ip, в качестве ключа используется ip
+	AddressLimits map[string]map[string]*Limits `yaml:"ipLimits"`
+
+	// правила ограничений, отсортированные от самого точного
+	rules Rules
+}
+
+// возвращает адаптивное ограничение провайдера почтового сервиса
+// провайдер определяется до того, как письмо займет место одновременной отправки,
+// поэтому место освобождается и ответ учитывается в том же ограничении
+// возвращает nil, если адаптивное ограничение не используется
+func (s *Service) getThrottle(hostnameTo string) *Throttle {
+	if s.Throttle == nil {
+		return nil
+	}
+	provider := s.getProvider(hostnameTo)
+	s.throttlesMutex.RLock()
+	throttle, ok := s.throttles[provider]
+	s.throttlesMutex.RUnlock()
+	if !ok {
+		throttle = s.findOrCreateThrottle(provider)
+	}
+	return throttle
+}
+
+// ищет адаптивное ограничение провайдера, если ограничение не найдено, создает его
+func (s *Service) findOrCreateThrottle(provider string) *Throttle {
+	s.throttlesMutex.Lock()
+	throttle, ok := s.throttles[provider]
+	if !ok {
+		throttle = newThrottle(provider, s.Throttle)
+		s.throttles[provider] = throttle
+	}
+	s.throttlesMutex.Unlock()
+	return throttle
+}
+
+// раз в минуту пишет в лог состояние провайдеров, для которых снижены ограничения
+func (s *Service) logThrottles() {
+	for range time.Tick(time.Minute) {
+		s.throttlesMutex.RLock()
+		for _, throttle := range s.throttles {
+			snapshot := throttle.snapshot()
+			if snapshot.Rate < s.Throttle.Rate || snapshot.Concurrency < s.Throttle.Concurrency {
+				logger.All().Info(
+					"limiter throttle %s: rate %.2f, concurrency %d, active %d, deferrals %d, last deferral %v",
+					snapshot.Provider,
+					snapshot.Rate,
+					int(snapshot.Concurrency),
+					snapshot.Active,
+					snapshot.Deferrals,
+					snapshot.DeferralDate,
+				)
+			}
+		}
+		s.throttlesMutex.RUnlock()
+	}
 }
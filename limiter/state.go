@@ -0,0 +1,58 @@
+package limiter
+
+import (
+	"github.com/actionpay/postmanq/common"
+	"github.com/actionpay/postmanq/logger"
+	"time"
+)
+
+// хранилище состояния ограничений между перезапусками
+// состояние всех ограничений хранится в одном json файле, ключом является ключ ограничений
+type StateStorage struct {
+	*common.StateFile
+}
+
+// создает хранилище состояния
+func newStateStorage(filename string) *StateStorage {
+	return &StateStorage{common.NewStateFile(filename)}
+}
+
+// читает состояние из файла
+// состояние ограничений, которых больше нет в настройках, и ограничений, жетоны которых уже полностью пополнились, отбрасывается
+func (s *StateStorage) load(limits map[string]*Limits, now time.Time) map[string][]*LimitState {
+	states := make(map[string][]*LimitState)
+	ok, err := s.Load(&states)
+	if err == nil {
+		for key, keyStates := range states {
+			if keyLimits, ok := limits[key]; !ok || !keyLimits.isAlive(keyStates, now) {
+				delete(states, key)
+			}
+		}
+		if ok {
+			logger.All().Debug("limiter read limits state from %s", s.Filename)
+		}
+	} else {
+		states = make(map[string][]*LimitState)
+		logger.All().Warn("limiter can't read limits state %s, error - %v", s.Filename, err)
+	}
+	return states
+}
+
+// сохраняет состояние в файл
+func (s *StateStorage) save(store Store) {
+	states := store.snapshot()
+	if states == nil {
+		return
+	}
+	err := s.Save(states)
+	if err != nil {
+		logger.All().Warn("limiter can't save limits state to %s, error - %v", s.Filename, err)
+	}
+}
+
+// периодически сохраняет состояние
+func (s *StateStorage) run(store Store) {
+	s.Run(func() {
+		s.save(store)
+	})
+}
@@ -0,0 +1,114 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// тип хранилища ограничений
+type StoreType string
+
+const (
+	// ограничения хранятся в памяти процесса, используется по умолчанию
+	MemoryStoreType StoreType = "memory"
+
+	// ограничения хранятся в redis и общие для всех экземпляров postmanq
+	RedisStoreType StoreType = "redis"
+)
+
+// настройки хранилища ограничений
+type StoreConfig struct {
+	// тип хранилища
+	Type StoreType `yaml:"type"`
+
+	// адрес сервера redis
+	Address string `yaml:"address"`
+
+	// пароль сервера redis, необязательный параметр
+	Password string `yaml:"password"`
+
+	// префикс ключей, необязательный параметр
+	Prefix string `yaml:"prefix"`
+
+	// максимальное количество простаивающих соединений, по умолчанию количество ограничителей
+	Connections int `yaml:"connections"`
+
+	// время ожидания блокировки ограничений другим экземпляром, по умолчанию секунда
+	LockTimeout time.Duration `yaml:"lockTimeout"`
+}
+
+// хранилище состояния ограничений
+type Store interface {
+	// берет жетоны ограничений и возвращает время, через которое письмо можно будет отправить
+	take(*Limits, time.Time) time.Duration
+
+	// возвращает жетоны ограничений, взятые для письма, которое не будет по ним отправлено
+	give(*Limits, time.Time)
+
+	// возвращает копию состояния ограничений для сохранения между перезапусками
+	// возвращает nil, если хранилище само сохраняет состояние
+	snapshot() map[string][]*LimitState
+
+	// восстанавливает состояние ограничений
+	restore(map[string][]*LimitState)
+
+	// закрывает хранилище
+	close()
+}
+
+// хранилище ограничений в памяти процесса
+type MemoryStore struct {
+	// состояние ограничений, в качестве ключа используется ключ ограничений
+	states map[string][]*LimitState
+
+	// семафор
+	mutex *sync.Mutex
+}
+
+// создает хранилище ограничений в памяти процесса
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		states: make(map[string][]*LimitState),
+		mutex:  new(sync.Mutex),
+	}
+}
+
+func (m *MemoryStore) take(limits *Limits, now time.Time) time.Duration {
+	m.mutex.Lock()
+	states, delay := limits.take(m.states[limits.key], now)
+	m.states[limits.key] = states
+	m.mutex.Unlock()
+	return delay
+}
+
+func (m *MemoryStore) give(limits *Limits, now time.Time) {
+	m.mutex.Lock()
+	if states, ok := m.states[limits.key]; ok {
+		m.states[limits.key] = limits.give(states, now)
+	}
+	m.mutex.Unlock()
+}
+
+func (m *MemoryStore) snapshot() map[string][]*LimitState {
+	m.mutex.Lock()
+	states := make(map[string][]*LimitState, len(m.states))
+	for key, keyStates := range m.states {
+		states[key] = make([]*LimitState, len(keyStates))
+		for i, state := range keyStates {
+			stateCopy := *state
+			states[key][i] = &stateCopy
+		}
+	}
+	m.mutex.Unlock()
+	return states
+}
+
+func (m *MemoryStore) restore(states map[string][]*LimitState) {
+	m.mutex.Lock()
+	for key, keyStates := range states {
+		m.states[key] = keyStates
+	}
+	m.mutex.Unlock()
+}
+
+func (m *MemoryStore) close() {}
@@ -0,0 +1,223 @@
+package limiter
+
+import (
+	"encoding/json"
+	"github.com/actionpay/postmanq/common"
+	"github.com/actionpay/postmanq/logger"
+	"math"
+	"net/http"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// путь, по которому отдается состояние адаптивных ограничений
+const throttlesStatusPath = "/throttles"
+
+// настройки адаптивного ограничения
+// при временных отказах почтового сервиса (421 и другие 4xx) частота и количество одновременных отправок
+// уменьшаются в несколько раз, при успешных отправках постепенно восстанавливаются (AIMD)
+type ThrottleConfig struct {
+	// адрес, на котором по пути /throttles отдается состояние адаптивных ограничений, необязательный параметр
+	Status string `yaml:"status"`
+
+	// максимальное количество писем в секунду для почтового провайдера
+	Rate float64 `yaml:"rate"`
+
+	// максимальное количество одновременных отправок для почтового провайдера
+	Concurrency float64 `yaml:"concurrency"`
+
+	// минимальное количество писем в секунду
+	MinRate float64 `yaml:"minRate"`
+
+	// минимальное количество одновременных отправок
+	MinConcurrency float64 `yaml:"minConcurrency"`
+
+	// множитель, на который уменьшаются ограничения при временном отказе
+	Decrease float64 `yaml:"decrease"`
+
+	// прибавка к частоте отправки при успешной отправке
+	Increase float64 `yaml:"increase"`
+}
+
+// инициализирует значения по умолчанию
+func (t *ThrottleConfig) init() {
+	if t.Rate <= 0 {
+		t.Rate = 100
+	}
+	if t.Concurrency <= 0 {
+		t.Concurrency = 50
+	}
+	if t.MinRate <= 0 {
+		t.MinRate = 0.1
+	}
+	if t.MinConcurrency < 1 {
+		t.MinConcurrency = 1
+	}
+	if t.Decrease <= 0 || t.Decrease >= 1 {
+		t.Decrease = 0.5
+	}
+	if t.Increase <= 0 {
+		t.Increase = 0.1
+	}
+}
+
+// адаптивное ограничение почтового провайдера
+type Throttle struct {
+	// почтовый провайдер или домен почтового сервиса
+	Provider string `json:"provider"`
+
+	// допустимое количество писем в секунду
+	Rate float64 `json:"rate"`
+
+	// допустимое количество одновременных отправок
+	Concurrency float64 `json:"concurrency"`
+
+	// текущее количество одновременных отправок
+	Active int `json:"active"`
+
+	// количество временных отказов
+	Deferrals int64 `json:"deferrals"`
+
+	// количество успешных отправок
+	Successes int64 `json:"successes"`
+
+	// дата последнего временного отказа
+	DeferralDate time.Time `json:"deferralDate"`
+
+	// количество писем, которое можно отправить сразу
+	tokens float64
+
+	// дата последнего пополнения количества писем
+	refillDate time.Time
+
+	// настройки
+	conf *ThrottleConfig
+
+	// семафор
+	mutex *sync.Mutex
+}
+
+// создает новое адаптивное ограничение, ограничение начинает с максимальных значений
+func newThrottle(provider string, conf *ThrottleConfig) *Throttle {
+	return &Throttle{
+		Provider:    provider,
+		Rate:        conf.Rate,
+		Concurrency: conf.Concurrency,
+		tokens:      math.Max(1, conf.Rate),
+		refillDate:  time.Now(),
+		conf:        conf,
+		mutex:       new(sync.Mutex),
+	}
+}
+
+// занимает место одновременной отправки
+// если письмо отправлять нельзя, возвращает время, через которое стоит повторить отправку
+func (t *Throttle) acquire(now time.Time) (time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// пополняем количество писем пропорционально прошедшему времени, но не больше, чем на секунду вперед
+	t.tokens = math.Min(math.Max(1, t.Rate), t.tokens+now.Sub(t.refillDate).Seconds()*t.Rate)
+	t.refillDate = now
+	if t.Active >= int(t.Concurrency) {
+		return time.Second, false
+	} else if t.tokens < 1 {
+		return time.Duration((1 - t.tokens) / t.Rate * float64(time.Second)), false
+	} else {
+		t.tokens--
+		t.Active++
+		return 0, true
+	}
+}
+
+// освобождает место одновременной отправки
+func (t *Throttle) Release() {
+	t.mutex.Lock()
+	if t.Active > 0 {
+		t.Active--
+	}
+	t.mutex.Unlock()
+}
+
+// учитывает ответ почтового сервиса
+// ответ учитывается тем же ограничением, в котором письмо заняло место одновременной отправки
+func (t *Throttle) Respond(event *common.SendEvent, err error) {
+	if err == nil {
+		t.increase()
+	} else if protoErr, ok := err.(*textproto.Error); ok && protoErr.Code >= 400 && protoErr.Code < 500 {
+		t.decrease(protoErr)
+	}
+}
+
+// постепенно восстанавливает ограничения после успешной отправки
+func (t *Throttle) increase() {
+	t.mutex.Lock()
+	t.Successes++
+	if t.Rate < t.conf.Rate || t.Concurrency < t.conf.Concurrency {
+		t.Rate = math.Min(t.conf.Rate, t.Rate+t.conf.Increase)
+		// количество одновременных отправок растет на единицу за каждые Concurrency успешных отправок
+		t.Concurrency = math.Min(t.conf.Concurrency, t.Concurrency+1/t.Concurrency)
+		if t.Rate == t.conf.Rate && t.Concurrency == t.conf.Concurrency {
+			logger.All().Info("limiter throttle %s recovered, rate %.2f, concurrency %d", t.Provider, t.Rate, int(t.Concurrency))
+		}
+	}
+	t.mutex.Unlock()
+}
+
+// уменьшает ограничения после временного отказа
+func (t *Throttle) decrease(err *textproto.Error) {
+	t.mutex.Lock()
+	t.Deferrals++
+	t.DeferralDate = time.Now()
+	t.Rate = math.Max(t.conf.MinRate, t.Rate*t.conf.Decrease)
+	t.Concurrency = math.Max(t.conf.MinConcurrency, math.Floor(t.Concurrency*t.conf.Decrease))
+	t.tokens = math.Min(t.tokens, math.Max(1, t.Rate))
+	logger.All().Warn("limiter throttle %s deferred with %d %s, rate %.2f, concurrency %d", t.Provider, err.Code, err.Msg, t.Rate, int(t.Concurrency))
+	t.mutex.Unlock()
+}
+
+// возвращает копию состояния ограничения
+func (t *Throttle) snapshot() Throttle {
+	t.mutex.Lock()
+	snapshot := Throttle{
+		Provider:     t.Provider,
+		Rate:         t.Rate,
+		Concurrency:  math.Floor(t.Concurrency),
+		Active:       t.Active,
+		Deferrals:    t.Deferrals,
+		Successes:    t.Successes,
+		DeferralDate: t.DeferralDate,
+	}
+	t.mutex.Unlock()
+	return snapshot
+}
+
+// отдает состояние адаптивных ограничений в формате json
+func (s *Service) writeThrottles(writer http.ResponseWriter, request *http.Request) {
+	s.throttlesMutex.RLock()
+	throttles := make([]Throttle, 0, len(s.throttles))
+	for _, throttle := range s.throttles {
+		throttles = append(throttles, throttle.snapshot())
+	}
+	s.throttlesMutex.RUnlock()
+	writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(writer).Encode(throttles)
+	if err != nil {
+		logger.All().Warn("limiter can't write throttles status, error - %v", err)
+	}
+}
+
+// создает обработчик запросов состояния, на остальные пути отвечает 404
+func (s *Service) newStatusMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(throttlesStatusPath, s.writeThrottles)
+	return mux
+}
+
+// запускает отдачу состояния адаптивных ограничений
+func (s *Service) serveStatus() {
+	err := http.ListenAndServe(s.Throttle.Status, s.newStatusMux())
+	if err != nil {
+		logger.All().Warn("limiter can't serve throttles status on %s, error - %v", s.Throttle.Status, err)
+	}
+}
@@ -0,0 +1,72 @@
+package limiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/actionpay/postmanq/common"
+	"github.com/actionpay/postmanq/logger"
+)
+
+func newTestThrottleService() *Service {
+	logger.Inst()
+	service = &Service{
+		Throttle:       &ThrottleConfig{Rate: 10, Concurrency: 4},
+		throttles:      make(map[string]*Throttle),
+		providers:      map[string]*MailProvider{"a.test": newTestProvider("mx.test"), "b.test": newTestProvider("mx.test")},
+		throttlesMutex: new(sync.RWMutex),
+	}
+	service.Throttle.init()
+	return service
+}
+
+// создает уже найденного провайдера
+func newTestProvider(name string) *MailProvider {
+	ready := make(chan struct{})
+	close(ready)
+	return &MailProvider{name: name, expireDate: time.Now().Add(time.Hour), ready: ready, resolved: true}
+}
+
+func TestThrottleRespondsOnAcquiredObject(t *testing.T) {
+	newTestThrottleService()
+	throttle := service.getThrottle("a.test")
+	if throttle.Provider != "mx.test" || service.getThrottle("b.test") != throttle {
+		t.Fatalf("domains of one provider should share throttle")
+	}
+	if _, ok := throttle.acquire(time.Now()); !ok {
+		t.Fatalf("expected free slot")
+	}
+	message := &common.MailMessage{Envelope: "sender@example.com", Recipient: "user@a.test"}
+	message.Init()
+	event := common.NewSendEvent(message)
+	throttle.Respond(event, &textproto.Error{Code: 421, Msg: "try later"})
+	throttle.Release()
+	snapshot := throttle.snapshot()
+	if snapshot.Deferrals != 1 || snapshot.Concurrency != 2 || snapshot.Active != 0 {
+		t.Fatalf("unexpected throttle state %+v", snapshot)
+	}
+	if len(service.throttles) != 1 {
+		t.Fatalf("expected one throttle, got %d", len(service.throttles))
+	}
+}
+
+func TestThrottleStatusPath(t *testing.T) {
+	newTestThrottleService().getThrottle("a.test")
+	mux := service.newStatusMux()
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, throttlesStatusPath, nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected status response %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 on other paths, got %d", recorder.Code)
+	}
+}
@@ -60,16 +60,17 @@ type Service struct {
 func Inst() common.SendingService {
 	if service == nil {
 		service = new(Service)
-		for i := 0; i < common.DefaultWorkersCount; i++ {
-			go service.listenCommonMessags()
-		}
 		service.Configs = map[string]*Config{
 			"localhost": &Config{
 				LevelName: "debug",
 				Output:    "stdout",
 			},
 		}
+		// каналы логирования создаются до запуска горутин, которые их читают
 		service.init()
+		for i := 0; i < common.DefaultWorkersCount; i++ {
+			go service.listenCommonMessags()
+		}
 	}
 	return service
 }
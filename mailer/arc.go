@@ -0,0 +1,317 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/actionpay/postmanq/common"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// заголовок печати ARC
+	arcSealHeader = "ARC-Seal"
+
+	// заголовок подписи письма ARC
+	arcMessageSignatureHeader = "ARC-Message-Signature"
+
+	// заголовок результатов проверки подлинности ARC
+	arcAuthenticationResultsHeader = "ARC-Authentication-Results"
+
+	// максимальное количество наборов ARC в письме, RFC 8617 4.2.1
+	maxArcInstances = 50
+
+	// префикс DNS записи политики DMARC, RFC 7489 6.1
+	dmarcRecordPrefix = "_dmarc."
+)
+
+// состояние цепочки ARC, RFC 8617 4.4
+type ArcChainStatus string
+
+const (
+	// цепочки нет
+	NoneArcChainStatus ArcChainStatus = "none"
+
+	// цепочка прошла проверку
+	PassArcChainStatus ArcChainStatus = "pass"
+
+	// цепочка не прошла проверку
+	FailArcChainStatus ArcChainStatus = "fail"
+)
+
+// набор заголовков ARC одного экземпляра
+type arcSet struct {
+	// номер экземпляра, i=
+	instance int
+
+	// заголовок ARC-Authentication-Results
+	results string
+
+	// заголовок ARC-Message-Signature
+	signature string
+
+	// заголовок ARC-Seal
+	seal string
+}
+
+// возвращает заголовки набора в том порядке, в котором они подписываются печатью, RFC 8617 5.1.1
+func (a *arcSet) headers() []string {
+	return []string{a.results, a.signature, a.seal}
+}
+
+// находит наборы ARC в заголовках письма и упорядочивает их по номеру экземпляра
+func parseArcChain(headers []string) ([]*arcSet, error) {
+	sets := make(map[int]*arcSet)
+	for _, name := range []string{arcAuthenticationResultsHeader, arcMessageSignatureHeader, arcSealHeader} {
+		for _, header := range findHeaders(headers, name) {
+			instance, err := strconv.Atoi(parseHeaderTags(header)["i"])
+			if err != nil || instance < 1 || instance > maxArcInstances {
+				return nil, fmt.Errorf("%s has invalid instance", name)
+			}
+			set, ok := sets[instance]
+			if !ok {
+				set = &arcSet{instance: instance}
+				sets[instance] = set
+			}
+			var field *string
+			switch name {
+			case arcAuthenticationResultsHeader:
+				field = &set.results
+			case arcMessageSignatureHeader:
+				field = &set.signature
+			default:
+				field = &set.seal
+			}
+			if len(*field) > 0 {
+				return nil, fmt.Errorf("%s with instance %d is duplicated", name, instance)
+			}
+			*field = header
+		}
+	}
+	chain := make([]*arcSet, len(sets))
+	for i := range chain {
+		set, ok := sets[i+1]
+		if !ok || len(set.results) == 0 || len(set.signature) == 0 || len(set.seal) == 0 {
+			return nil, fmt.Errorf("arc set with instance %d is incomplete", i+1)
+		}
+		chain[i] = set
+	}
+	return chain, nil
+}
+
+// проверяет цепочку ARC письма, RFC 8617 5.2
+func validateArcChain(headers []string, body string, lookup func(string, string) (crypto.PublicKey, error)) (ArcChainStatus, error) {
+	chain, err := parseArcChain(headers)
+	if err != nil {
+		return FailArcChainStatus, err
+	}
+	if len(chain) == 0 {
+		return NoneArcChainStatus, nil
+	}
+	for i, set := range chain {
+		status := ArcChainStatus(parseHeaderTags(set.seal)["cv"])
+		if i == 0 && status != NoneArcChainStatus || i > 0 && status != PassArcChainStatus {
+			return FailArcChainStatus, fmt.Errorf("arc set with instance %d has chain status %s", set.instance, status)
+		}
+	}
+
+	// проверяется только подпись письма последнего набора, предыдущие наборы могли сломаться при пересылке
+	last := chain[len(chain)-1]
+	tags := parseHeaderTags(last.signature)
+	publicKey, err := lookup(tags["d"], tags["s"])
+	if err == nil {
+		err = verifyDkimSignature(headers, body, last.signature, tags, publicKey)
+	}
+	if err != nil {
+		return FailArcChainStatus, fmt.Errorf("arc message signature with instance %d is invalid, error - %v", last.instance, err)
+	}
+
+	// печать каждого набора подписывает все предыдущие наборы
+	for i := len(chain) - 1; i >= 0; i-- {
+		tags = parseHeaderTags(chain[i].seal)
+		publicKey, err = lookup(tags["d"], tags["s"])
+		if err == nil {
+			hash := sha256.New()
+			for _, set := range chain[:i] {
+				for _, header := range set.headers() {
+					hash.Write([]byte(canonicalizeHeader(header, relaxedCanonicalization)))
+				}
+			}
+			hash.Write([]byte(canonicalizeHeader(chain[i].results, relaxedCanonicalization)))
+			hash.Write([]byte(canonicalizeHeader(chain[i].signature, relaxedCanonicalization)))
+			writeUnsignedHeader(hash, chain[i].seal, relaxedCanonicalization)
+			err = verifyDkimDigest(publicKey, hash.Sum(nil), tags["b"])
+		}
+		if err != nil {
+			return FailArcChainStatus, fmt.Errorf("arc seal with instance %d is invalid, error - %v", chain[i].instance, err)
+		}
+	}
+	return PassArcChainStatus, nil
+}
+
+// проверяет подписи dkim полученного письма и возвращает результаты для ARC-Authentication-Results, RFC 8601 2.7
+// SPF не проверяется, т.к. ip, с которого письмо было получено, неизвестен, поэтому в результатах явно указывается spf=none с адресом из конверта,
+// а DMARC указывается, только если прошла подпись домена, выровненного с доменом из заголовка From, RFC 7489 4.2
+func authenticateMessage(envelope string, headers []string, body string, lookup func(string, string) (crypto.PublicKey, error), lookupTxt func(string) ([]string, error)) []string {
+	results := make([]string, 0)
+	aligned := false
+	var fromDomain string
+	if from := findHeaders(headers, "From"); len(from) == 1 {
+		if address, err := common.ParseAddress(strings.Replace(from[0][strings.Index(from[0], ":")+1:], "\r\n", common.EmptyStr, -1)); err == nil {
+			fromDomain = address.Domain
+		}
+	}
+	for _, signature := range findHeaders(headers, dkimSignatureHeader) {
+		tags := parseHeaderTags(signature)
+		domain := strings.ToLower(tags["d"])
+		var err error
+		if tags["a"] != string(RsaSha256DkimAlgorithm) && tags["a"] != string(Ed25519Sha256DkimAlgorithm) {
+			err = fmt.Errorf("unsupported algorithm %s", tags["a"])
+		} else {
+			var publicKey crypto.PublicKey
+			publicKey, err = lookup(domain, tags["s"])
+			if err == nil {
+				err = verifyDkimSignature(headers, body, signature, tags, publicKey)
+			}
+		}
+		if err == nil {
+			results = append(results, fmt.Sprintf("dkim=pass header.d=%s header.s=%s", domain, tags["s"]))
+			aligned = aligned || len(fromDomain) > 0 && isAlignedDomain(domain, fromDomain)
+		} else {
+			results = append(results, fmt.Sprintf("dkim=fail header.d=%s header.s=%s", domain, tags["s"]))
+		}
+	}
+	if len(results) == 0 {
+		results = append(results, "dkim=none")
+	}
+	if len(envelope) > 0 {
+		results = append(results, fmt.Sprintf("spf=none smtp.mailfrom=%s", envelope))
+	} else {
+		results = append(results, "spf=none")
+	}
+	if aligned {
+		if hasDmarcRecord(fromDomain, lookupTxt) {
+			results = append(results, fmt.Sprintf("dmarc=pass header.from=%s", fromDomain))
+		} else {
+			results = append(results, fmt.Sprintf("dmarc=none header.from=%s", fromDomain))
+		}
+	}
+	return results
+}
+
+// проверяет, что домен подписи совпадает с доменом из заголовка From или один из них является поддоменом другого
+func isAlignedDomain(domain, fromDomain string) bool {
+	return domain == fromDomain || strings.HasSuffix(fromDomain, "."+domain) || strings.HasSuffix(domain, "."+fromDomain)
+}
+
+// проверяет, что для домена или одного из его родительских доменов опубликована политика DMARC, RFC 7489 6.6.3
+func hasDmarcRecord(domain string, lookupTxt func(string) ([]string, error)) bool {
+	labels := strings.Split(domain, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		records, err := lookupTxt(dmarcRecordPrefix + strings.Join(labels[i:], "."))
+		if err == nil {
+			for _, record := range records {
+				if strings.HasPrefix(strings.TrimSpace(record), "v=DMARC1") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// добавляет к цепочке ARC пересылаемого письма новый набор с результатами проверки полученного письма, RFC 8617 5.1
+// письмо должно быть уже подписано dkim, т.к. подпись письма ARC подписывает и заголовок DKIM-Signature
+func (d *DkimConfig) seal(domain, message string, key *DkimKey, status ArcChainStatus, results []string, now time.Time) (string, error) {
+	headers, body := splitMessage(message)
+	chain, err := parseArcChain(headers)
+	if err != nil {
+		// номер нового набора определить нельзя
+		return message, err
+	}
+	if len(chain) > 0 && ArcChainStatus(parseHeaderTags(chain[len(chain)-1].seal)["cv"]) == FailArcChainStatus {
+		// цепочка уже сломана, новый набор не добавляется, RFC 8617 5.1.2
+		return message, errors.New("arc chain is already failed")
+	}
+	if len(chain) == maxArcInstances {
+		return message, fmt.Errorf("arc chain has %d sets", maxArcInstances)
+	}
+	set := &arcSet{instance: len(chain) + 1}
+	results = append(results, fmt.Sprintf("arc=%s", status))
+	set.results = fmt.Sprintf("%s: i=%d; %s;\r\n\t%s\r\n", arcAuthenticationResultsHeader, set.instance, domain, strings.Join(results, ";\r\n\t"))
+
+	canonicalBody := canonicalizeBody(body, d.bodyCanonicalization)
+	bodyHash := sha256.Sum256([]byte(canonicalBody))
+	// заголовки ARC подписью письма не подписываются, RFC 8617 4.1.2
+	signedNames, signedHeaders := d.selectHeaders(headers, append([]string{dkimSignatureHeader}, d.Headers...))
+	tags := []string{
+		fmt.Sprintf("i=%d", set.instance),
+		fmt.Sprintf("a=%s", key.algorithm),
+		fmt.Sprintf("c=%s/%s", d.headerCanonicalization, d.bodyCanonicalization),
+		fmt.Sprintf("d=%s", domain),
+		fmt.Sprintf("s=%s", key.Selector),
+		fmt.Sprintf("t=%d", now.Unix()),
+		fmt.Sprintf("h=%s", strings.Join(signedNames, ":")),
+		fmt.Sprintf("bh=%s", base64.StdEncoding.EncodeToString(bodyHash[:])),
+	}
+	signature := fmt.Sprintf("%s: %s;\r\n\tb=", arcMessageSignatureHeader, strings.Join(tags, ";\r\n\t"))
+	hash := sha256.New()
+	for _, header := range signedHeaders {
+		hash.Write([]byte(canonicalizeHeader(header, d.headerCanonicalization)))
+	}
+	writeUnsignedHeader(hash, signature, d.headerCanonicalization)
+	signed, err := key.signDigest(hash.Sum(nil))
+	if err != nil {
+		return message, err
+	}
+	set.signature = signature + foldBase64(base64.StdEncoding.EncodeToString(signed)) + "\r\n"
+
+	tags = []string{
+		fmt.Sprintf("i=%d", set.instance),
+		fmt.Sprintf("a=%s", key.algorithm),
+		fmt.Sprintf("cv=%s", status),
+		fmt.Sprintf("d=%s", domain),
+		fmt.Sprintf("s=%s", key.Selector),
+		fmt.Sprintf("t=%d", now.Unix()),
+	}
+	seal := fmt.Sprintf("%s: %s;\r\n\tb=", arcSealHeader, strings.Join(tags, ";\r\n\t"))
+	hash = sha256.New()
+	// сломанная цепочка тоже запечатывается, но печать подписывает только новый набор, RFC 8617 5.1.2
+	if status != FailArcChainStatus {
+		for _, previous := range chain {
+			for _, header := range previous.headers() {
+				hash.Write([]byte(canonicalizeHeader(header, relaxedCanonicalization)))
+			}
+		}
+	}
+	hash.Write([]byte(canonicalizeHeader(set.results, relaxedCanonicalization)))
+	hash.Write([]byte(canonicalizeHeader(set.signature, relaxedCanonicalization)))
+	writeUnsignedHeader(hash, seal, relaxedCanonicalization)
+	signed, err = key.signDigest(hash.Sum(nil))
+	if err != nil {
+		return message, err
+	}
+	set.seal = seal + foldBase64(base64.StdEncoding.EncodeToString(signed)) + "\r\n"
+
+	sealed := new(bytes.Buffer)
+	sealed.WriteString(set.seal)
+	sealed.WriteString(set.signature)
+	sealed.WriteString(set.results)
+	sealed.WriteString(message)
+	return sealed.String(), nil
+}
+
+// возвращает ключ для печати ARC, RFC 8617 определяет только rsa-sha256
+func arcKey(keys []*DkimKey) *DkimKey {
+	for _, key := range keys {
+		if key.algorithm == RsaSha256DkimAlgorithm {
+			return key
+		}
+	}
+	return nil
+}
@@ -0,0 +1,453 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/actionpay/postmanq/common"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// алгоритм подписи dkim
+type DkimAlgorithm string
+
+const (
+	// алгоритм не определен
+	EmptyDkimAlgorithm DkimAlgorithm = ""
+
+	// RSA, RFC 6376
+	RsaSha256DkimAlgorithm DkimAlgorithm = "rsa-sha256"
+
+	// Ed25519, RFC 8463
+	Ed25519Sha256DkimAlgorithm DkimAlgorithm = "ed25519-sha256"
+)
+
+const (
+	// простая канонизация, письмо подписывается как есть
+	simpleCanonicalization = "simple"
+
+	// мягкая канонизация, подпись не ломается при переносе заголовков и изменении пробелов
+	relaxedCanonicalization = "relaxed"
+
+	// селектор по умолчанию
+	defaultDkimSelector = "mail"
+
+	// заголовок подписи
+	dkimSignatureHeader = "DKIM-Signature"
+)
+
+var (
+	// подписываемые заголовки по умолчанию
+	defaultDkimHeaders = []string{
+		"From",
+		"Reply-To",
+		"To",
+		"Cc",
+		"Subject",
+		"Date",
+		"Message-ID",
+		"In-Reply-To",
+		"References",
+		"MIME-Version",
+		"Content-Type",
+		"Content-Transfer-Encoding",
+		"List-Unsubscribe",
+		"List-Unsubscribe-Post",
+		"Feedback-ID",
+	}
+
+	// заголовки, подписываемые с запасом по умолчанию
+	defaultDkimOversignHeaders = []string{
+		"From",
+		"To",
+		"Subject",
+		"Date",
+	}
+)
+
+// ключ dkim
+type DkimKey struct {
+	// селектор, публичный ключ должен быть опубликован в DNS записи selector._domainkey.domain
+	Selector string `yaml:"selector"`
+
+	// путь до закрытого ключа, RSA в PKCS#1 или PKCS#8, Ed25519 в PKCS#8
+	PrivateKeyFilename string `yaml:"privateKey"`
+
+	// путь до публичного ключа в PEM, которым проверяется подпись перед отправкой,
+	// по умолчанию подпись проверяется публичным ключом из DNS записи селектора
+	PublicKeyFilename string `yaml:"publicKey"`
+
+	// начало действия ключа, по умолчанию ключ действует сразу
+	ActiveFrom time.Time `yaml:"activeFrom"`
+
+	// окончание действия ключа, по умолчанию ключ действует всегда
+	ActiveTo time.Time `yaml:"activeTo"`
+
+	// DNS запись ключа совпадает с ключом
+	published bool
+
+	// семафор
+	mutex *sync.RWMutex
+
+	// закрытый ключ
+	signer crypto.Signer
+
+	// алгоритм подписи, определяется по ключу
+	algorithm DkimAlgorithm
+
+	// публичный ключ для проверки подписи
+	verifier crypto.PublicKey
+
+	// публичный ключ, полученный из DNS записи селектора
+	dnsKey crypto.PublicKey
+
+	// время получения публичного ключа из DNS
+	dnsKeyDate time.Time
+}
+
+// читает закрытый ключ и определяет алгоритм подписи
+func (d *DkimKey) init() error {
+	if len(d.Selector) == 0 {
+		d.Selector = defaultDkimSelector
+	}
+	if !d.ActiveFrom.IsZero() && !d.ActiveTo.IsZero() && !d.ActiveFrom.Before(d.ActiveTo) {
+		return fmt.Errorf("activeTo should be after activeFrom")
+	}
+	d.mutex = new(sync.RWMutex)
+	data, err := ioutil.ReadFile(d.PrivateKeyFilename)
+	if err == nil {
+		d.signer, d.algorithm, err = parseDkimPrivateKey(data)
+	}
+	if err == nil && len(d.PublicKeyFilename) > 0 {
+		data, err = ioutil.ReadFile(d.PublicKeyFilename)
+		if err == nil {
+			d.verifier, err = parseDkimPublicKey(data)
+		}
+	}
+	return err
+}
+
+// возвращает публичный ключ, которым проверяется подпись
+// если публичный ключ не указан в настройках, используется ключ из DNS, т.к. почтовый сервис проверит подпись именно им
+// ключ из закрытого не подходит, подпись им проверится всегда и не покажет, что DNS запись не совпадает с ключом
+func (d *DkimKey) verificationKey(domain string, now time.Time) (crypto.PublicKey, error) {
+	if d.verifier != nil {
+		return d.verifier, nil
+	}
+	d.mutex.RLock()
+	publicKey, date := d.dnsKey, d.dnsKeyDate
+	d.mutex.RUnlock()
+	if publicKey != nil && now.Sub(date) < dkimPublicKeyTimeout {
+		return publicKey, nil
+	}
+	publicKey, err := dkimPublicKeyLookup(domain, d.Selector)
+	if err == nil {
+		d.mutex.Lock()
+		d.dnsKey = publicKey
+		d.dnsKeyDate = now
+		d.mutex.Unlock()
+	}
+	return publicKey, err
+}
+
+// разбирает публичный ключ в формате PEM
+func parseDkimPublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// разбирает закрытый ключ в формате PEM
+func parseDkimPrivateKey(data []byte) (crypto.Signer, DkimAlgorithm, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, EmptyDkimAlgorithm, errors.New("private key is not PEM encoded")
+	}
+	var key interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, EmptyDkimAlgorithm, err
+	}
+	switch privateKey := key.(type) {
+	case *rsa.PrivateKey:
+		return privateKey, RsaSha256DkimAlgorithm, nil
+	case ed25519.PrivateKey:
+		return privateKey, Ed25519Sha256DkimAlgorithm, nil
+	default:
+		return nil, EmptyDkimAlgorithm, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
+// настройки dkim отправителя
+type DkimConfig struct {
+	// подписываемые заголовки, заголовки, которых нет в письме, не подписываются
+	Headers []string `yaml:"headers"`
+
+	// заголовки, подписываемые на один раз больше, чем они встречаются в письме,
+	// после этого заголовок нельзя добавить в письмо, не сломав подпись
+	Oversign []string `yaml:"oversign"`
+
+	// канонизация заголовков и тела, например relaxed/simple, по умолчанию relaxed/relaxed
+	Canonicalization string `yaml:"canonicalization"`
+
+	// указывать в подписи длину тела письма, l=
+	BodyLength bool `yaml:"bodyLength"`
+
+	// время действия подписи, x=, по умолчанию подпись не истекает
+	Expiration time.Duration `yaml:"expiration"`
+
+	// ключи, письмо подписывается каждым действующим ключом
+	Keys []*DkimKey `yaml:"keys"`
+
+	// подписывать письма только ключами, DNS запись которых совпадает с ключом, по умолчанию true
+	VerifyDns *bool `yaml:"verifyDns"`
+
+	// канонизация заголовков
+	headerCanonicalization string
+
+	// канонизация тела
+	bodyCanonicalization string
+
+	// заголовки, подписываемые с запасом, для быстрого поиска
+	oversign map[string]bool
+}
+
+// проверяет настройки и читает ключи
+func (d *DkimConfig) init() error {
+	if len(d.Headers) == 0 {
+		d.Headers = defaultDkimHeaders
+	}
+	if d.Oversign == nil {
+		d.Oversign = defaultDkimOversignHeaders
+	}
+	d.oversign = make(map[string]bool, len(d.Oversign))
+	for _, header := range d.Oversign {
+		d.oversign[strings.ToLower(header)] = true
+	}
+	if len(d.Canonicalization) == 0 {
+		d.Canonicalization = relaxedCanonicalization + "/" + relaxedCanonicalization
+	}
+	parts := strings.SplitN(d.Canonicalization, "/", 2)
+	d.headerCanonicalization = parts[0]
+	// если канонизация тела не указана, используется простая, RFC 6376 3.5
+	d.bodyCanonicalization = simpleCanonicalization
+	if len(parts) == 2 {
+		d.bodyCanonicalization = parts[1]
+	}
+	for _, canonicalization := range []string{d.headerCanonicalization, d.bodyCanonicalization} {
+		if canonicalization != simpleCanonicalization && canonicalization != relaxedCanonicalization {
+			return fmt.Errorf("unknown dkim canonicalization %s", d.Canonicalization)
+		}
+	}
+	for _, key := range d.Keys {
+		if err := key.init(); err != nil {
+			return fmt.Errorf("can't read dkim key %s, error - %v", key.PrivateKeyFilename, err)
+		}
+	}
+	return nil
+}
+
+// подписывает письмо всеми ключами и возвращает письмо с заголовками подписи
+// переводы строк в письме приводятся к CRLF, т.к. письмо все равно уйдет почтовому сервису с CRLF
+func (d *DkimConfig) sign(domain, message string, keys []*DkimKey, now time.Time) (string, error) {
+	message = toCRLF(message)
+	headers, body := splitMessage(message)
+	canonicalBody := canonicalizeBody(body, d.bodyCanonicalization)
+	bodyHash := sha256.Sum256([]byte(canonicalBody))
+
+	signedNames, signedHeaders := d.selectHeaders(headers, d.Headers)
+
+	signatures := new(bytes.Buffer)
+	for _, key := range keys {
+		tags := []string{
+			"v=1",
+			fmt.Sprintf("a=%s", key.algorithm),
+			fmt.Sprintf("c=%s/%s", d.headerCanonicalization, d.bodyCanonicalization),
+			fmt.Sprintf("d=%s", domain),
+			fmt.Sprintf("s=%s", key.Selector),
+			fmt.Sprintf("t=%d", now.Unix()),
+		}
+		if d.Expiration > 0 {
+			tags = append(tags, fmt.Sprintf("x=%d", now.Add(d.Expiration).Unix()))
+		}
+		if d.BodyLength {
+			tags = append(tags, fmt.Sprintf("l=%d", len(canonicalBody)))
+		}
+		tags = append(tags, fmt.Sprintf("h=%s", strings.Join(signedNames, ":")))
+		tags = append(tags, fmt.Sprintf("bh=%s", base64.StdEncoding.EncodeToString(bodyHash[:])))
+		signature := fmt.Sprintf("%s: %s;\r\n\tb=", dkimSignatureHeader, strings.Join(tags, ";\r\n\t"))
+
+		hash := sha256.New()
+		for _, header := range signedHeaders {
+			hash.Write([]byte(canonicalizeHeader(header, d.headerCanonicalization)))
+		}
+		// заголовок подписи подписывается с пустым значением b= и без завершающего перевода строки
+		hash.Write([]byte(strings.TrimSuffix(canonicalizeHeader(signature, d.headerCanonicalization), "\r\n")))
+		signed, err := key.signDigest(hash.Sum(nil))
+		if err != nil {
+			return message, err
+		}
+		signatures.WriteString(signature)
+		signatures.WriteString(foldBase64(base64.StdEncoding.EncodeToString(signed)))
+		signatures.WriteString("\r\n")
+	}
+	return signatures.String() + message, nil
+}
+
+// выбирает подписываемые заголовки и возвращает их имена для тега h= и сами заголовки
+// экземпляры заголовков выбираются снизу вверх, RFC 6376 5.4.2
+func (d *DkimConfig) selectHeaders(headers []string, names []string) ([]string, []string) {
+	signedNames := make([]string, 0)
+	signedHeaders := make([]string, 0)
+	for _, name := range names {
+		instances := findHeaders(headers, name)
+		for i := len(instances) - 1; i >= 0; i-- {
+			signedNames = append(signedNames, name)
+			signedHeaders = append(signedHeaders, instances[i])
+		}
+		if d.oversign[strings.ToLower(name)] {
+			// несуществующий экземпляр заголовка подписывается как пустая строка
+			signedNames = append(signedNames, name)
+		}
+	}
+	return signedNames, signedHeaders
+}
+
+// подписывает хеш заголовков закрытым ключом
+func (d *DkimKey) signDigest(digest []byte) ([]byte, error) {
+	if d.algorithm == Ed25519Sha256DkimAlgorithm {
+		// Ed25519 подписывает хеш как сообщение, RFC 8463 3
+		return d.signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	return d.signer.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+// приводит переводы строк к CRLF
+func toCRLF(message string) string {
+	return strings.Replace(strings.Replace(message, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// разделяет письмо на заголовки и тело
+// каждый заголовок возвращается вместе с продолжениями и завершающим CRLF
+func splitMessage(message string) ([]string, string) {
+	headers := make([]string, 0)
+	for len(message) > 0 {
+		if strings.HasPrefix(message, "\r\n") {
+			return headers, message[2:]
+		}
+		end := strings.Index(message, "\r\n")
+		if end == -1 {
+			end = len(message)
+		} else {
+			end += 2
+		}
+		line := message[:end]
+		message = message[end:]
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += line
+		} else {
+			headers = append(headers, line)
+		}
+	}
+	return headers, common.EmptyStr
+}
+
+// возвращает все экземпляры заголовка в порядке следования
+func findHeaders(headers []string, name string) []string {
+	found := make([]string, 0)
+	for _, header := range headers {
+		colon := strings.Index(header, ":")
+		if colon > 0 && strings.EqualFold(strings.TrimRight(header[:colon], " \t"), name) {
+			found = append(found, header)
+		}
+	}
+	return found
+}
+
+// канонизирует заголовок, RFC 6376 3.4.1 и 3.4.2
+func canonicalizeHeader(header, canonicalization string) string {
+	if canonicalization == simpleCanonicalization {
+		return header
+	}
+	colon := strings.Index(header, ":")
+	name := strings.ToLower(strings.TrimRight(header[:colon], " \t"))
+	value := strings.Replace(header[colon+1:], "\r\n", common.EmptyStr, -1)
+	value = strings.TrimSpace(collapseSpaces(value))
+	return name + ":" + value + "\r\n"
+}
+
+// канонизирует тело письма, RFC 6376 3.4.3 и 3.4.4
+func canonicalizeBody(body, canonicalization string) string {
+	if canonicalization == relaxedCanonicalization {
+		lines := strings.Split(body, "\r\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(collapseSpaces(line), " ")
+		}
+		body = strings.Join(lines, "\r\n")
+	}
+	// отбрасываем пустые строки в конце тела
+	for strings.HasSuffix(body, "\r\n") {
+		body = strings.TrimSuffix(body, "\r\n")
+	}
+	if len(body) > 0 {
+		return body + "\r\n"
+	} else if canonicalization == simpleCanonicalization {
+		return "\r\n"
+	} else {
+		return common.EmptyStr
+	}
+}
+
+// заменяет последовательности пробелов и табуляций одним пробелом
+func collapseSpaces(value string) string {
+	buf := new(bytes.Buffer)
+	space := false
+	for i := 0; i < len(value); i++ {
+		if value[i] == ' ' || value[i] == '\t' {
+			space = true
+		} else {
+			if space {
+				buf.WriteByte(' ')
+				space = false
+			}
+			buf.WriteByte(value[i])
+		}
+	}
+	if space {
+		buf.WriteByte(' ')
+	}
+	return buf.String()
+}
+
+// переносит значение подписи, чтобы строки заголовка не превышали рекомендуемую длину
+func foldBase64(value string) string {
+	const lineLen = 72
+	parts := make([]string, 0, len(value)/lineLen+1)
+	for len(value) > lineLen {
+		parts = append(parts, value[:lineLen])
+		value = value[lineLen:]
+	}
+	parts = append(parts, value)
+	return strings.Join(parts, "\r\n\t")
+}
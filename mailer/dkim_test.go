@@ -0,0 +1,263 @@
+package mailer
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/actionpay/postmanq/common"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const rfcMessage = "From: Joe SixPack <joe@football.example.com>\r\nTo: Suzie Q <suzie@shopping.example.net>\r\nSubject: Is dinner ready?\r\nDate: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\nMessage-ID: <20030712040037.46341.5F8J@football.example.com>\r\n\r\nHi.\r\n\r\nWe lost the game.  Are you hungry yet?\r\n\r\nJoe.\r\n"
+
+func TestRfc8463(t *testing.T) {
+	headers, body := splitMessage(rfcMessage)
+	bh := sha256.Sum256([]byte(canonicalizeBody(body, relaxedCanonicalization)))
+	if got := base64.StdEncoding.EncodeToString(bh[:]); got != "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=" {
+		t.Fatal("bh", got)
+	}
+	sigHeader := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n d=football.example.com; i=@football.example.com;\r\n q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n subject : date : message-id : from : subject : date;\r\n bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n b="
+	h := sha256.New()
+	for _, n := range []string{"from", "to", "subject", "date", "message-id"} {
+		h.Write([]byte(canonicalizeHeader(findHeaders(headers, n)[0], relaxedCanonicalization)))
+	}
+	h.Write([]byte(strings.TrimSuffix(canonicalizeHeader(sigHeader, relaxedCanonicalization), "\r\n")))
+	seed, _ := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	key := ed25519.NewKeyFromSeed(seed)
+	sig, _ := key.Sign(rand.Reader, h.Sum(nil), crypto.Hash(0))
+	if got := base64.StdEncoding.EncodeToString(sig); got != "/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==" {
+		t.Fatal("b", got)
+	}
+}
+
+func TestSignMultiple(t *testing.T) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, ek, _ := ed25519.GenerateKey(rand.Reader)
+	d := &DkimConfig{BodyLength: true, Expiration: time.Hour}
+	if err := d.init(); err != nil {
+		t.Fatal(err)
+	}
+	keys := []*DkimKey{{Selector: "r", signer: rk, algorithm: RsaSha256DkimAlgorithm}, {Selector: "e", signer: ek, algorithm: Ed25519Sha256DkimAlgorithm}}
+	out, err := d.sign("football.example.com", strings.Replace(rfcMessage, "\r\n", "\n", -1), keys, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "DKIM-Signature:") != 2 || !strings.Contains(out, "h=From:From:To:To:Subject:Subject:Date:Date:Message-ID;") {
+		t.Fatal(out)
+	}
+
+}
+
+func TestVerify(t *testing.T) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, ek, _ := ed25519.GenerateKey(rand.Reader)
+	published := map[string]crypto.PublicKey{"r": rk.Public(), "e": ek.Public()}
+	lookups := 0
+	dkimPublicKeyLookup = func(domain, selector string) (crypto.PublicKey, error) {
+		lookups++
+		if publicKey, ok := published[selector]; ok && domain == "football.example.com" {
+			return publicKey, nil
+		}
+		return nil, fmt.Errorf("key %s._domainkey.%s is not found", selector, domain)
+	}
+	defer func() { dkimPublicKeyLookup = lookupDkimPublicKey }()
+	now := time.Now()
+	for _, c := range []string{"relaxed/relaxed", "simple/simple", "relaxed/simple", "simple/relaxed"} {
+		for _, bl := range []bool{false, true} {
+			d := &DkimConfig{Canonicalization: c, BodyLength: bl}
+			if err := d.init(); err != nil {
+				t.Fatal(err)
+			}
+			keys := []*DkimKey{
+				{Selector: "r", signer: rk, algorithm: RsaSha256DkimAlgorithm, mutex: new(sync.RWMutex)},
+				{Selector: "e", signer: ek, algorithm: Ed25519Sha256DkimAlgorithm, mutex: new(sync.RWMutex)},
+			}
+			out, err := d.sign("football.example.com", "DKIM-Signature: v=1; old\r\n"+rfcMessage, keys, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.verify("football.example.com", out, keys, now); err != nil {
+				t.Fatal(c, bl, err)
+			}
+			if err := d.verify("football.example.com", strings.Replace(out, "We lost", "We won", 1), keys, now); err == nil {
+				t.Fatal("tampered body verified")
+			}
+			if err := d.verify("football.example.com", strings.Replace(out, "Subject: Is", "Subject: Was", 1), keys, now); err == nil {
+				t.Fatal("tampered header verified")
+			}
+			bad := []*DkimKey{{Selector: "r", signer: rk, algorithm: RsaSha256DkimAlgorithm, verifier: other.Public(), mutex: new(sync.RWMutex)}, keys[1]}
+			if err := d.verify("football.example.com", out, bad, now); err == nil {
+				t.Fatal("wrong public key verified")
+			}
+		}
+	}
+
+	// подпись ключом, запись которого не опубликована или не совпадает, не проходит проверку
+	d := &DkimConfig{}
+	d.init()
+	unpublished := []*DkimKey{{Selector: "u", signer: rk, algorithm: RsaSha256DkimAlgorithm, mutex: new(sync.RWMutex)}}
+	out, _ := d.sign("football.example.com", rfcMessage, unpublished, now)
+	if err, ok := d.verify("football.example.com", out, unpublished, now).(*dkimLookupError); !ok {
+		t.Fatal("unpublished key isn't reported as lookup error", err)
+	}
+	published["u"] = other.Public()
+	if err := d.verify("football.example.com", out, unpublished, now); err == nil {
+		t.Fatal("mismatched dns key verified")
+	} else if _, ok := err.(*dkimLookupError); ok {
+		t.Fatal("mismatched dns key is reported as lookup error", err)
+	}
+	// несовпадение одной подписи важнее недоступного ключа другой
+	both := []*DkimKey{{Selector: "n", signer: rk, algorithm: RsaSha256DkimAlgorithm, mutex: new(sync.RWMutex)}, unpublished[0]}
+	out, _ = d.sign("football.example.com", rfcMessage, both, now)
+	if err := d.verify("football.example.com", out, both, now); err == nil {
+		t.Fatal("mismatched dns key verified")
+	} else if _, ok := err.(*dkimLookupError); ok {
+		t.Fatal("mismatched dns key is reported as lookup error", err)
+	}
+
+	// ключ из DNS кешируется
+	cached := []*DkimKey{{Selector: "r", signer: rk, algorithm: RsaSha256DkimAlgorithm, mutex: new(sync.RWMutex)}}
+	out, _ = d.sign("football.example.com", rfcMessage, cached, now)
+	lookups = 0
+	for i := 0; i < 3; i++ {
+		if err := d.verify("football.example.com", out, cached, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.verify("football.example.com", out, cached, now.Add(dkimPublicKeyTimeout)); err != nil || lookups != 2 {
+		t.Fatal("cache", lookups, err)
+	}
+}
+
+func TestPrepareKeepsSignatureOnLookupError(t *testing.T) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var published crypto.PublicKey
+	dkimPublicKeyLookup = func(domain, selector string) (crypto.PublicKey, error) {
+		if published == nil {
+			return nil, errors.New("i/o timeout")
+		}
+		return published, nil
+	}
+	defer func() { dkimPublicKeyLookup = lookupDkimPublicKey }()
+	d := &DkimConfig{Keys: []*DkimKey{{Selector: "r", signer: rk, algorithm: RsaSha256DkimAlgorithm, mutex: new(sync.RWMutex)}}}
+	d.init()
+	service = &Service{Configs: map[string]*Config{"football.example.com": {Dkim: d}}}
+	defer func() { service = nil }()
+	message := &common.MailMessage{HostnameFrom: "football.example.com", Body: rfcMessage}
+	m := &Mailer{id: 1}
+
+	// DNS не ответил, письмо отправляется подписанным
+	body, err := m.prepare(message)
+	if err != nil || !strings.HasPrefix(body, "DKIM-Signature:") {
+		t.Fatal("signature is dropped on lookup error", err)
+	}
+
+	// подпись не совпала с опубликованным ключом, письмо отправляется без подписи
+	published = other.Public()
+	body, err = m.prepare(message)
+	if err == nil || body != rfcMessage {
+		t.Fatal("mismatched signature is sent", err)
+	}
+}
+
+func TestArc(t *testing.T) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	lookup := func(d, s string) (crypto.PublicKey, error) { return rk.Public(), nil }
+	d := &DkimConfig{}
+	d.init()
+	key := &DkimKey{Selector: "r", signer: rk, algorithm: RsaSha256DkimAlgorithm}
+	msg, _ := d.sign("a.example", rfcMessage, []*DkimKey{key}, time.Now())
+	h, b := splitMessage(msg)
+	st, err := validateArcChain(h, b, lookup)
+	if st != NoneArcChainStatus || err != nil {
+		t.Fatal(st, err)
+	}
+	msg, err = d.seal("a.example", msg, key, st, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ = d.sign("b.example", msg, []*DkimKey{key}, time.Now())
+	h, b = splitMessage(msg)
+	st, err = validateArcChain(h, b, lookup)
+	if st != PassArcChainStatus {
+		t.Fatal(st, err)
+	}
+	msg, err = d.seal("b.example", msg, key, st, nil, time.Now())
+	h, b = splitMessage(msg)
+	st, err = validateArcChain(h, b, lookup)
+	if st != PassArcChainStatus || strings.Count(msg, "ARC-Seal: i=2") != 1 {
+		t.Fatal(st, err, msg)
+	}
+	h, b = splitMessage(strings.Replace(msg, "We lost", "We won", 1))
+	if st, _ = validateArcChain(h, b, lookup); st != FailArcChainStatus {
+		t.Fatal(st)
+	}
+	bad, _ := d.seal("c.example", strings.Replace(msg, "We lost", "We won", 1), key, FailArcChainStatus, nil, time.Now())
+	h, b = splitMessage(bad)
+	if st, _ = validateArcChain(h, b, lookup); st != FailArcChainStatus {
+		t.Fatal(st)
+	}
+	if _, err = d.seal("c.example", bad, key, FailArcChainStatus, nil, time.Now()); err == nil {
+		t.Fatal("sealed failed chain")
+	}
+}
+
+func TestAuthenticateMessage(t *testing.T) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	lookup := func(d, s string) (crypto.PublicKey, error) {
+		if s == "r" {
+			return rk.Public(), nil
+		}
+		return other.Public(), nil
+	}
+	records := map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}}
+	lookupTxt := func(name string) ([]string, error) {
+		if record, ok := records[name]; ok {
+			return record, nil
+		}
+		return nil, fmt.Errorf("%s is not found", name)
+	}
+	d := &DkimConfig{}
+	d.init()
+	message := strings.Replace(rfcMessage, "joe@football.example.com", "joe@news.example.com", 1)
+	keys := []*DkimKey{{Selector: "r", signer: rk, algorithm: RsaSha256DkimAlgorithm}, {Selector: "o", signer: rk, algorithm: RsaSha256DkimAlgorithm}}
+	signed, _ := d.sign("example.com", message, keys, time.Now())
+	h, b := splitMessage(signed)
+	results := strings.Join(authenticateMessage("bounce@news.example.com", h, b, lookup, lookupTxt), "; ")
+	if results != "dkim=pass header.d=example.com header.s=r; dkim=fail header.d=example.com header.s=o; spf=none smtp.mailfrom=bounce@news.example.com; dmarc=pass header.from=news.example.com" {
+		t.Fatal(results)
+	}
+	signed, _ = d.sign("other.example", message, keys[:1], time.Now())
+	h, b = splitMessage(signed)
+	if results = strings.Join(authenticateMessage("bounce@news.example.com", h, b, lookup, lookupTxt), "; "); results != "dkim=pass header.d=other.example header.s=r; spf=none smtp.mailfrom=bounce@news.example.com" {
+		t.Fatal(results)
+	}
+	h, b = splitMessage(message)
+	if results = strings.Join(authenticateMessage("", h, b, lookup, lookupTxt), "; "); results != "dkim=none; spf=none" {
+		t.Fatal(results)
+	}
+
+	sealed, err := d.seal("forwarder.example", signed, keys[0], NoneArcChainStatus, []string{"dkim=pass header.d=other.example header.s=r", "spf=none smtp.mailfrom=a@other.example"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, b = splitMessage(sealed)
+	results = findHeaders(h, arcAuthenticationResultsHeader)[0]
+	if !strings.Contains(results, "dkim=pass header.d=other.example header.s=r;") || !strings.Contains(results, "spf=none smtp.mailfrom=a@other.example;") || !strings.Contains(results, "arc=none") {
+		t.Fatal(results)
+	}
+	if st, err := validateArcChain(h, b, lookup); st != PassArcChainStatus {
+		t.Fatal(st, err)
+	}
+}
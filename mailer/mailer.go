@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"github.com/actionpay/postmanq/common"
 	"github.com/actionpay/postmanq/logger"
-	"github.com/byorty/dkim"
+	"io"
+	"net"
+	"net/textproto"
+	"time"
 )
 
 // отправитель письма
@@ -30,39 +33,110 @@ func (m *Mailer) run() {
 // подписывает dkim и отправляет письмо
 func (m *Mailer) sendMail(event *common.SendEvent) {
 	message := event.Message
-	if common.EmailRegexp.MatchString(message.Envelope) && common.EmailRegexp.MatchString(message.Recipient) {
-		m.prepare(message)
-		m.send(event)
+	// адреса уже проверены получателем из очереди, но адрес с не ASCII символами можно отправить только с SMTPUTF8
+	if ok, _ := event.Client.Worker.Extension("SMTPUTF8"); message.SmtpUtf8 && !ok {
+		m.releaseClient(event)
+		common.ReturnMail(event, errors.New(fmt.Sprintf("553 5.6.7 service#%d can't send mail#%d, server doesn't support SMTPUTF8", m.id, message.Id)))
+		return
+	}
+	envelope, err := service.getEnvelope(message)
+	if err != nil {
+		logger.By(message.HostnameFrom).Warn("mailer#%d-%d can't encode verp address, error - %v", m.id, message.Id, err)
+		envelope = message.Envelope
+	}
+	var status ArcChainStatus
+	var results []string
+	if event.Forwarding {
+		// пересылаемое письмо не меняется, иначе сломаются подписи и цепочка ARC, с которыми оно получено
+		status, results = m.authenticate(message)
+	} else if err := service.getPreprocess(message.HostnameFrom).prepare(message, envelope, time.Now()); err != nil {
+		logger.By(message.HostnameFrom).Err("mailer#%d-%d can't prepare mail, error - %v", m.id, message.Id, err)
+		m.releaseClient(event)
+		if _, ok := err.(*longHeaderError); ok {
+			// письмо не изменится при повторной отправке, поэтому ошибка постоянная
+			common.FailMail(event, 554, fmt.Sprintf("554 5.6.0 mailer#%d can't prepare mail#%d, %v", m.id, message.Id, err))
+		} else {
+			common.ReturnMail(event, errors.New(fmt.Sprintf("451 4.3.0 mailer#%d can't prepare mail#%d, %v", m.id, message.Id, err)))
+		}
+		return
+	}
+	body, err := m.prepare(message)
+	if err == nil && event.Forwarding {
+		body = m.seal(message, body, status, results)
+	}
+	if err == nil || !service.isDkimRequired(message.HostnameFrom) {
+		m.send(event, envelope, body)
 	} else {
-		common.ReturnMail(event, errors.New(fmt.Sprintf("511 service#%d can't send mail#%d, envelope or ricipient is invalid", m.id, message.Id)))
+		// письмо без подписи будет отклонено доменами с DMARC p=reject, поэтому не отправляем его
+		logger.By(message.HostnameFrom).Err("mailer#%d-%d dkim is required, mail isn't sent", m.id, message.Id)
+		m.releaseClient(event)
+		common.FailMail(event, 554, fmt.Sprintf("554 5.7.0 mailer#%d can't sign mail#%d, %v", m.id, message.Id, err))
 	}
 }
 
-// подписывает dkim
-func (m *Mailer) prepare(message *common.MailMessage) {
-	conf, err := dkim.NewConf(message.HostnameFrom, service.getDkimSelector(message.HostnameFrom))
+// подписывает dkim, проверяет подпись и возвращает подписанное письмо
+// само письмо не меняется, т.к. при переключении на другой сервер письмо подписывается заново
+// если письмо не удалось подписать или подпись не совпала с ключом, возвращается письмо без подписи и ошибка
+func (m *Mailer) prepare(message *common.MailMessage) (string, error) {
+	dkim := service.getDkim(message.HostnameFrom)
+	if dkim == nil {
+		return message.Body, errors.New("dkim config is not found")
+	}
+	now := time.Now()
+	keys := dkim.activeKeys(now)
+	if len(keys) == 0 {
+		logger.By(message.HostnameFrom).Warn("mailer#%d-%d has no active dkim keys, mail isn't signed", m.id, message.Id)
+		return message.Body, errors.New("no active dkim keys")
+	}
+	signed, err := dkim.sign(message.HostnameFrom, message.Body, keys, now)
 	if err == nil {
-		conf[dkim.AUIDKey] = message.Envelope
-		conf[dkim.CanonicalizationKey] = "relaxed/relaxed"
-		signer := dkim.NewByKey(conf, service.getPrivateKey(message.HostnameFrom))
-		if err == nil {
-			signed, err := signer.Sign([]byte(message.Body))
-			if err == nil {
-				message.Body = string(signed)
-				logger.By(message.HostnameFrom).Debug("mailer#%d-%d success sign mail", m.id, message.Id)
-			} else {
-				logger.By(message.HostnameFrom).Warn("mailer#%d-%d can't sign mail, error - %v", m.id, message.Id, err)
-			}
-		} else {
-			logger.By(message.HostnameFrom).Warn("mailer#%d-%d can't create dkim signer, error - %v", m.id, message.Id, err)
-		}
+		// проверяем подпись до отправки, чтобы не отправлять письмо с подписью, которую не примет почтовый сервис
+		err = dkim.verify(message.HostnameFrom, signed, keys, now)
+	}
+	if err == nil {
+		logger.By(message.HostnameFrom).Debug("mailer#%d-%d success sign mail", m.id, message.Id)
+		return signed, nil
+	} else if _, ok := err.(*dkimLookupError); ok {
+		// DNS не ответил, подпись могла быть верной, поэтому письмо отправляется подписанным, как и без проверки
+		logger.By(message.HostnameFrom).Warn("mailer#%d-%d sign mail, but can't verify signature, error - %v", m.id, message.Id, err)
+		return signed, nil
 	} else {
-		logger.By(message.HostnameFrom).Warn("mailer#%d-%d can't create dkim config, error - %v", m.id, message.Id, err)
+		logger.By(message.HostnameFrom).Warn("mailer#%d-%d can't sign mail, error - %v", m.id, message.Id, err)
+		return message.Body, err
 	}
 }
 
+// проверяет цепочку ARC и подписи dkim пересылаемого письма в том виде, в котором оно получено
+func (m *Mailer) authenticate(message *common.MailMessage) (ArcChainStatus, []string) {
+	headers, body := splitMessage(toCRLF(message.Body))
+	status, err := validateArcChain(headers, body, lookupDkimPublicKey)
+	if err != nil {
+		logger.By(message.HostnameFrom).Warn("mailer#%d-%d arc chain is invalid, error - %v", m.id, message.Id, err)
+	}
+	return status, authenticateMessage(message.Envelope, headers, body, lookupDkimPublicKey, net.LookupTXT)
+}
+
+// добавляет печать к цепочке ARC пересылаемого письма
+// если письмо не удалось запечатать, письмо отправляется только с подписью dkim
+func (m *Mailer) seal(message *common.MailMessage, body string, status ArcChainStatus, results []string) string {
+	dkim := service.getDkim(message.HostnameFrom)
+	now := time.Now()
+	key := arcKey(dkim.activeKeys(now))
+	if key == nil {
+		logger.By(message.HostnameFrom).Warn("mailer#%d-%d has no active rsa dkim key, mail isn't sealed", m.id, message.Id)
+		return body
+	}
+	sealed, err := dkim.seal(message.HostnameFrom, body, key, status, results, now)
+	if err == nil {
+		logger.By(message.HostnameFrom).Debug("mailer#%d-%d success seal mail, arc chain status %s", m.id, message.Id, status)
+	} else {
+		logger.By(message.HostnameFrom).Warn("mailer#%d-%d can't seal mail, error - %v", m.id, message.Id, err)
+	}
+	return sealed
+}
+
 // отправляет письмо
-func (m *Mailer) send(event *common.SendEvent) {
+func (m *Mailer) send(event *common.SendEvent, envelope, body string) {
 	message := event.Message
 	worker := event.Client.Worker
 	logger.By(event.Message.HostnameFrom).Info("mailer#%d-%d begin sending mail", m.id, message.Id)
@@ -70,42 +144,82 @@ func (m *Mailer) send(event *common.SendEvent) {
 
 	success := false
 	event.Client.SetTimeout(common.App.Timeout().Mail)
-	err := worker.Mail(message.Envelope)
+	err := worker.Mail(envelope)
 	if err == nil {
-		logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command MAIL FROM: %s", m.id, message.Id, message.Envelope)
+		logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command MAIL FROM: %s", m.id, message.Id, envelope)
 		event.Client.SetTimeout(common.App.Timeout().Rcpt)
 		err = worker.Rcpt(message.Recipient)
 		if err == nil {
 			logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command RCPT TO: %s", m.id, message.Id, message.Recipient)
 			event.Client.SetTimeout(common.App.Timeout().Data)
-			wc, err := worker.Data()
+			var wc io.WriteCloser
+			wc, err = worker.Data()
 			if err == nil {
 				logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command DATA", m.id, message.Id)
-				_, err = fmt.Fprint(wc, message.Body)
+				_, err = fmt.Fprint(wc, body)
 				if err == nil {
-					wc.Close()
-					logger.By(message.HostnameFrom).Debug("%s", message.Body)
-					logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command .", m.id, message.Id)
-					// стараемся слать письма через уже созданное соединение,
-					// поэтому после отправки письма не закрываем соединение
-					err = worker.Reset()
+					// почтовый сервис отвечает на окончание письма, поэтому ответ необходимо проверить
+					err = wc.Close()
 					if err == nil {
-						logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command RSET", m.id, message.Id)
-						logger.By(event.Message.HostnameFrom).Info("mailer#%d-%d success send mail#%d", m.id, message.Id, message.Id)
-						success = true
+						logger.By(message.HostnameFrom).Debug("%s", body)
+						logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command .", m.id, message.Id)
+						// стараемся слать письма через уже созданное соединение,
+						// поэтому после отправки письма не закрываем соединение
+						err = worker.Reset()
+						if err == nil {
+							logger.By(message.HostnameFrom).Debug("mailer#%d-%d send command RSET", m.id, message.Id)
+							logger.By(event.Message.HostnameFrom).Info("mailer#%d-%d success send mail#%d", m.id, message.Id, message.Id)
+							success = true
+						}
 					}
 				}
 			}
 		}
 	}
 
-	event.Client.Wait()
-	event.Queue.Push(event.Client)
+	if event.Feedback != nil {
+		event.Feedback.Respond(event, err)
+	}
 
 	if success {
+		m.releaseClient(event)
+		if event.Failover != nil {
+			event.Failover.Success()
+		}
+		if event.Feedback != nil {
+			event.Feedback.Release()
+		}
 		// отпускаем поток получателя сообщений из очереди
 		event.Result <- common.SuccessSendEventResult
+		return
+	}
+
+	protoErr, isProtoErr := err.(*textproto.Error)
+	if isProtoErr && protoErr.Code != 421 {
+		// сбрасываем цепочку команд к почтовому сервису
+		// до возврата клиента в очередь, иначе клиента может получить другой соединитель
+		worker.Reset()
 	} else {
+		// соединение разорвано или почтовый сервис закрывает соединение, клиента придется переоткрыть
+		event.Client.Close()
+	}
+	m.releaseClient(event)
+
+	if isProtoErr && protoErr.Code >= 500 {
+		// почтовый сервис отклонил письмо, но сам сервер исправен
+		if event.Failover != nil {
+			event.Failover.Success()
+		}
+		common.ReturnMail(event, err)
+	} else if event.Failover == nil || !event.Failover.Failure(err) {
+		// если сервер временно не смог принять письмо, письмо отправится через другой сервер почтового сервиса,
+		// после передачи событие принадлежит соединителю, поэтому больше его не трогаем
 		common.ReturnMail(event, err)
 	}
 }
+
+// возвращает клиента в очередь, после этого клиент может быть получен другим соединителем
+func (m *Mailer) releaseClient(event *common.SendEvent) {
+	event.Client.Wait()
+	event.Queue.Push(event.Client)
+}
@@ -0,0 +1,143 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/actionpay/postmanq/common"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// максимальная длина строки письма без CRLF, RFC 5322 2.1.1
+const maxLineLen = 998
+
+// настройки подготовки письма перед подписью dkim
+type PreprocessConfig struct {
+	// добавлять Message-ID, если его нет в письме
+	MessageId bool `yaml:"messageId"`
+
+	// добавлять Date, если его нет в письме
+	Date bool `yaml:"date"`
+
+	// добавлять Return-Path с адресом отправителя из конверта, с адресом VERP, если он настроен
+	// обычно Return-Path добавляет сервер, доставляющий письмо в ящик получателя, RFC 5321 4.4, поэтому по умолчанию заголовок не добавляется
+	ReturnPath bool `yaml:"returnPath"`
+
+	// добавлять List-Unsubscribe и List-Unsubscribe-Post из ссылок для отписки письма
+	ListUnsubscribe bool `yaml:"listUnsubscribe"`
+
+	// идентификатор отправителя, последняя часть заголовка Feedback-ID
+	FeedbackSenderId string `yaml:"feedbackId"`
+}
+
+// готовит письмо к подписи: приводит переводы строк к CRLF, переносит длинные строки и добавляет недостающие заголовки
+// добавленные заголовки сохраняются в письме, поэтому при повторной отправке Message-ID и Date не меняются
+// если не удалось создать Message-ID или заголовок длиннее 998 символов нельзя перенести, письмо не меняется
+func (p *PreprocessConfig) prepare(message *common.MailMessage, envelope string, now time.Time) error {
+	headers, body := splitMessage(toCRLF(message.Body))
+	added := make([]string, 0)
+	if p != nil {
+		if p.ReturnPath && len(findHeaders(headers, "Return-Path")) == 0 {
+			added = append(added, fmt.Sprintf("Return-Path: <%s>", envelope))
+		}
+		if p.MessageId && len(findHeaders(headers, "Message-ID")) == 0 {
+			messageId, err := newMessageId(message, now)
+			if err != nil {
+				return err
+			}
+			added = append(added, fmt.Sprintf("Message-ID: <%s@%s>", messageId, message.HostnameFrom))
+		}
+		if p.Date && len(findHeaders(headers, "Date")) == 0 {
+			added = append(added, fmt.Sprintf("Date: %s", now.Format(time.RFC1123Z)))
+		}
+		if p.ListUnsubscribe && len(message.Unsubscribe) > 0 && len(findHeaders(headers, "List-Unsubscribe")) == 0 {
+			links := make([]string, len(message.Unsubscribe))
+			oneClick := false
+			for i, link := range message.Unsubscribe {
+				links[i] = fmt.Sprintf("<%s>", link)
+				oneClick = oneClick || strings.HasPrefix(strings.ToLower(link), "https:")
+			}
+			added = append(added, fmt.Sprintf("List-Unsubscribe: %s", strings.Join(links, ", ")))
+			// отписка в один клик возможна только по https ссылке, RFC 8058 3.1
+			if oneClick && len(findHeaders(headers, "List-Unsubscribe-Post")) == 0 {
+				added = append(added, "List-Unsubscribe-Post: List-Unsubscribe=One-Click")
+			}
+		}
+		feedbackId := make([]string, 0, 2)
+		for _, part := range []string{message.FeedbackId, p.FeedbackSenderId} {
+			if len(part) > 0 {
+				feedbackId = append(feedbackId, part)
+			}
+		}
+		if len(feedbackId) > 0 && len(findHeaders(headers, "Feedback-ID")) == 0 {
+			added = append(added, fmt.Sprintf("Feedback-ID: %s", strings.Join(feedbackId, ":")))
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	for i, header := range added {
+		added[i] = header + "\r\n"
+	}
+	for _, header := range append(added, headers...) {
+		folded := common.FoldHeader(header, maxLineLen)
+		for _, line := range strings.Split(folded, "\r\n") {
+			if len(line) > maxLineLen {
+				return &longHeaderError{name: strings.TrimSpace(strings.SplitN(header, ":", 2)[0])}
+			}
+		}
+		buf.WriteString(folded)
+	}
+	buf.WriteString("\r\n")
+	for i, line := range strings.Split(body, "\r\n") {
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(wrapLine(line))
+	}
+	message.Body = buf.String()
+	return nil
+}
+
+// заголовок длиннее 998 символов, в котором нет пробелов для переноса
+// такой заголовок нельзя отправить, не нарушив RFC 5322 2.1.1, а кодировать его по RFC 2047 можно только в неструктурированных заголовках,
+// поэтому письмо не отправляется
+type longHeaderError struct {
+	name string
+}
+
+func (e *longHeaderError) Error() string {
+	return fmt.Sprintf("header %s is longer than %d characters and can't be folded", e.name, maxLineLen)
+}
+
+// создает уникальную левую часть Message-ID
+func newMessageId(message *common.MailMessage, now time.Time) (string, error) {
+	random := make([]byte, 8)
+	_, err := rand.Read(random)
+	if err != nil {
+		return common.EmptyStr, fmt.Errorf("can't create message id, error - %v", err)
+	}
+	return fmt.Sprintf("%s.%s.%s", strconv.FormatInt(now.UnixNano(), 36), strconv.FormatInt(message.Id, 36), hex.EncodeToString(random)), nil
+}
+
+// переносит строку тела длиннее 998 символов, по возможности по пробелу
+func wrapLine(line string) string {
+	wrapped := make([]string, 0, 1)
+	for len(line) > maxLineLen {
+		end := strings.LastIndex(line[:maxLineLen], " ") + 1
+		if end <= 0 {
+			// пробела нет, переносим по границе символа
+			end = maxLineLen
+			for end > 0 && !utf8.RuneStart(line[end]) {
+				end--
+			}
+		}
+		wrapped = append(wrapped, line[:end])
+		line = line[end:]
+	}
+	wrapped = append(wrapped, line)
+	return strings.Join(wrapped, "\r\n")
+}
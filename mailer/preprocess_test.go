@@ -0,0 +1,65 @@
+package mailer
+
+import (
+	"github.com/actionpay/postmanq/common"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreprocess(t *testing.T) {
+	p := &PreprocessConfig{MessageId: true, Date: true, ReturnPath: true, ListUnsubscribe: true, FeedbackSenderId: "pmq"}
+	long := strings.Repeat("word ", 300)
+	m := &common.MailMessage{Id: 1, Envelope: "a@b.example", HostnameFrom: "b.example", Unsubscribe: []string{"https://x/u", "mailto:u@x"}, FeedbackId: "c1:cust",
+		Body: "Subject: " + long + "\nX-Long: " + strings.Repeat("x ", 600) + "\n\n" + strings.Repeat("я", 700) + "\n" + long + "\nend\n"}
+	if err := p.prepare(m, "bounces+1@b.example", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	first := m.Body
+	p.prepare(m, "bounces+1@b.example", time.Now())
+	if first != m.Body {
+		t.Fatal("not idempotent")
+	}
+	for _, h := range []string{"Message-ID: <", "Date: ", "List-Unsubscribe: <https://x/u>, <mailto:u@x>\r\n", "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n", "Feedback-ID: c1:cust:pmq\r\n"} {
+		if !strings.Contains(m.Body, h) {
+			t.Fatal(h, m.Body)
+		}
+	}
+	if !strings.HasPrefix(m.Body, "Return-Path: <bounces+1@b.example>\r\n") || strings.Count(m.Body, "Return-Path:") != 1 {
+		t.Fatal("return path", m.Body[:100])
+	}
+	if strings.Contains(strings.Replace(m.Body, "\r\n", "", -1), "\n") {
+		t.Fatal("bare lf")
+	}
+	for _, line := range strings.Split(m.Body, "\r\n") {
+		if len(line) > 998 {
+			t.Fatal(len(line), line[:20])
+		}
+	}
+	if !strings.HasSuffix(m.Body, "end\r\n") {
+		t.Fatal("tail")
+	}
+	var nilp *PreprocessConfig
+	m2 := &common.MailMessage{Body: "A: b\n\nc\n"}
+	nilp.prepare(m2, "a@b.example", time.Now())
+	if m2.Body != "A: b\r\n\r\nc\r\n" {
+		t.Fatalf("%q", m2.Body)
+	}
+}
+
+// заголовок без пробелов длиннее 998 символов нельзя перенести, письмо не меняется
+func TestPreprocessLongHeader(t *testing.T) {
+	body := "Subject: hi\nX-Long: " + strings.Repeat("x", 1200) + "\n\nbody\n"
+	m := &common.MailMessage{Body: body}
+	err := (&PreprocessConfig{Date: true}).prepare(m, "a@b.example", time.Now())
+	if e, ok := err.(*longHeaderError); !ok || e.name != "X-Long" {
+		t.Fatal(err)
+	}
+	if m.Body != body {
+		t.Fatal("mail is changed")
+	}
+	var nilp *PreprocessConfig
+	if err := nilp.prepare(m, "a@b.example", time.Now()); err == nil {
+		t.Fatal("long header without preprocess config")
+	}
+}
@@ -0,0 +1,290 @@
+package mailer
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/actionpay/postmanq/common"
+	"github.com/actionpay/postmanq/logger"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// как часто проверяются DNS записи ключей dkim
+const dkimVerifyInterval = 10 * time.Minute
+
+// получает TXT записи селектора, подменяется в тестах
+var dkimTxtLookup = net.LookupTXT
+
+// состояние ключа dkim
+type DkimKeyStatus string
+
+const (
+	// ключ подписывает письма
+	ActiveDkimKeyStatus DkimKeyStatus = "active"
+
+	// время действия ключа еще не наступило
+	ScheduledDkimKeyStatus DkimKeyStatus = "scheduled"
+
+	// время действия ключа прошло
+	ExpiredDkimKeyStatus DkimKeyStatus = "expired"
+
+	// время действия ключа наступило, но его DNS запись еще не опубликована или не совпадает с ключом
+	UnpublishedDkimKeyStatus DkimKeyStatus = "unpublished"
+)
+
+// возвращает состояние ключа на указанное время
+func (d *DkimKey) status(now time.Time, verifyDns bool) DkimKeyStatus {
+	if !d.ActiveFrom.IsZero() && now.Before(d.ActiveFrom) {
+		return ScheduledDkimKeyStatus
+	} else if !d.ActiveTo.IsZero() && !now.Before(d.ActiveTo) {
+		return ExpiredDkimKeyStatus
+	} else if verifyDns && !d.isPublished() {
+		return UnpublishedDkimKeyStatus
+	} else {
+		return ActiveDkimKeyStatus
+	}
+}
+
+// проверяет, что DNS запись ключа совпадает с ключом
+func (d *DkimKey) isPublished() bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.published
+}
+
+// возвращает тип ключа и публичный ключ в том виде, в котором они указываются в DNS записи
+func (d *DkimKey) publicKey() (string, string, error) {
+	return dkimPublicKey(d.signer.Public())
+}
+
+// возвращает тип ключа и публичный ключ для DNS записи, RFC 6376 3.6.1 и RFC 8463 4
+func dkimPublicKey(key interface{}) (string, string, error) {
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(publicKey)
+		return "rsa", base64.StdEncoding.EncodeToString(der), err
+	case ed25519.PublicKey:
+		return "ed25519", base64.StdEncoding.EncodeToString(publicKey), nil
+	default:
+		return common.EmptyStr, common.EmptyStr, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// возвращает значение DNS записи ключа
+func dkimTxtRecord(keyType, publicKey string) string {
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", keyType, publicKey)
+}
+
+// проверяет через DNS, что опубликованная запись ключа совпадает с ключом
+func (d *DkimKey) verifyDns(domain string) error {
+	keyType, publicKey, err := d.publicKey()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s._domainkey.%s", d.Selector, domain)
+	records, err := dkimTxtLookup(name)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		tags := parseDkimTags(record)
+		recordType, ok := tags["k"]
+		if !ok {
+			// по умолчанию ключ RSA, RFC 6376 3.6.1
+			recordType = "rsa"
+		}
+		if recordType == keyType && tags["p"] == publicKey {
+			return nil
+		}
+	}
+	return fmt.Errorf("published record %s doesn't match key %s", name, d.PrivateKeyFilename)
+}
+
+// разбирает список тегов dkim вида tag=value; tag=value
+// пробелы внутри значений отбрасываются, т.к. длинные ключи в DNS часто разбивают на строки
+func parseDkimTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(value, ";") {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) == 2 {
+			tags[strings.TrimSpace(pair[0])] = strings.Join(strings.Fields(pair[1]), common.EmptyStr)
+		}
+	}
+	return tags
+}
+
+// проверяет DNS записи ключей, время действия которых еще не прошло
+func (d *DkimConfig) verifyKeys(domain string, now time.Time) {
+	for _, key := range d.Keys {
+		if key.status(now, false) == ExpiredDkimKeyStatus {
+			continue
+		}
+		err := key.verifyDns(domain)
+		key.mutex.Lock()
+		changed := key.published != (err == nil)
+		key.published = err == nil
+		key.mutex.Unlock()
+		if changed && err == nil {
+			logger.By(domain).Info("mailer service dkim key with selector %s is published", key.Selector)
+		} else if err != nil {
+			logger.By(domain).Warn("mailer service dkim key with selector %s is not published, error - %v", key.Selector, err)
+		}
+	}
+}
+
+// возвращает ключи, которыми необходимо подписать письмо
+// во время смены ключа действуют оба ключа, и письмо подписывается обоими
+// если DNS запись нового ключа еще не совпадает с ключом, письмо подписывается предыдущим ключом того же алгоритма,
+// даже если его время действия прошло, чтобы смена ключа не оставила письма без подписи
+func (d *DkimConfig) activeKeys(now time.Time) []*DkimKey {
+	verifyDns := d.verifiesDns()
+	keys := make([]*DkimKey, 0, len(d.Keys))
+	signed := make(map[DkimAlgorithm]bool)
+	for _, key := range d.Keys {
+		if key.status(now, verifyDns) == ActiveDkimKeyStatus {
+			keys = append(keys, key)
+			signed[key.algorithm] = true
+		}
+	}
+	// ключи, которые ждут публикации DNS записи
+	unpublished := make(map[DkimAlgorithm]*DkimKey)
+	for _, key := range d.Keys {
+		if !signed[key.algorithm] && unpublished[key.algorithm] == nil && key.status(now, verifyDns) == UnpublishedDkimKeyStatus {
+			unpublished[key.algorithm] = key
+		}
+	}
+	fallbacks := make(map[DkimAlgorithm]*DkimKey)
+	for _, key := range d.Keys {
+		if unpublished[key.algorithm] == nil || key.status(now, verifyDns) != ExpiredDkimKeyStatus {
+			continue
+		}
+		// предыдущим считается ключ, время действия которого закончилось позже остальных
+		if fallback, ok := fallbacks[key.algorithm]; !ok || key.ActiveTo.After(fallback.ActiveTo) {
+			fallbacks[key.algorithm] = key
+		}
+	}
+	for algorithm, key := range unpublished {
+		// если предыдущего ключа нет, подписывать больше нечем,
+		// и письмо подписывается неопубликованным ключом, подпись все равно проверяется перед отправкой
+		if _, ok := fallbacks[algorithm]; !ok {
+			fallbacks[algorithm] = key
+		}
+	}
+	for _, key := range d.Keys {
+		if fallbacks[key.algorithm] == key {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// проверяет, что письма подписываются только ключами, DNS запись которых совпадает с ключом
+// проверка выключается только явно
+func (d *DkimConfig) verifiesDns() bool {
+	return d.VerifyDns == nil || *d.VerifyDns
+}
+
+// периодически проверяет DNS записи ключей отправителей
+func (s *Service) verifyDkim() {
+	for range time.Tick(dkimVerifyInterval) {
+		for hostname, conf := range s.Configs {
+			if conf.Dkim.verifiesDns() {
+				conf.Dkim.verifyKeys(hostname, time.Now())
+			}
+		}
+	}
+}
+
+// создает закрытый ключ и возвращает его вместе с PEM в PKCS#8
+func generateDkimKey(keyType string, bits int) (crypto.Signer, []byte, error) {
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case "rsa":
+		var rsaKey *rsa.PrivateKey
+		rsaKey, err = rsa.GenerateKey(rand.Reader, bits)
+		key = rsaKey
+	case "ed25519":
+		var ed25519Key ed25519.PrivateKey
+		_, ed25519Key, err = ed25519.GenerateKey(rand.Reader)
+		key = ed25519Key
+	default:
+		err = fmt.Errorf("unsupported key type %s", keyType)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// создает ключ dkim, сохраняет его в файл и печатает DNS запись
+func (s *Service) generateDkimKey(event *common.ApplicationEvent) error {
+	filename := event.GetStringArg("output")
+	if len(filename) == 0 {
+		return fmt.Errorf("output file should be defined")
+	}
+	if _, err := ioutil.ReadFile(filename); err == nil {
+		return fmt.Errorf("file %s already exists", filename)
+	}
+	key, data, err := generateDkimKey(event.GetStringArg("type"), event.GetIntArg("bits"))
+	if err != nil {
+		return err
+	}
+	keyType, publicKey, err := dkimPublicKey(key.Public())
+	if err == nil {
+		err = ioutil.WriteFile(filename, data, 0600)
+	}
+	if err == nil {
+		fmt.Printf("private key is written to %s\n", filename)
+		fmt.Println("publish DNS record:")
+		fmt.Printf("%s._domainkey.%s. IN TXT \"%s\"\n", event.GetStringArg("selector"), event.GetStringArg("domain"), dkimTxtRecord(keyType, publicKey))
+	}
+	return err
+}
+
+// печатает состояние ключей отправителей и проверяет их DNS записи
+func (s *Service) checkDkimKeys(event *common.ApplicationEvent) {
+	domain := event.GetStringArg("domain")
+	now := time.Now()
+	for hostname, conf := range s.Configs {
+		if len(domain) > 0 && domain != hostname {
+			continue
+		}
+		for _, key := range conf.Dkim.Keys {
+			published := "published"
+			if err := key.verifyDns(hostname); err != nil {
+				published = err.Error()
+			}
+			fmt.Printf(
+				"%s\t%s\t%s\t%s - %s\t%s\t%s\n",
+				hostname,
+				key.Selector,
+				key.algorithm,
+				formatDkimDate(key.ActiveFrom),
+				formatDkimDate(key.ActiveTo),
+				key.status(now, false),
+				published,
+			)
+		}
+	}
+}
+
+// форматирует границу времени действия ключа
+func formatDkimDate(date time.Time) string {
+	if date.IsZero() {
+		return "*"
+	}
+	return date.Format(time.RFC3339)
+}
@@ -0,0 +1,86 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotationWindow(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	d := &DkimConfig{Keys: []*DkimKey{
+		{Selector: "old", ActiveTo: to, signer: oldKey, algorithm: RsaSha256DkimAlgorithm, mutex: new(sync.RWMutex)},
+		{Selector: "new", ActiveFrom: from, signer: newKey, algorithm: RsaSha256DkimAlgorithm, mutex: new(sync.RWMutex)},
+	}}
+	records := make(map[string]string)
+	defer func() { dkimTxtLookup = net.LookupTXT }()
+	dkimTxtLookup = func(name string) ([]string, error) {
+		if record, ok := records[name]; ok {
+			return []string{record}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	publish := func(key *DkimKey, signer *rsa.PrivateKey) {
+		keyType, publicKey, _ := dkimPublicKey(signer.Public())
+		records[key.Selector+"._domainkey.example.com"] = dkimTxtRecord(keyType, publicKey)
+	}
+	selectors := func(now time.Time) string {
+		d.verifyKeys("example.com", now)
+		result := ""
+		for _, key := range d.activeKeys(now) {
+			result += key.Selector + ";"
+		}
+		return result
+	}
+
+	// старый ключ опубликован, новый ключ до начала действия не подписывает
+	publish(d.Keys[0], oldKey)
+	if got := selectors(from.Add(-time.Second)); got != "old;" {
+		t.Fatal("before window", got)
+	}
+	// новый ключ начал действовать, но его запись еще не опубликована
+	if got := selectors(from); got != "old;" {
+		t.Fatal("unpublished new key", got)
+	}
+	// время действия старого ключа прошло, но новый ключ не опубликован, письма подписываются старым
+	if got := selectors(to); got != "old;" {
+		t.Fatal("old key should stay active until new key is published", got)
+	}
+	// запись нового ключа опубликована с другим ключом
+	publish(d.Keys[1], oldKey)
+	if got := selectors(to); got != "old;" {
+		t.Fatal("mismatched record", got)
+	}
+	// запись совпала с ключом, в пересечении подписывают оба, после - только новый
+	publish(d.Keys[1], newKey)
+	if got := selectors(to.Add(-time.Second)); got != "old;new;" {
+		t.Fatal("overlap", got)
+	}
+	if got := selectors(to); got != "new;" {
+		t.Fatal("after window", got)
+	}
+
+	// проверка DNS выключена явно, новый ключ подписывает по времени действия
+	verifyDns := false
+	d.VerifyDns = &verifyDns
+	delete(records, "new._domainkey.example.com")
+	if got := selectors(from); got != "old;new;" {
+		t.Fatal("verifyDns: false", got)
+	}
+}
+
+// единственный ключ без опубликованной записи все равно подписывает письма, т.к. подписать больше нечем
+func TestRotationWithoutPreviousKey(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	d := &DkimConfig{Keys: []*DkimKey{{Selector: "s", signer: key, algorithm: RsaSha256DkimAlgorithm, mutex: new(sync.RWMutex)}}}
+	if keys := d.activeKeys(time.Now()); len(keys) != 1 {
+		t.Fatal(keys)
+	}
+}
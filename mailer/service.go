@@ -1,14 +1,12 @@
 package mailer
 
 import (
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"fmt"
 	"github.com/actionpay/postmanq/common"
 	"github.com/actionpay/postmanq/logger"
-	"github.com/byorty/dkim"
 	yaml "gopkg.in/yaml.v2"
-	"io/ioutil"
+	"strconv"
+	"time"
 )
 
 var (
@@ -41,12 +39,6 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 		for name, config := range s.Configs {
 			s.init(config, name)
 		}
-		// указываем заголовки для DKIM
-		dkim.StdSignableHeaders = []string{
-			"From",
-			"To",
-			"Subject",
-		}
 		if s.MailersCount == 0 {
 			s.MailersCount = common.DefaultWorkersCount
 		}
@@ -56,25 +48,32 @@ func (s *Service) OnInit(event *common.ApplicationEvent) {
 }
 
 func (s *Service) init(conf *Config, hostname string) {
-	// закрытый ключ должен быть указан обязательно
-	// поэтому даже не проверяем что указано в переменной
-	privateKey, err := ioutil.ReadFile(conf.PrivateKeyFilename)
-	if err == nil {
-		logger.By(hostname).Debug("mailer service private key %s read success", conf.PrivateKeyFilename)
-		der, _ := pem.Decode(privateKey)
-		conf.privateKey, err = x509.ParsePKCS1PrivateKey(der.Bytes)
-		if err != nil {
-			logger.By(hostname).Err("mailer service can't decode or parse private key %s", conf.PrivateKeyFilename)
+	if conf.Dkim == nil {
+		conf.Dkim = new(DkimConfig)
+	}
+	// если ключи dkim не указаны, письма подписываются закрытым ключом отправителя с селектором dkimSelector
+	if len(conf.Dkim.Keys) == 0 {
+		conf.Dkim.Keys = []*DkimKey{
+			&DkimKey{Selector: conf.DkimSelector, PrivateKeyFilename: conf.PrivateKeyFilename},
+		}
+	}
+	if conf.Verp != nil {
+		if err := conf.Verp.Init(hostname); err != nil {
 			logger.By(hostname).FailExitWithErr(err)
 		}
+	}
+	err := conf.Dkim.init()
+	if err == nil {
+		if conf.Dkim.verifiesDns() {
+			conf.Dkim.verifyKeys(hostname, time.Now())
+		}
+		for _, key := range conf.Dkim.Keys {
+			logger.By(hostname).Debug("mailer service dkim key %s with selector %s read success, algorithm %s", key.PrivateKeyFilename, key.Selector, key.algorithm)
+		}
 	} else {
-		logger.By(hostname).Err("mailer service can't read private key %s", conf.PrivateKeyFilename)
+		logger.By(hostname).Err("mailer service can't init dkim")
 		logger.By(hostname).FailExitWithErr(err)
 	}
-	// если не задан селектор, устанавливаем селектор по умолчанию
-	if len(conf.DkimSelector) == 0 {
-		conf.DkimSelector = "mail"
-	}
 }
 
 // запускает отправителей и прием сообщений из очереди
@@ -83,6 +82,7 @@ func (s *Service) OnRun() {
 	for i := 0; i < s.MailersCount; i++ {
 		go newMailer(i + 1)
 	}
+	go s.verifyDkim()
 }
 
 // канал для приема событий отправки писем
@@ -95,24 +95,64 @@ func (s *Service) OnFinish() {
 	close(events)
 }
 
-func (s *Service) getDkimSelector(hostname string) string {
+// создает ключи dkim и проверяет их DNS записи из консоли
+func (s *Service) OnDkim(event *common.ApplicationEvent) {
+	var err error
+	switch event.GetStringArg("action") {
+	case "generate":
+		err = s.generateDkimKey(event)
+	case "check":
+		s.checkDkimKeys(event)
+	default:
+		err = fmt.Errorf("unknown action %s", event.GetStringArg("action"))
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+	common.App.Events() <- common.NewApplicationEvent(common.FinishApplicationEventKind)
+}
+
+// проверяет, что письма отправителя необходимо отправлять только с подписью dkim
+func (s *Service) isDkimRequired(hostname string) bool {
 	if conf, ok := s.Configs[hostname]; ok {
-		return conf.DkimSelector
-	} else {
-		logger.By(hostname).Err("mailer service can't find dkim selector by %s", hostname)
-		return common.EmptyStr
+		return conf.DkimRequired
 	}
+	return false
 }
 
-func (s *Service) getPrivateKey(hostname string) *rsa.PrivateKey {
+// возвращает адрес, с которого отправляется письмо
+// если для отправителя настроен VERP, в адрес кодируются идентификатор письма и получатель
+func (s *Service) getEnvelope(message *common.MailMessage) (string, error) {
+	conf, ok := s.Configs[message.HostnameFrom]
+	if !ok || conf.Verp == nil {
+		return message.Envelope, nil
+	}
+	// идентификатор сохраняется в письме, поэтому при повторной отправке адрес не меняется
+	if len(message.Uid) == 0 {
+		message.Uid = strconv.FormatInt(message.Id, 36)
+	}
+	return conf.Verp.Encode(message.Uid, message.Recipient)
+}
+
+// возвращает настройки подготовки писем отправителя
+func (s *Service) getPreprocess(hostname string) *PreprocessConfig {
 	if conf, ok := s.Configs[hostname]; ok {
-		return conf.privateKey
+		return conf.Preprocess
+	}
+	return nil
+}
+
+// возвращает настройки dkim отправителя
+func (s *Service) getDkim(hostname string) *DkimConfig {
+	if conf, ok := s.Configs[hostname]; ok {
+		return conf.Dkim
 	} else {
-		logger.By(hostname).Err("mailer service can't find private key by %s", hostname)
+		logger.By(hostname).Err("mailer service can't find dkim config by %s", hostname)
 		return nil
 	}
 }
 
+// настройки отправителя
 type Config struct {
 	// путь до закрытого ключа
 	PrivateKeyFilename string `yaml:"privateKey"`
@@ -120,6 +160,15 @@ type Config struct {
 	// селектор
 	DkimSelector string `yaml:"dkimSelector"`
 
-	// содержимое приватного ключа
-	privateKey *rsa.PrivateKey
+	// настройки dkim, необязательный параметр
+	Dkim *DkimConfig `yaml:"dkim"`
+
+	// не отправлять письма, которые не удалось подписать
+	DkimRequired bool `yaml:"dkimRequired"`
+
+	// настройки подготовки письма, необязательный параметр
+	Preprocess *PreprocessConfig `yaml:"preprocess"`
+
+	// настройки VERP, если указаны, письмо отправляется с адреса, в котором закодированы письмо и получатель
+	Verp *common.VerpConfig `yaml:"verp"`
 }
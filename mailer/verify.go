@@ -0,0 +1,185 @@
+package mailer
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// сколько используется публичный ключ, полученный из DNS, до повторного запроса
+const dkimPublicKeyTimeout = 10 * time.Minute
+
+var (
+	// значение тега b= в заголовке подписи, отбрасывается при проверке, RFC 6376 3.7
+	dkimSignatureValueRegex = regexp.MustCompile(`([;:][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+	// получает публичный ключ селектора из DNS
+	dkimPublicKeyLookup = lookupDkimPublicKey
+)
+
+// публичный ключ селектора не удалось получить, подпись не проверена, но и не признана неверной
+type dkimLookupError struct {
+	selector string
+	err      error
+}
+
+func (e *dkimLookupError) Error() string {
+	return fmt.Sprintf("can't get public key of dkim selector %s, error - %v", e.selector, e.err)
+}
+
+// проверяет подписи, которыми письмо было подписано ключами, перед отправкой
+// подписи добавляются в начало письма в порядке следования ключей
+// если подпись не совпала хотя бы с одним ключом, возвращается ошибка несовпадения,
+// если не удалось получить только публичные ключи, возвращается *dkimLookupError
+func (d *DkimConfig) verify(domain, message string, keys []*DkimKey, now time.Time) error {
+	headers, body := splitMessage(message)
+	signatures := findHeaders(headers, dkimSignatureHeader)
+	if len(signatures) < len(keys) {
+		return fmt.Errorf("expected %d dkim signatures, found %d", len(keys), len(signatures))
+	}
+	var lookupErr error
+	for i, key := range keys {
+		tags := parseHeaderTags(signatures[i])
+		var err error
+		if tags["s"] != key.Selector {
+			err = fmt.Errorf("selector %s doesn't match", tags["s"])
+		} else if tags["a"] != string(key.algorithm) {
+			err = fmt.Errorf("algorithm %s doesn't match", tags["a"])
+		} else {
+			var publicKey crypto.PublicKey
+			publicKey, err = key.verificationKey(domain, now)
+			if err == nil {
+				err = verifyDkimSignature(headers, body, signatures[i], tags, publicKey)
+			} else {
+				// остальные подписи все равно проверяются, несовпадение важнее недоступного DNS
+				lookupErr = &dkimLookupError{selector: key.Selector, err: err}
+				continue
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("dkim signature with selector %s is invalid, error - %v", key.Selector, err)
+		}
+	}
+	return lookupErr
+}
+
+// разбирает теги заголовка подписи
+func parseHeaderTags(header string) map[string]string {
+	return parseDkimTags(header[strings.Index(header, ":")+1:])
+}
+
+// проверяет подпись письма публичным ключом, RFC 6376 6.1
+// так же проверяется подпись письма ARC-Message-Signature, RFC 8617 4.1.2
+func verifyDkimSignature(headers []string, body, signature string, tags map[string]string, publicKey crypto.PublicKey) error {
+	// по умолчанию используется простая канонизация, RFC 6376 3.5
+	canonicalization := strings.SplitN(tags["c"], "/", 2)
+	if len(canonicalization[0]) == 0 {
+		canonicalization[0] = simpleCanonicalization
+	}
+	if len(canonicalization) == 1 {
+		canonicalization = append(canonicalization, simpleCanonicalization)
+	}
+	for _, value := range canonicalization {
+		if value != simpleCanonicalization && value != relaxedCanonicalization {
+			return fmt.Errorf("invalid canonicalization %s", tags["c"])
+		}
+	}
+
+	canonicalBody := canonicalizeBody(body, canonicalization[1])
+	if length, ok := tags["l"]; ok {
+		bodyLength, err := strconv.Atoi(length)
+		if err != nil || bodyLength > len(canonicalBody) {
+			return fmt.Errorf("invalid body length %s", length)
+		}
+		canonicalBody = canonicalBody[:bodyLength]
+	}
+	bodyHash := sha256.Sum256([]byte(canonicalBody))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errors.New("body hash doesn't match")
+	}
+
+	// экземпляры заголовков выбираются снизу вверх, RFC 6376 5.4.2
+	used := make(map[string]int)
+	hash := sha256.New()
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		instances := findHeaders(headers, name)
+		if used[name] < len(instances) {
+			hash.Write([]byte(canonicalizeHeader(instances[len(instances)-1-used[name]], canonicalization[0])))
+			used[name]++
+		}
+	}
+	writeUnsignedHeader(hash, signature, canonicalization[0])
+	return verifyDkimDigest(publicKey, hash.Sum(nil), tags["b"])
+}
+
+// добавляет в хеш заголовок подписи без значения тега b= и без завершающего перевода строки
+func writeUnsignedHeader(hash hash.Hash, signature, canonicalization string) {
+	unsigned := dkimSignatureValueRegex.ReplaceAllString(signature, "$1")
+	hash.Write([]byte(strings.TrimSuffix(canonicalizeHeader(unsigned, canonicalization), "\r\n")))
+}
+
+// проверяет подпись хеша заголовков
+func verifyDkimDigest(publicKey crypto.PublicKey, digest []byte, value string) error {
+	signed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	switch verifier := publicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(verifier, crypto.SHA256, digest, signed)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(verifier, digest, signed) {
+			return errors.New("ed25519 verification failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
+
+// получает публичный ключ из DNS записи selector._domainkey.domain, RFC 6376 3.6.2
+func lookupDkimPublicKey(domain, selector string) (crypto.PublicKey, error) {
+	name := fmt.Sprintf("%s._domainkey.%s", selector, domain)
+	records, err := net.LookupTXT(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		tags := parseDkimTags(record)
+		publicKey, ok := tags["p"]
+		if !ok {
+			continue
+		}
+		if len(publicKey) == 0 {
+			return nil, fmt.Errorf("key %s is revoked", name)
+		}
+		data, err := base64.StdEncoding.DecodeString(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		if tags["k"] == "ed25519" {
+			if len(data) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key %s has invalid size", name)
+			}
+			return ed25519.PublicKey(data), nil
+		}
+		// ключ RSA публикуется в SubjectPublicKeyInfo, но иногда встречается и в PKCS#1
+		if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+			return key, nil
+		}
+		return x509.ParsePKCS1PublicKey(data)
+	}
+	return nil, fmt.Errorf("key %s is not found", name)
+}
@@ -0,0 +1,110 @@
+package recipient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// максимальная длина командной строки вместе с CRLF, RFC 5321 4.5.3.1.4
+	maxCommandLineLen = 512
+
+	// максимальная длина строки письма вместе с переводом строки, RFC 5321 4.5.3.1.6
+	maxTextLineLen = 1000
+
+	// максимальное количество получателей письма, RFC 5321 4.5.3.1.8 требует принимать не меньше 100
+	maxRecipients = 100
+
+	// максимальный размер письма по умолчанию
+	defaultMaxSize = 10485760
+
+	// время ожидания команды или строки письма, RFC 5321 4.5.3.2.7
+	readTimeout = 5 * time.Minute
+)
+
+var (
+	// строка длиннее допустимой
+	errLineTooLong = errors.New("line too long")
+
+	// письмо больше допустимого размера
+	errMessageTooBig = errors.New("message too big")
+)
+
+// читает строку вместе с переводом строки
+// строка длиннее limit дочитывается до конца и отбрасывается, поэтому соединение можно использовать дальше
+func readLine(reader *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > limit {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			if tooLong {
+				return nil, errLineTooLong
+			}
+			return line, err
+		}
+	}
+}
+
+// разбирает путь и параметры ESMTP команд MAIL и RCPT, RFC 5321 4.1.2
+// args - часть команды после двоеточия, например <mail@example.com> SIZE=1024
+// возвращает адрес без угловых скобок и параметры с ключами в верхнем регистре
+func parsePath(args string) (string, map[string]string, error) {
+	// пробел после двоеточия запрещен RFC, но его отправляют многие клиенты
+	args = strings.TrimLeft(args, " ")
+	if !strings.HasPrefix(args, "<") {
+		return "", nil, fmt.Errorf("path %q should be in angle brackets", args)
+	}
+	// локальная часть в кавычках может содержать >
+	end := -1
+	quoted := false
+	for i := 1; i < len(args) && end == -1; i++ {
+		switch {
+		case args[i] == '\\' && quoted:
+			i++
+		case args[i] == '"':
+			quoted = !quoted
+		case args[i] == '>' && !quoted:
+			end = i
+		}
+	}
+	if end == -1 {
+		return "", nil, fmt.Errorf("path %q has unclosed angle bracket", args)
+	}
+	path := args[1:end]
+	// маршрут источника устарел и отбрасывается, RFC 5321 4.1.1.3
+	if strings.HasPrefix(path, "@") {
+		colon := strings.Index(path, ":")
+		if colon == -1 {
+			return "", nil, fmt.Errorf("path %q has invalid source route", args)
+		}
+		path = path[colon+1:]
+	}
+	rest := args[end+1:]
+	if len(rest) > 0 && rest[0] != ' ' {
+		return "", nil, fmt.Errorf("path %q should be separated from parameters by space", args)
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Fields(rest) {
+		key, value := param, ""
+		if equal := strings.Index(param, "="); equal > -1 {
+			key, value = param[:equal], param[equal+1:]
+		}
+		if len(key) == 0 {
+			return "", nil, fmt.Errorf("parameter %q has empty keyword", param)
+		}
+		params[strings.ToUpper(key)] = value
+	}
+	return path, params, nil
+}
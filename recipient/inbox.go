@@ -0,0 +1,42 @@
+package recipient
+
+import (
+	"net"
+	"time"
+)
+
+// принятое письмо, публикуется в точку обмена для входящих писем
+type InboxMail struct {
+	// отправитель из команды MAIL FROM
+	Envelope string `json:"envelope"`
+
+	// получатели из команд RCPT TO
+	Recipients []string `json:"recipients"`
+
+	// письмо с заголовками и содержимым
+	Body string `json:"body"`
+
+	// ip клиента
+	ClientIp string `json:"clientIp"`
+
+	// имя клиента из команды HELO или EHLO
+	Helo string `json:"helo"`
+
+	// дата получения письма
+	ReceivedDate time.Time `json:"receivedDate"`
+}
+
+// создает принятое письмо из события
+func newInboxMail(event *Event) *InboxMail {
+	mail := &InboxMail{
+		Envelope:     event.message.Envelope,
+		Recipients:   event.recipients,
+		Body:         event.message.Body,
+		Helo:         string(event.clientHostname),
+		ReceivedDate: time.Now(),
+	}
+	if addr, ok := event.clientAddr.(*net.TCPAddr); ok {
+		mail.ClientIp = addr.IP.String()
+	}
+	return mail
+}
@@ -0,0 +1,186 @@
+package recipient
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/streadway/amqp"
+	"sync"
+	"time"
+)
+
+const (
+	// время ожидания подтверждения публикации от AMQP сервера
+	confirmTimeout = 30 * time.Second
+
+	// количество подтверждений, которые AMQP клиент может передать, не дожидаясь их обработки
+	confirmsBufferSize = 64
+)
+
+// AMQP сервер отказался принять публикацию, канал при этом остается рабочим
+var errNotAcknowledged = errors.New("publishing is not acknowledged")
+
+// публикует сообщения в точку обмена AMQP сервера
+// точка обмена и одноименная очередь объявляются при подключении, канал работает в режиме подтверждений
+// семафор удерживается только на время публикации, подтверждения ожидаются параллельно по номерам публикаций
+type Publisher struct {
+	// адрес AMQP сервера
+	uri string
+
+	// имя точки обмена и очереди
+	exchange string
+
+	// соединение
+	connect *amqp.Connection
+
+	// канал, nil - соединение необходимо открыть заново
+	channel *amqp.Channel
+
+	// номер последней публикации в канале, AMQP сервер подтверждает публикации по этому номеру
+	deliveryTag uint64
+
+	// публикации, ожидающие подтверждения, по номеру публикации
+	pending map[uint64]chan error
+
+	// семафор публикаций
+	mutex *sync.Mutex
+
+	// семафор ожидающих подтверждения публикаций
+	// отдельный, т.к. AMQP клиент не примет публикацию, пока не передаст предыдущее подтверждение
+	confirmMutex *sync.Mutex
+}
+
+// создает публикатора, соединение открывается при первой публикации
+func newPublisher(uri, exchange string) *Publisher {
+	return &Publisher{
+		uri:          uri,
+		exchange:     exchange,
+		mutex:        new(sync.Mutex),
+		confirmMutex: new(sync.Mutex),
+	}
+}
+
+// открывает соединение и объявляет точку обмена и очередь
+func (p *Publisher) open() error {
+	connect, err := amqp.Dial(p.uri)
+	if err != nil {
+		return err
+	}
+	channel, err := connect.Channel()
+	if err == nil {
+		err = channel.ExchangeDeclare(p.exchange, "fanout", true, false, false, false, nil)
+	}
+	if err == nil {
+		_, err = channel.QueueDeclare(p.exchange, true, false, false, false, nil)
+	}
+	if err == nil {
+		err = channel.QueueBind(p.exchange, "", p.exchange, false, nil)
+	}
+	if err == nil {
+		err = channel.Confirm(false)
+	}
+	if err == nil {
+		p.connect = connect
+		p.channel = channel
+		p.deliveryTag = 0
+		p.pending = make(map[uint64]chan error)
+		go p.listenConfirms(channel.NotifyPublish(make(chan amqp.Confirmation, confirmsBufferSize)), p.pending)
+	} else {
+		connect.Close()
+	}
+	return err
+}
+
+// передает подтверждения публикаций ожидающим их публикациям
+// когда канал закрывается, все ожидающие публикации завершаются с ошибкой
+func (p *Publisher) listenConfirms(confirms chan amqp.Confirmation, pending map[uint64]chan error) {
+	for confirm := range confirms {
+		p.confirmMutex.Lock()
+		if wait, ok := pending[confirm.DeliveryTag]; ok {
+			delete(pending, confirm.DeliveryTag)
+			if confirm.Ack {
+				wait <- nil
+			} else {
+				wait <- errNotAcknowledged
+			}
+		}
+		p.confirmMutex.Unlock()
+	}
+	p.confirmMutex.Lock()
+	for deliveryTag, wait := range pending {
+		delete(pending, deliveryTag)
+		wait <- errors.New("channel is closed")
+	}
+	p.confirmMutex.Unlock()
+}
+
+// удаляет публикацию из ожидающих подтверждения
+func (p *Publisher) forget(pending map[uint64]chan error, deliveryTag uint64) {
+	p.confirmMutex.Lock()
+	delete(pending, deliveryTag)
+	p.confirmMutex.Unlock()
+}
+
+// закрывает соединение, если оно не было открыто заново, пока публикация ждала подтверждения
+// вызывается под семафором
+func (p *Publisher) reset(channel *amqp.Channel) {
+	if p.channel == channel && channel != nil {
+		p.connect.Close()
+		p.channel = nil
+	}
+}
+
+// сериализует значение в json, публикует его и ждет подтверждения от AMQP сервера
+// при ошибке, кроме отказа сервера, соединение закрывается и открывается заново при следующей публикации
+func (p *Publisher) Publish(value interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	if p.channel == nil {
+		if err = p.open(); err != nil {
+			p.mutex.Unlock()
+			return err
+		}
+	}
+	channel, pending := p.channel, p.pending
+	// номера публикаций в канале идут подряд, начиная с 1
+	// публикация ждет подтверждения еще до отправки, т.к. подтверждение может прийти раньше, чем вернется Publish
+	p.deliveryTag++
+	deliveryTag := p.deliveryTag
+	wait := make(chan error, 1)
+	p.confirmMutex.Lock()
+	pending[deliveryTag] = wait
+	p.confirmMutex.Unlock()
+	err = channel.Publish(
+		p.exchange,
+		"",
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+		},
+	)
+	if err != nil {
+		p.forget(pending, deliveryTag)
+		p.reset(channel)
+		p.mutex.Unlock()
+		return err
+	}
+	p.mutex.Unlock()
+
+	select {
+	case err = <-wait:
+	case <-time.After(confirmTimeout):
+		err = errors.New("publishing is not confirmed")
+	}
+	if err != nil && err != errNotAcknowledged {
+		p.forget(pending, deliveryTag)
+		p.mutex.Lock()
+		p.reset(channel)
+		p.mutex.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package recipient
+
+import (
+	"github.com/actionpay/postmanq/common"
+	"github.com/streadway/amqp"
+	"testing"
+	"time"
+)
+
+func TestPublisherConfirmsByDeliveryTag(t *testing.T) {
+	p := newPublisher("amqp://localhost", "inbox")
+	pending := make(map[uint64]chan error)
+	waits := make([]chan error, 4)
+	for i := range waits {
+		waits[i] = make(chan error, 1)
+		pending[uint64(i+1)] = waits[i]
+	}
+	confirms := make(chan amqp.Confirmation)
+	go p.listenConfirms(confirms, pending)
+
+	// подтверждения приходят не по порядку, каждая публикация получает свое
+	confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: false}
+	if err := receive(t, waits[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(t, waits[0]); err != errNotAcknowledged {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-waits[1]:
+		t.Fatal("unconfirmed publishing is finished", err)
+	default:
+	}
+
+	// при закрытии канала оставшиеся публикации завершаются с ошибкой
+	close(confirms)
+	for _, wait := range []chan error{waits[1], waits[3]} {
+		if err := receive(t, wait); err == nil {
+			t.Fatal("publishing is confirmed by closed channel")
+		}
+	}
+	p.confirmMutex.Lock()
+	defer p.confirmMutex.Unlock()
+	if len(pending) > 0 {
+		t.Fatal(pending)
+	}
+}
+
+func receive(t *testing.T, wait chan error) error {
+	select {
+	case err := <-wait:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("confirm is not received")
+		return nil
+	}
+}
+
+func TestDeliverWithoutInbox(t *testing.T) {
+	service = &Service{Configs: map[string]*Config{
+		"example.com": {},
+		"reports.com": {bounces: newPublisher("amqp://localhost", "bounces")},
+	}}
+	message := &common.MailMessage{Envelope: "a@b.com"}
+	for _, event := range []*Event{
+		{serverHostname: "unknown.com", message: message},
+		{serverHostname: "example.com", message: message},
+		{serverHostname: "example.com", message: message, verp: &common.VerpAddress{Uid: "1"}},
+		{serverHostname: "reports.com", message: message},
+	} {
+		if err := service.deliver(event); err != errNoInbox {
+			t.Errorf("%s: %v", event.serverHostname, err)
+		}
+	}
+	if err := service.deliver(&Event{serverHostname: "reports.com", message: message, verp: &common.VerpAddress{Uid: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,9 +1,11 @@
 package recipient
 
 import (
+	"crypto/tls"
 	"github.com/actionpay/postmanq/logger"
 	"net"
 	"net/textproto"
+	"time"
 )
 
 type Recipient struct {
@@ -11,6 +13,8 @@ type Recipient struct {
 	first State
 	state State
 	conn  net.Conn
+	// состояния всех команд, по ним команда, пришедшая не в свое время, отличается от неизвестной
+	commands []State
 }
 
 func newRecipient(id int, events chan *Event) {
@@ -26,35 +30,46 @@ func newRecipient(id int, events chan *Event) {
 		vrfy,
 	}
 
+	ehlo := new(EhloState)
+	ehlo.SetPossibles(commonPossibles)
+
+	// после приветствия клиент может поздороваться заново в любой момент, RFC 5321 4.1.4
+	greetedPossibles := append([]State{ehlo}, commonPossibles...)
+
 	input := new(InputState)
-	input.SetPossibles(commonPossibles)
 
 	data := new(DataState)
 	data.SetNext(input)
-	data.SetPossibles(commonPossibles)
 
 	rcpt := new(RcptState)
 	rcpt.SetNext(data)
-	rcpt.SetPossibles(commonPossibles)
+	rcpt.SetPossibles(greetedPossibles)
+
+	// после первого получателя можно добавлять следующих
+	data.SetPossibles(append([]State{rcpt}, greetedPossibles...))
+
+	// после STARTTLS клиент должен поздороваться заново, RFC 3207 4.2
+	starttls := new(StartTlsState)
+	starttls.SetNext(ehlo)
 
 	mail := new(MailState)
 	mail.SetNext(rcpt)
-	mail.SetPossibles(commonPossibles)
+	// шифрование начинается только вне транзакции
+	mail.SetPossibles(append([]State{starttls}, greetedPossibles...))
 
 	input.SetNext(mail)
 	rset.SetNext(mail)
-
-	ehlo := new(EhloState)
+	rset.greet = ehlo
 	ehlo.SetNext(mail)
-	ehlo.SetPossibles(commonPossibles)
 
 	conn := new(ConnectState)
 	conn.SetNext(ehlo)
 	conn.SetPossibles(commonPossibles)
 
 	recipient := &Recipient{
-		id:    id,
-		first: conn,
+		id:       id,
+		first:    conn,
+		commands: []State{ehlo, mail, rcpt, data, quit, noop, rset, vrfy, starttls},
 	}
 	for event := range events {
 		recipient.handle(event)
@@ -62,60 +77,68 @@ func newRecipient(id int, events chan *Event) {
 }
 
 func (r *Recipient) handle(event *Event) {
-	var id uint
 	var buf []byte
+	var err error
 	txt := textproto.NewConn(event.conn)
-	//status := ReadStatus
+	// после STARTTLS соединение заменяется зашифрованным
+	defer func() {
+		txt.Close()
+	}()
 	r.state = r.first
 
-	statuses := make(StateStatuses)
-	statuses.Add(ReadStatus)
-	for status := range statuses {
+	status := ReadStatus
+	for {
 		r.state.SetEvent(event)
 
 		switch status {
 		case ReadStatus:
-			id = txt.Next()
-			txt.StartRequest(id)
-			buf = r.state.Read(txt)
-			txt.EndRequest(id)
+			event.conn.SetReadDeadline(time.Now().Add(readTimeout))
+			buf, err = r.state.Read(txt)
+			if err == errLineTooLong || err == errMessageTooBig {
+				if err == errLineTooLong {
+					r.write(txt, event, lineTooLongResp)
+				} else {
+					r.write(txt, event, messageTooBigResp)
+				}
+				// письмо отброшено, транзакция завершена
+				if _, ok := r.state.(*InputState); ok {
+					r.state = r.state.GetNext()
+				}
+				continue
+			} else if err != nil {
+				logger.By(event.serverHostname).Debug("recipient service - connection with %s is closed, error - %v", event.clientAddr, err)
+				return
+			}
+			logger.By(event.serverHostname).Debug(string(buf))
 			cmd, cmdLen := r.state.GetCmd()
 			if r.state.Check(buf, cmd, cmdLen) {
-				statuses.Add(r.state.Process(buf))
+				status = r.state.Process(buf)
 			} else {
-				statuses.Add(PossibleStatus)
+				status = PossibleStatus
 			}
-			logger.By(event.serverHostname).Debug(string(buf))
 
 		case WriteStatus:
-			txt.StartResponse(id)
 			r.state.Write(txt)
-			txt.EndResponse(id)
-
 			r.state = r.state.GetNext()
-			statuses.Add(ReadStatus)
+			status = ReadStatus
 
 		case PossibleStatus:
-			var possibleStatus StateStatus
-			var state State
-			for _, possible := range r.state.GetPossibles() {
-				possible.SetEvent(event)
-				cmd, cmdLen := possible.GetCmd()
-				if possible.Check(buf, cmd, cmdLen) {
-					possibleStatus = possible.Process(buf)
-					if possibleStatus != FailureStatus {
-						state = possible
-						status = possibleStatus
-						break
-					}
-				}
-			}
+			state := r.possible(buf)
 			if state == nil {
-				state := r.first
-				for state.GetNext() != nil {
-
+				if r.isCommand(buf) {
+					r.write(txt, event, badSequenceResp)
+				} else {
+					r.write(txt, event, syntaxErrorResp)
 				}
-				txt.PrintfLine(syntaxErrorResp)
+				status = ReadStatus
+				break
+			}
+			state.SetEvent(event)
+			status = state.Process(buf)
+			if status == FailureStatus {
+				// состояние не меняется, клиент может повторить команду
+				r.write(txt, event, state.GetError().message)
+				status = ReadStatus
 			} else {
 				if state.IsUseCurrent() {
 					state.SetNext(r.state)
@@ -124,19 +147,69 @@ func (r *Recipient) handle(event *Event) {
 			}
 
 		case FailureStatus:
-			txt.StartResponse(id)
-			txt.PrintfLine(r.state.GetError().message)
-			txt.EndResponse(id)
-			logger.By(event.serverHostname).Debug("%s: %s", buf, r.state.GetError().message)
-			//statuses.Add(ReadStatus)
+			r.write(txt, event, r.state.GetError().message)
+			status = ReadStatus
+
+		case TlsStatus:
+			r.state.Write(txt)
+			if !r.startTls(event) {
+				return
+			}
+			// команды, отправленные клиентом до рукопожатия, отбрасываются вместе с буфером старого соединения, RFC 3207 5
+			txt = textproto.NewConn(event.conn)
+			r.state = r.state.GetNext()
+			status = ReadStatus
 
 		case QuitStatus:
-			txt.StartResponse(id)
 			r.state.Write(txt)
-			txt.EndResponse(id)
-			txt.Close()
 			return
 		}
 	}
-	close(statuses)
+}
+
+// шифрует соединение и сбрасывает все, что клиент сообщил до шифрования, RFC 3207 4.2
+func (r *Recipient) startTls(event *Event) bool {
+	conn := tls.Server(event.conn, event.tlsConfig)
+	conn.SetDeadline(time.Now().Add(readTimeout))
+	err := conn.Handshake()
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		event.conn = conn
+		event.tls = true
+		event.clientHostname = nil
+		event.message = nil
+		event.recipients = nil
+		event.verp = nil
+		return true
+	} else {
+		logger.By(event.serverHostname).Debug("recipient service - tls handshake with %s failed, error - %v", event.clientAddr, err)
+		return false
+	}
+}
+
+// возвращает состояние команды, допустимой в текущем состоянии
+func (r *Recipient) possible(line []byte) State {
+	for _, possible := range r.state.GetPossibles() {
+		cmd, cmdLen := possible.GetCmd()
+		if possible.Check(line, cmd, cmdLen) {
+			return possible
+		}
+	}
+	return nil
+}
+
+// проверяет, что строка является известной командой
+func (r *Recipient) isCommand(line []byte) bool {
+	for _, command := range r.commands {
+		cmd, cmdLen := command.GetCmd()
+		if command.Check(line, cmd, cmdLen) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Recipient) write(txt *textproto.Conn, event *Event, resp string) {
+	txt.PrintfLine("%s", resp)
+	logger.By(event.serverHostname).Debug(resp)
 }
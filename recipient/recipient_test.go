@@ -0,0 +1,281 @@
+package recipient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/actionpay/postmanq/common"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// тестовый обработчик соединений, все соединения обрабатываются одним обработчиком с общими состояниями
+type testRecipient struct {
+	t        *testing.T
+	listener *net.TCPListener
+	events   chan *Event
+	done     chan bool
+	// последнее открытое соединение клиента
+	conn   net.Conn
+	client *textproto.Conn
+}
+
+func newTestRecipient(t *testing.T, conf *Config) *testRecipient {
+	service = &Service{Configs: map[string]*Config{"example.com": conf}}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRecipient{t: t, listener: listener, events: make(chan *Event), done: make(chan bool)}
+	go func() { newRecipient(0, r.events); close(r.done) }()
+	return r
+}
+
+// открывает соединение и возвращает функцию, которая отправляет команду и проверяет ответ
+func (r *testRecipient) dial() (func(string, int, string), *Event) {
+	var err error
+	r.conn, err = net.Dial("tcp", r.listener.Addr().String())
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.client = textproto.NewConn(r.conn)
+	conn, _ := r.listener.AcceptTCP()
+	conf := service.Configs["example.com"]
+	event := &Event{serverHostname: "example.com", serverMxHostname: "mx.example.com", conn: conn, clientAddr: conn.RemoteAddr(), maxSize: conf.MaxSize, tlsConfig: conf.tlsConfig}
+	r.events <- event
+	expect := func(cmd string, code int, contains string) {
+		r.t.Helper()
+		if len(cmd) > 0 {
+			r.client.PrintfLine("%s", cmd)
+		}
+		got, msg, err := r.client.ReadResponse(0)
+		if got != code || !strings.Contains(msg, contains) {
+			r.t.Fatalf("%q: got %d %q %v, want %d", cmd, got, msg, err, code)
+		}
+	}
+	expect("", 220, "")
+	return expect, event
+}
+
+func (r *testRecipient) close() {
+	close(r.events)
+	<-r.done
+	r.listener.Close()
+}
+
+func TestSmtpDialog(t *testing.T) {
+	r := newTestRecipient(t, &Config{MaxSize: 1000})
+	defer r.close()
+	expect, event := r.dial()
+	expect("MAIL FROM:<a@b.com>", 503, "")
+	expect("FOO", 500, "")
+	expect("EHLO client.example.com", 250, "SIZE 1000\n8BITMIME")
+	expect("STARTTLS", 502, "")
+	expect("RCPT TO:<a@b.com>", 503, "")
+	expect("DATA", 503, "")
+	expect("MAIL FROM: a@b.com", 501, "")
+	expect("MAIL FROM:<a@b.com> SIZE=5000", 552, "")
+	expect("MAIL FROM:<a@b.com> FOO=1", 555, "")
+	expect("MAIL FROM:<a@b.com>"+strings.Repeat(" ", 600), 500, "Line too long")
+	expect("VRFY", 501, "")
+	expect("VRFY bob", 252, "")
+	expect("MAIL FROM:<> SIZE=100 BODY=8BITMIME", 250, "")
+	expect("MAIL FROM:<a@b.com>", 503, "")
+	expect("DATA", 503, "")
+	expect("RCPT TO:<c@d.com>", 250, "")
+	expect("NOOP", 250, "")
+	expect("RCPT TO:<Postmaster>", 250, "")
+	expect("RCPT TO:<bad>", 501, "")
+	expect("DATA x", 501, "")
+	expect("DATA", 354, "")
+	// без точки обмена для входящих писем письмо отклоняется
+	expect("Subject: hi\r\n\r\n..dot\r\nbody\r\n.", 550, "")
+	if event.message.Body != "Subject: hi\n\n.dot\nbody\n" || len(event.recipients) != 2 || event.message.Envelope != "" {
+		t.Fatalf("%q %v", event.message.Body, event.recipients)
+	}
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("RCPT TO:<c@d.com>", 250, "")
+	expect("DATA", 354, "")
+	expect(strings.Repeat("x", 1200)+"\r\n.", 500, "Line too long")
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("RCPT TO:<c@d.com>", 250, "")
+	expect("DATA", 354, "")
+	expect(strings.Repeat("xxxxxxxxx\r\n", 200)+".", 552, "")
+	expect("RCPT TO:<c@d.com>", 503, "")
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("RSET", 250, "")
+	expect("RCPT TO:<c@d.com>", 503, "")
+	expect("HELO again.example.com", 250, "")
+	expect("QUIT", 221, "")
+}
+
+func TestSmtpRset(t *testing.T) {
+	r := newTestRecipient(t, &Config{MaxSize: 1000})
+	defer r.close()
+
+	// до приветствия после RSET клиент все еще должен поздороваться
+	expect, _ := r.dial()
+	expect("RSET", 250, "")
+	expect("MAIL FROM:<a@b.com>", 503, "")
+	expect("RSET x", 501, "")
+	expect("EHLO client.example.com", 250, "")
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("QUIT", 221, "")
+
+	// RSET в предыдущем соединении не меняет переходы для следующего соединения
+	expect, event := r.dial()
+	expect("EHLO client.example.com", 250, "")
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("RCPT TO:<c@d.com>", 250, "")
+	expect("RSET", 250, "")
+	if event.message != nil || event.recipients != nil {
+		t.Fatal("transaction isn't reset", event.message, event.recipients)
+	}
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("RSET", 250, "")
+	expect("RSET", 250, "")
+	expect("MAIL FROM:<e@f.com>", 250, "")
+	expect("RCPT TO:<c@d.com>", 250, "")
+	expect("QUIT", 221, "")
+
+	expect, _ = r.dial()
+	expect("RSET", 250, "")
+	expect("HELO client.example.com", 250, "")
+	expect("RSET", 250, "")
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("QUIT", 221, "")
+}
+
+func TestSmtpTransactions(t *testing.T) {
+	verp := &common.VerpConfig{Secret: "secret"}
+	if err := verp.Init("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// без inbox принимаются только письма на адреса VERP, отчетов в письмах нет, поэтому в bounces ничего не публикуется
+	r := newTestRecipient(t, &Config{MaxSize: 1000, Verp: verp, bounces: newPublisher("amqp://localhost", "bounces")})
+	defer r.close()
+	address, _ := verp.Encode("k3x9", "john@mail.ru")
+
+	expect, event := r.dial()
+	expect("EHLO client.example.com", 250, "")
+	for i := 0; i < 2; i++ {
+		// отчеты о доставке отправляются с пустым адресом отправителя
+		expect("MAIL FROM:<>", 250, "")
+		expect("RCPT TO:<"+address+">", 250, "")
+		expect("RCPT TO:<other@example.com>", 250, "")
+		expect("RCPT TO:<Postmaster>", 250, "")
+		expect("DATA", 354, "")
+		expect("Subject: hi\r\n\r\nbody\r\n.", 250, "")
+		if len(event.recipients) != 3 || event.verp == nil || event.verp.Recipient != "john@mail.ru" || event.message.Envelope != "" {
+			t.Fatal(event.recipients, event.verp)
+		}
+	}
+	// новая транзакция не наследует получателей и адрес VERP предыдущей
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("RCPT TO:<other@example.com>", 250, "")
+	if len(event.recipients) != 1 || event.verp != nil {
+		t.Fatal(event.recipients, event.verp)
+	}
+	expect("DATA", 354, "")
+	expect("Subject: hi\r\n\r\nbody\r\n.", 550, "")
+	expect("DATA", 503, "")
+	expect("RCPT TO:<other@example.com>", 503, "")
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("MAIL FROM:<a@b.com>", 503, "")
+	expect("RCPT TO:<"+strings.Repeat("x", 600)+"@example.com>", 500, "Line too long")
+	expect("RCPT TO:<c@d.com>", 250, "")
+	expect("DATA", 354, "")
+	expect(strings.Repeat("x", 998)+"\r\n.", 550, "")
+	expect("QUIT", 221, "")
+}
+
+// создает самоподписанный сертификат для mx.example.com
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestSmtpStartTls(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	r := newTestRecipient(t, &Config{MaxSize: 1000, tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+	defer r.close()
+
+	expect, event := r.dial()
+	expect("STARTTLS", 503, "")
+	expect("EHLO client.example.com", 250, "8BITMIME\nSTARTTLS")
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("STARTTLS", 503, "")
+	expect("RSET", 250, "")
+	expect("STARTTLS x", 501, "")
+	// команда, отправленная вместе со STARTTLS до рукопожатия, не должна выполниться, RFC 3207 5
+	r.client.PrintfLine("STARTTLS\r\nMAIL FROM:<evil@b.com>")
+	expect("", 220, "Ready to start TLS")
+	conn := tls.Client(r.conn, &tls.Config{ServerName: "mx.example.com", RootCAs: pool})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	r.client = textproto.NewConn(conn)
+	expect("NOOP", 250, "")
+	// после шифрования клиент здоровается заново, а STARTTLS больше не объявляется
+	expect("MAIL FROM:<a@b.com>", 503, "")
+	expect("EHLO client.example.com", 250, "")
+	if !event.tls || event.message != nil {
+		t.Fatal(event.tls, event.message)
+	}
+	r.client.PrintfLine("EHLO client.example.com")
+	_, msg, _ := r.client.ReadResponse(250)
+	if strings.Contains(msg, "STARTTLS") {
+		t.Fatal(msg)
+	}
+	expect("STARTTLS", 503, "")
+	expect("MAIL FROM:<a@b.com>", 250, "")
+	expect("QUIT", 221, "")
+
+	// неудачное рукопожатие закрывает соединение, обработчик принимает следующее
+	expect, _ = r.dial()
+	expect("EHLO client.example.com", 250, "")
+	expect("STARTTLS", 220, "")
+	r.conn.Write([]byte("not a tls handshake\r\n"))
+	if _, err := r.client.ReadLine(); err == nil {
+		t.Fatal("connection isn't closed")
+	}
+	expect, _ = r.dial()
+	expect("EHLO client.example.com", 250, "STARTTLS")
+	expect("QUIT", 221, "")
+}
+
+func TestParsePath(t *testing.T) {
+	path, params, err := parsePath(`<@a,@b:"x>y"@c.com> SIZE=1 body=8bitmime`)
+	if err != nil || path != `"x>y"@c.com` || params["SIZE"] != "1" || params["BODY"] != "8bitmime" {
+		t.Fatal(path, params, err)
+	}
+	for _, bad := range []string{"a@b.com", "<a@b.com", "<a@b.com>SIZE=1", "<a@b.com> =1"} {
+		if _, _, err = parsePath(bad); err == nil {
+			t.Fatal(bad)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package recipient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/actionpay/postmanq/common"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// тип отчета
+type ReportKind string
+
+const (
+	// отказ почтового сервиса, RFC 3464
+	BounceReportKind ReportKind = "bounce"
+
+	// жалоба получателя, RFC 5965
+	ComplaintReportKind ReportKind = "complaint"
+)
+
+// письмо не является отчетом о доставке или жалобой
+var errNotReport = errors.New("mail is not a report")
+
+// отчет о доставке или жалоба, публикуется в точку обмена для отказов
+type Report struct {
+	// тип отчета
+	Kind ReportKind `json:"kind"`
+
+	// идентификатор исходного письма из адреса VERP
+	Uid string `json:"uid"`
+
+	// Message-ID исходного письма
+	MessageId string `json:"messageId"`
+
+	// получатель исходного письма
+	Recipient string `json:"recipient"`
+
+	// отправитель исходного письма, адрес VERP, если письмо было отправлено с VERP
+	Envelope string `json:"envelope"`
+
+	// действие почтового сервиса - failed, delayed, delivered, relayed, expanded
+	Action string `json:"action"`
+
+	// расширенный код статуса, например 5.1.1
+	Status string `json:"status"`
+
+	// ответ почтового сервиса
+	DiagnosticCode string `json:"diagnosticCode"`
+
+	// тип жалобы, например abuse
+	FeedbackType string `json:"feedbackType"`
+
+	// сервер, создавший отчет
+	ReportingMta string `json:"reportingMta"`
+
+	// домен отправителя, которому пришел отчет
+	Postman string `json:"postman"`
+
+	// дата получения отчета
+	CreatedDate time.Time `json:"createdDate"`
+}
+
+// проверяет, что отчет сообщает о жестком отказе по адресу получателя, например 5.1.1
+func (r *Report) isHardBounce() bool {
+	return r.Kind == BounceReportKind && r.Action == "failed" && strings.HasPrefix(r.Status, "5.1.")
+}
+
+// разбирает отчеты о доставке multipart/report; report-type=delivery-status, RFC 3464,
+// и жалобы multipart/report; report-type=feedback-report, RFC 5965
+// для отчета о доставке возвращается отчет на каждого получателя
+func parseReports(body []byte) ([]*Report, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" {
+		return nil, errNotReport
+	}
+	reportType := strings.ToLower(params["report-type"])
+	if reportType != "delivery-status" && reportType != "feedback-report" {
+		return nil, errNotReport
+	}
+
+	reports := make([]*Report, 0)
+	var fields []textproto.MIMEHeader
+	var original textproto.MIMEHeader
+	var envelope string
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/feedback-report":
+			fields, err = readFieldGroups(decodePart(part))
+			if err == nil && len(fields) > 0 && len(envelope) == 0 {
+				envelope = strings.Trim(fields[0].Get("Original-Mail-From"), " <>")
+			}
+		case "message/rfc822", "text/rfc822-headers", "message/rfc822-headers":
+			// из исходного письма нужны только заголовки, исходное письмо может быть обрезано, поэтому ошибки чтения не важны
+			original, _ = textproto.NewReader(bufio.NewReader(decodePart(part))).ReadMIMEHeader()
+			if len(envelope) == 0 {
+				envelope = strings.Trim(original.Get("Return-Path"), " <>")
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("report has no machine readable part")
+	}
+
+	base := &Report{Envelope: envelope}
+	if original != nil {
+		base.MessageId = strings.Trim(original.Get("Message-Id"), " <>")
+	}
+	if reportType == "delivery-status" {
+		// первая группа описывает сообщение, остальные - получателей, RFC 3464 2.2
+		base.Kind = BounceReportKind
+		base.ReportingMta = fieldValue(fields[0].Get("Reporting-MTA"))
+		for _, field := range fields[1:] {
+			report := *base
+			report.Recipient = fieldValue(field.Get("Original-Recipient"))
+			if len(report.Recipient) == 0 {
+				report.Recipient = fieldValue(field.Get("Final-Recipient"))
+			}
+			report.Action = strings.ToLower(field.Get("Action"))
+			report.Status = field.Get("Status")
+			report.DiagnosticCode = fieldValue(field.Get("Diagnostic-Code"))
+			reports = append(reports, &report)
+		}
+	} else {
+		field := fields[0]
+		base.Kind = ComplaintReportKind
+		base.FeedbackType = strings.ToLower(field.Get("Feedback-Type"))
+		base.ReportingMta = fieldValue(field.Get("Reporting-MTA"))
+		base.Recipient = strings.Trim(field.Get("Original-Rcpt-To"), " <>")
+		if len(base.Recipient) == 0 && original != nil {
+			if address, err := mail.ParseAddress(original.Get("To")); err == nil {
+				base.Recipient = address.Address
+			}
+		}
+		reports = append(reports, base)
+	}
+	return reports, nil
+}
+
+// читает группы полей, разделенные пустой строкой
+func readFieldGroups(reader io.Reader) ([]textproto.MIMEHeader, error) {
+	groups := make([]textproto.MIMEHeader, 0)
+	text := textproto.NewReader(bufio.NewReader(reader))
+	for {
+		group, err := text.ReadMIMEHeader()
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+		if err == io.EOF {
+			return groups, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// декодирует часть письма в base64, quoted-printable декодирует сам multipart
+func decodePart(part *multipart.Part) io.Reader {
+	if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+		data, _ := ioutil.ReadAll(part)
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), common.EmptyStr))
+		if err == nil {
+			return bytes.NewReader(decoded)
+		}
+		return bytes.NewReader(data)
+	}
+	return part
+}
+
+// возвращает значение поля без типа, например rfc822; mail@example.com -> mail@example.com
+func fieldValue(value string) string {
+	if semicolon := strings.Index(value, ";"); semicolon > -1 {
+		value = value[semicolon+1:]
+	}
+	return strings.Trim(strings.TrimSpace(value), "<>")
+}
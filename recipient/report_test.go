@@ -0,0 +1,165 @@
+package recipient
+
+import (
+	"github.com/actionpay/postmanq/common"
+	"strings"
+	"testing"
+)
+
+const dsn = `From: MAILER-DAEMON@mx.mail.ru
+To: bounces+k3x9=john=mail.ru@bounce.example.com
+Subject: Undelivered Mail
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status;
+	boundary="B1"
+
+--B1
+Content-Type: text/plain
+
+Sorry.
+
+--B1
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.mail.ru
+Arrival-Date: Mon, 1 Jan 2024 00:00:00 +0000
+
+Final-Recipient: rfc822; john@mail.ru
+Action: failed
+Status: 5.1.1
+Diagnostic-Code: smtp; 550 5.1.1 user unknown
+
+Final-Recipient: rfc822; jane@mail.ru
+Action: delayed
+Status: 4.2.2
+--B1
+Content-Type: text/rfc822-headers
+
+Return-Path: <bounces+k3x9=john=mail.ru@bounce.example.com>
+Message-ID: <abc@example.com>
+To: john@mail.ru
+
+--B1--
+`
+
+const arf = `From: fbl@mail.ru
+Content-Type: multipart/report; report-type=feedback-report; boundary="B2"
+
+--B2
+Content-Type: text/plain
+
+complaint
+--B2
+Content-Type: message/feedback-report
+
+Feedback-Type: abuse
+User-Agent: x/1
+Version: 1
+Original-Mail-From: <bounces+zz1@bounce.example.com>
+Reporting-MTA: dns; fbl.mail.ru
+
+--B2
+Content-Type: message/rfc822
+Content-Transfer-Encoding: base64
+
+` + "TWVzc2FnZS1JRDogPHF3ZUBleGFtcGxlLmNvbT4NClRvOiBWYXN5YSA8dmFzeWFAbWFpbC5ydT4NCg0KaGVsbG8NCg==" + `
+--B2--
+`
+
+func TestReports(t *testing.T) {
+	r, err := parseReports([]byte(strings.Replace(dsn, "\n", "\r\n", -1)))
+	if err != nil || len(r) != 2 {
+		t.Fatal(r, err)
+	}
+	if r[0].Recipient != "john@mail.ru" || r[0].Status != "5.1.1" || r[0].Action != "failed" || r[0].DiagnosticCode != "550 5.1.1 user unknown" || r[0].MessageId != "abc@example.com" || r[0].ReportingMta != "mx.mail.ru" || !r[0].isHardBounce() || r[0].Envelope != "bounces+k3x9=john=mail.ru@bounce.example.com" {
+		t.Fatalf("%+v", r[0])
+	}
+	if r[1].Recipient != "jane@mail.ru" || r[1].isHardBounce() {
+		t.Fatalf("%+v", r[1])
+	}
+	r, err = parseReports([]byte(arf))
+	if err != nil || len(r) != 1 {
+		t.Fatal(r, err)
+	}
+	if r[0].Kind != ComplaintReportKind || r[0].FeedbackType != "abuse" || r[0].Recipient != "vasya@mail.ru" || r[0].MessageId != "qwe@example.com" || r[0].Envelope != "bounces+zz1@bounce.example.com" {
+		t.Fatalf("%+v", r[0])
+	}
+	if _, err = parseReports([]byte("Subject: hi\r\n\r\nbody")); err != errNotReport {
+		t.Fatal(err)
+	}
+}
+
+type testSuppressor struct {
+	bounces    []string
+	complaints []string
+}
+
+func (s *testSuppressor) SuppressBounce(address, reason string) {
+	s.bounces = append(s.bounces, address)
+}
+
+func (s *testSuppressor) SuppressComplaint(address, reason string) {
+	s.complaints = append(s.complaints, address)
+}
+
+func TestHandleReportsSuppressesOnlyVerifiedVerp(t *testing.T) {
+	verp := &common.VerpConfig{Domain: "bounce.example.com", Secret: "secret"}
+	if err := verp.Init("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	service = &Service{Configs: map[string]*Config{"example.com": {Verp: verp}}}
+	suppressor := new(testSuppressor)
+	common.Suppressions = suppressor
+	defer func() { common.Suppressions = nil }()
+
+	address, _ := verp.Encode("k3x9", "john@mail.ru")
+	body := strings.Replace(strings.Replace(dsn, "bounces+k3x9=john=mail.ru@bounce.example.com", address, -1), "\n", "\r\n", -1)
+	newEvent := func(verp *common.VerpAddress) *Event {
+		return &Event{serverHostname: "example.com", message: &common.MailMessage{Envelope: "MAILER-DAEMON@mx.mail.ru", Body: body}, verp: verp}
+	}
+
+	// отчет не на адрес VERP не подавляет получателя, даже если в отчете указан подписанный адрес
+	service.handleReports(newEvent(nil))
+	if len(suppressor.bounces) > 0 {
+		t.Fatal("suppressed without verp", suppressor.bounces)
+	}
+	// адрес VERP без получателя не подтверждает получателя из отчета
+	service.handleReports(newEvent(&common.VerpAddress{Uid: "k3x9"}))
+	if len(suppressor.bounces) > 0 {
+		t.Fatal("suppressed without verp recipient", suppressor.bounces)
+	}
+	decoded, err := verp.Decode(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.handleReports(newEvent(decoded))
+	if len(suppressor.bounces) != 1 || suppressor.bounces[0] != "john@mail.ru" {
+		t.Fatal(suppressor.bounces)
+	}
+}
+
+// в отчете о нескольких получателях подавляется только получатель из адреса VERP
+func TestHandleReportsSuppressesOnlyVerpRecipient(t *testing.T) {
+	verp := &common.VerpConfig{Domain: "bounce.example.com", Secret: "secret"}
+	if err := verp.Init("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	service = &Service{Configs: map[string]*Config{"example.com": {Verp: verp}}}
+	suppressor := new(testSuppressor)
+	common.Suppressions = suppressor
+	defer func() { common.Suppressions = nil }()
+
+	address, _ := verp.Encode("k3x9", "john@mail.ru")
+	decoded, err := verp.Decode(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Replace(dsn, "Action: delayed\nStatus: 4.2.2", "Action: failed\nStatus: 5.1.1", 1)
+	body = strings.Replace(body, "john@mail.ru\nAction", "John@Mail.ru\nAction", 1)
+	body = strings.Replace(body, "\n", "\r\n", -1)
+	event := &Event{serverHostname: "example.com", message: &common.MailMessage{Envelope: "MAILER-DAEMON@mx.mail.ru", Body: body}, verp: decoded}
+	service.handleReports(event)
+	if len(suppressor.bounces) != 1 || suppressor.bounces[0] != "john@mail.ru" {
+		t.Fatal(suppressor.bounces)
+	}
+}
@@ -1,16 +1,22 @@
 package recipient
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/actionpay/postmanq/common"
 	"github.com/actionpay/postmanq/logger"
 	yaml "gopkg.in/yaml.v2"
 	"net"
 	"strings"
+	"time"
 )
 
 var (
 	service *Service
+
+	// письмо некуда опубликовать, и оно не может быть принято
+	errNoInbox = errors.New("inbox is not defined")
 )
 
 func Inst() common.SendingService {
@@ -21,9 +27,24 @@ func Inst() common.SendingService {
 }
 
 type Config struct {
-	ListenerCount int    `yaml:"listenerCount"`
-	Inbox         string `yaml:"inbox"`
-	MxHostnames   []string
+	ListenerCount int `yaml:"listenerCount"`
+	// точка обмена для принятых писем
+	Inbox string             `yaml:"inbox"`
+	Verp  *common.VerpConfig `yaml:"verp"`
+	// адрес AMQP сервера, в который публикуются входящие письма и отчеты
+	Amqp string `yaml:"amqp"`
+	// точка обмена для отчетов о доставке и жалоб
+	Bounces string `yaml:"bounces"`
+	// максимальный размер письма в байтах, объявляется клиентам в расширении SIZE
+	MaxSize int `yaml:"maxSize"`
+	// путь до файла с сертификатом, если он указан, recipient объявляет расширение STARTTLS, RFC 3207
+	CertFilename string `yaml:"certificate"`
+	// путь до файла с закрытым ключом сертификата
+	PrivateKeyFilename string `yaml:"privateKey"`
+	MxHostnames        []string
+	inbox              *Publisher
+	bounces            *Publisher
+	tlsConfig          *tls.Config
 }
 
 type Event struct {
@@ -31,8 +52,17 @@ type Event struct {
 	serverMxHostname string
 	clientHostname   []byte
 	clientAddr       net.Addr
-	conn             *net.TCPConn
+	conn             net.Conn
 	message          *common.MailMessage
+	maxSize          int
+	// получатели из команд RCPT TO
+	recipients []string
+	// адрес VERP, на который пришло письмо, по нему отказ сопоставляется с отправленным письмом
+	verp *common.VerpAddress
+	// настройки TLS для команды STARTTLS, nil, если сертификат не указан
+	tlsConfig *tls.Config
+	// соединение уже зашифровано командой STARTTLS
+	tls bool
 }
 
 type Service struct {
@@ -60,6 +90,34 @@ func (s *Service) init(conf *Config, hostname string) {
 		if conf.ListenerCount == 0 {
 			conf.ListenerCount = common.DefaultWorkersCount
 		}
+		if conf.MaxSize == 0 {
+			conf.MaxSize = defaultMaxSize
+		}
+		if len(conf.CertFilename) > 0 {
+			cert, err := tls.LoadX509KeyPair(conf.CertFilename, conf.PrivateKeyFilename)
+			if err == nil {
+				conf.tlsConfig = &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					MinVersion:   tls.VersionTLS12,
+				}
+			} else {
+				logger.By(hostname).FailExit("recipient service can't load certificate %s, private key %s, error - %v", conf.CertFilename, conf.PrivateKeyFilename, err)
+			}
+		}
+		if conf.Verp != nil {
+			if err = conf.Verp.Init(hostname); err != nil {
+				logger.By(hostname).FailExitWithErr(err)
+			}
+		}
+		if (len(conf.Inbox) > 0 || len(conf.Bounces) > 0) && len(conf.Amqp) == 0 {
+			logger.By(hostname).FailExit("recipient service - amqp should be defined for inbox and bounces")
+		}
+		if len(conf.Inbox) > 0 {
+			conf.inbox = newPublisher(conf.Amqp, conf.Inbox)
+		}
+		if len(conf.Bounces) > 0 {
+			conf.bounces = newPublisher(conf.Amqp, conf.Bounces)
+		}
 	} else {
 		logger.By(hostname).FailExit("recipient service - can't lookup mx for %s", hostname)
 	}
@@ -100,6 +158,8 @@ func (s *Service) run(hostname, mxHostname string, conf *Config, listener *net.T
 				serverMxHostname: mxHostname,
 				clientAddr:       conn.RemoteAddr(),
 				conn:             conn,
+				maxSize:          conf.MaxSize,
+				tlsConfig:        conf.tlsConfig,
 			}
 		} else {
 			logger.By(hostname).Warn("recipient service - can't accept %s, error - %v", hostname, err)
@@ -107,6 +167,96 @@ func (s *Service) run(hostname, mxHostname string, conf *Config, listener *net.T
 	}
 }
 
+// разбирает адрес VERP отправителя, возвращает nil, если адрес не является адресом VERP
+func (s *Service) decodeVerp(hostname, address string) *common.VerpAddress {
+	if conf, ok := s.Configs[hostname]; ok && conf.Verp != nil {
+		if verp, err := conf.Verp.Decode(address); err == nil {
+			return verp
+		}
+	}
+	return nil
+}
+
+// публикует принятое письмо в точку обмена для входящих писем и ждет подтверждения от AMQP сервера
+// письмо считается принятым, только если публикация подтверждена
+// если точка обмена для входящих писем не указана, принимаются только отчеты на адреса VERP, остальные письма отклоняются
+func (s *Service) deliver(event *Event) error {
+	conf, ok := s.Configs[event.serverHostname]
+	if !ok {
+		return errNoInbox
+	}
+	if conf.inbox == nil {
+		if event.verp != nil && conf.bounces != nil {
+			return nil
+		}
+		return errNoInbox
+	}
+	err := conf.inbox.Publish(newInboxMail(event))
+	if err == nil {
+		logger.By(event.serverHostname).Info("recipient service - publish mail from %s to %s", event.message.Envelope, conf.Inbox)
+	} else {
+		logger.By(event.serverHostname).Warn("recipient service - can't publish mail from %s to %s, error - %v", event.message.Envelope, conf.Inbox, err)
+	}
+	return err
+}
+
+// разбирает отчеты о доставке и жалобы и публикует их в точку обмена для отказов
+// по жестким отказам и жалобам получатели добавляются в список подавления, так же как при синхронном отказе,
+// но только если отчет пришел на подписанный адрес VERP с получателем, иначе отчетом можно подавить любой адрес
+func (s *Service) handleReports(event *Event) {
+	hostname := event.serverHostname
+	reports, err := parseReports([]byte(event.message.Body))
+	if err == errNotReport {
+		return
+	} else if err != nil {
+		logger.By(hostname).Warn("recipient service - can't parse report from %s, error - %v", event.message.Envelope, err)
+		return
+	}
+	for _, report := range reports {
+		report.Postman = hostname
+		report.CreatedDate = time.Now()
+		// получатель, о котором сообщает сам отчет, в отчете может быть несколько получателей
+		reported := report.Recipient
+		verp := event.verp
+		if verp == nil && len(report.Envelope) > 0 {
+			verp = s.decodeVerp(hostname, report.Envelope)
+		}
+		if verp != nil {
+			report.Uid = verp.Uid
+			// получатель из адреса VERP точнее, т.к. письмо могло быть переадресовано
+			if len(verp.Recipient) > 0 {
+				report.Recipient = verp.Recipient
+			}
+		}
+		logger.By(hostname).Info(
+			"recipient service - receive %s for mail %s, recipient - %s, status - %s",
+			report.Kind,
+			report.Uid,
+			report.Recipient,
+			report.Status,
+		)
+
+		if event.verp == nil || len(event.verp.Recipient) == 0 {
+			logger.By(hostname).Debug("recipient service - %s for %s isn't received on verp address with recipient, recipient isn't suppressed", report.Kind, report.Recipient)
+		} else if report.Kind != ComplaintReportKind && !strings.EqualFold(reported, event.verp.Recipient) {
+			// отказ по другому получателю из того же отчета не относится к получателю из адреса VERP
+			logger.By(hostname).Debug("recipient service - %s for %s doesn't match verp recipient %s, recipient isn't suppressed", report.Kind, reported, event.verp.Recipient)
+		} else if common.Suppressions != nil {
+			if report.Kind == ComplaintReportKind {
+				common.Suppressions.SuppressComplaint(event.verp.Recipient, fmt.Sprintf("%s complaint from %s", report.FeedbackType, report.ReportingMta))
+			} else if report.isHardBounce() {
+				common.Suppressions.SuppressBounce(event.verp.Recipient, fmt.Sprintf("%s %s", report.Status, report.DiagnosticCode))
+			}
+		}
+
+		if conf, ok := s.Configs[hostname]; ok && conf.bounces != nil {
+			if err = conf.bounces.Publish(report); err != nil {
+				logger.By(hostname).Warn("recipient service - can't publish %s to %s, error - %v", report.Kind, conf.Bounces, err)
+			}
+		}
+	}
+}
+
 func (s *Service) Events() chan *common.SendEvent {
 	return nil
 }
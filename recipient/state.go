@@ -1,11 +1,15 @@
 package recipient
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"github.com/actionpay/postmanq/common"
 	"github.com/actionpay/postmanq/logger"
+	"io"
+	"net"
 	"net/textproto"
+	"strconv"
 	"strings"
 )
 
@@ -17,6 +21,8 @@ const (
 	WriteStatus
 	PossibleStatus
 	QuitStatus
+	// клиент начинает рукопожатие TLS, RFC 3207
+	TlsStatus
 )
 
 type StateError struct {
@@ -29,7 +35,7 @@ type State interface {
 	SetNext(State)
 	GetPossibles() []State
 	SetPossibles([]State)
-	Read(*textproto.Conn) []byte
+	Read(*textproto.Conn) ([]byte, error)
 	Process([]byte) StateStatus
 	Write(*textproto.Conn)
 	GetId() uint
@@ -41,19 +47,26 @@ type State interface {
 }
 
 var (
-	crlf           = "\r\n"
-	greetResp      = fmt.Sprintf("%d %s", ReadyCode, "%s ESMTP")
+	crlf      = "\r\n"
+	greetResp = fmt.Sprintf("%d %s", ReadyCode, "%s ESMTP")
+	// расширения, которые поддерживает recipient, RFC 1870 и RFC 6152
 	ehloExtensions = []string{
-		fmt.Sprintf("%d-STARTTLS", CompleteCode),
-		fmt.Sprintf("%d-SIZE", CompleteCode),
-		fmt.Sprintf("%d HELP", CompleteCode),
+		"SIZE %d",
+		"8BITMIME",
 	}
-	ehloResp        = fmt.Sprintf("%d-%s", CompleteCode, "%s ready to serve") + crlf + strings.Join(ehloExtensions, crlf)
-	heloResp        = fmt.Sprintf("%d %s", CompleteCode, "%s ready to serve")
-	completeResp    = fmt.Sprintf("%d OK", CompleteCode)
-	startInputResp  = fmt.Sprintf(StartInputCode.GetName(), StartInputCode)
-	closeResp       = CloseCode.GetName()
-	syntaxErrorResp = SyntaxErrorCode.GetName()
+	// расширение RFC 3207 объявляется, только если указан сертификат и соединение еще не зашифровано
+	starttlsExtension = "STARTTLS"
+	ehloResp          = "%s ready to serve"
+	heloResp          = fmt.Sprintf("%d %s", CompleteCode, "%s ready to serve")
+	completeResp      = fmt.Sprintf("%d OK", CompleteCode)
+	startInputResp    = fmt.Sprintf(StartInputCode.GetName(), StartInputCode)
+	closeResp         = CloseCode.GetName()
+	syntaxErrorResp   = SyntaxErrorCode.GetFormattedName()
+	badSequenceResp   = BadSequenceCode.GetFormattedName()
+	lineTooLongResp   = fmt.Sprintf("%d Line too long", SyntaxErrorCode)
+	messageTooBigResp = ExceededStorageCode.GetFormattedName()
+	attemptResp       = AttemptDeliveryCode.GetFormattedName()
+	startTlsResp      = fmt.Sprintf("%d Ready to start TLS", ReadyCode)
 
 	emptyCmd   = []byte{}
 	ehlo       = []byte("EHLO")
@@ -69,11 +82,13 @@ var (
 	quitCmd    = []byte("QUIT")
 	quitCmdLen = len(quitCmd)
 	noopCmd    = []byte("NOOP")
-	noopCmdLen = len(quitCmd)
+	noopCmdLen = len(noopCmd)
 	rsetCmd    = []byte("RSET")
-	rsetCmdLen = len(quitCmd)
+	rsetCmdLen = len(rsetCmd)
 	vrfyCmd    = []byte("VRFY")
-	vrfyCmdLen = len(quitCmd)
+	vrfyCmdLen = len(vrfyCmd)
+	tlsCmd     = []byte("STARTTLS")
+	tlsCmdLen  = len(tlsCmd)
 )
 
 type BaseState struct {
@@ -116,16 +131,20 @@ func (b BaseState) GetError() *StateError {
 	return b.error
 }
 
+// проверяет, что строка начинается с команды, за которой следует пробел или конец строки
 func (b BaseState) Check(line []byte, cmd []byte, cmdLen int) bool {
-	return len(line) >= cmdLen && bytes.Equal(cmd, bytes.ToUpper(line[:cmdLen]))
+	return len(line) >= cmdLen &&
+		bytes.Equal(cmd, bytes.ToUpper(line[:cmdLen])) &&
+		(len(line) == cmdLen || cmdLen == 0 || cmd[cmdLen-1] == ':' || line[cmdLen] == ' ')
 }
 
-func (b BaseState) Read(conn *textproto.Conn) []byte {
-	line, err := conn.ReadLineBytes()
+// читает командную строку без CRLF
+func (b BaseState) Read(conn *textproto.Conn) ([]byte, error) {
+	line, err := readLine(conn.R, maxCommandLineLen)
 	if err == nil {
-		return line
+		return bytes.TrimRight(line, crlf), nil
 	} else {
-		return nil
+		return nil, err
 	}
 }
 
@@ -134,8 +153,12 @@ func (b BaseState) IsUseCurrent() bool {
 }
 
 func (b *BaseState) wrongParams() StateStatus {
+	return b.fail(SyntaxParamErrorCode)
+}
+
+func (b *BaseState) fail(code Code) StateStatus {
 	b.error = &StateError{
-		message: SyntaxParamErrorCode.GetFormattedName(),
+		message: code.GetFormattedName(),
 	}
 	return FailureStatus
 }
@@ -144,8 +167,8 @@ type ConnectState struct {
 	BaseState
 }
 
-func (c *ConnectState) Read(conn *textproto.Conn) []byte {
-	return nil
+func (c *ConnectState) Read(conn *textproto.Conn) ([]byte, error) {
+	return emptyCmd, nil
 }
 
 func (c *ConnectState) Process(line []byte) StateStatus {
@@ -167,10 +190,9 @@ type EhloState struct {
 }
 
 func (e *EhloState) Check(line []byte, cmd []byte, cmdLen int) bool {
-	isEhlo := e.BaseState.Check(line, ehlo, ehloLen)
-	if isEhlo {
-		e.useEhlo = true
-		return isEhlo
+	e.useEhlo = e.BaseState.Check(line, ehlo, ehloLen)
+	if e.useEhlo {
+		return true
 	} else {
 		return e.BaseState.Check(line, helo, heloLen)
 	}
@@ -192,25 +214,54 @@ func (e *EhloState) Process(line []byte) StateStatus {
 
 func (e *EhloState) receiveClientHostname(line []byte, cmd []byte, cmdLen int) StateStatus {
 	hostname := bytes.TrimSpace(line[cmdLen:])
-	if common.HostnameRegex.Match(hostname) {
+	if _, err := common.ParseDomain(string(hostname)); err == nil || isAddressLiteral(hostname) {
 		e.event.clientHostname = hostname
+		// повторное приветствие сбрасывает транзакцию, RFC 5321 4.1.4
+		e.event.message = nil
+		e.event.recipients = nil
+		e.event.verp = nil
 		return WriteStatus
 	} else {
 		return e.wrongParams()
 	}
 }
 
+// проверяет, что клиент представился ip адресом в квадратных скобках, RFC 5321 4.1.3
+func isAddressLiteral(hostname []byte) bool {
+	if len(hostname) < 2 || hostname[0] != '[' || hostname[len(hostname)-1] != ']' {
+		return false
+	}
+	ip := strings.TrimPrefix(string(hostname[1:len(hostname)-1]), "IPv6:")
+	return net.ParseIP(ip) != nil
+}
+
 func (e *EhloState) Write(conn *textproto.Conn) {
 	var resp string
 
 	if e.useEhlo {
-		resp = ehloResp
+		lines := []string{
+			fmt.Sprintf(ehloResp, e.event.serverMxHostname),
+			fmt.Sprintf(ehloExtensions[0], e.event.maxSize),
+		}
+		lines = append(lines, ehloExtensions[1:]...)
+		if e.event.tlsConfig != nil && !e.event.tls {
+			lines = append(lines, starttlsExtension)
+		}
+		// в многострочном ответе после кода всех строк, кроме последней, ставится дефис, RFC 5321 4.2.1
+		for i, line := range lines {
+			if i == len(lines)-1 {
+				lines[i] = fmt.Sprintf("%d %s", CompleteCode, line)
+			} else {
+				lines[i] = fmt.Sprintf("%d-%s", CompleteCode, line)
+			}
+		}
+		resp = strings.Join(lines, crlf)
 	} else {
-		resp = heloResp
+		resp = fmt.Sprintf(heloResp, e.event.serverMxHostname)
 	}
 
-	conn.PrintfLine(resp, e.event.serverMxHostname)
-	logger.By(e.event.serverHostname).Debug(resp, e.event.serverMxHostname)
+	conn.PrintfLine("%s", resp)
+	logger.By(e.event.serverHostname).Debug(resp)
 }
 
 type MailState struct {
@@ -222,19 +273,44 @@ func (m *MailState) GetCmd() ([]byte, int) {
 }
 
 func (m *MailState) Process(line []byte) StateStatus {
-	envelope := line[mailCmdLen+1 : len(line)-1]
-	if common.EmailRegexp.Match(envelope) {
-		m.event.message = &common.MailMessage{
-			Envelope: string(envelope),
-		}
-		return WriteStatus
-	} else {
+	envelope, params, err := parsePath(string(line[mailCmdLen:]))
+	if err != nil {
 		return m.wrongParams()
 	}
+	// пустой отправитель <> используется в отчетах о доставке, RFC 5321 4.5.5
+	if len(envelope) > 0 {
+		if _, err = common.ParseAddress(envelope); err != nil {
+			return m.wrongParams()
+		}
+	}
+	for key, value := range params {
+		switch key {
+		case "SIZE":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 {
+				return m.wrongParams()
+			}
+			if size > m.event.maxSize {
+				return m.fail(ExceededStorageCode)
+			}
+		case "BODY":
+			if !strings.EqualFold(value, "7BIT") && !strings.EqualFold(value, "8BITMIME") {
+				return m.wrongParams()
+			}
+		default:
+			return m.fail(ParamsNotRecognizedCode)
+		}
+	}
+	m.event.message = &common.MailMessage{
+		Envelope: envelope,
+	}
+	m.event.recipients = nil
+	m.event.verp = nil
+	return WriteStatus
 }
 
 func (m *MailState) Write(conn *textproto.Conn) {
-	conn.PrintfLine(completeResp)
+	conn.PrintfLine("%s", completeResp)
 	logger.By(m.event.serverHostname).Debug(completeResp)
 }
 
@@ -247,17 +323,37 @@ func (r *RcptState) GetCmd() ([]byte, int) {
 }
 
 func (r *RcptState) Process(line []byte) StateStatus {
-	recipient := line[rcptCmdLen+1 : len(line)-1]
-	if common.EmailRegexp.Match(recipient) {
-		r.event.message.Recipient = string(recipient)
-		return WriteStatus
-	} else {
+	recipient, params, err := parsePath(string(line[rcptCmdLen:]))
+	if err != nil || len(recipient) == 0 {
 		return r.wrongParams()
 	}
+	if len(params) > 0 {
+		return r.fail(ParamsNotRecognizedCode)
+	}
+	// postmaster без домена принимается всегда, RFC 5321 4.5.1
+	if !strings.EqualFold(recipient, "postmaster") {
+		if _, err = common.ParseAddress(recipient); err != nil {
+			return r.wrongParams()
+		}
+	}
+	if len(r.event.recipients) == maxRecipients {
+		return r.fail(NotTakenCode)
+	}
+	r.event.recipients = append(r.event.recipients, recipient)
+	if len(r.event.message.Recipient) == 0 {
+		r.event.message.Recipient = recipient
+	}
+	if r.event.verp == nil {
+		if verp := service.decodeVerp(r.event.serverHostname, recipient); verp != nil {
+			r.event.verp = verp
+			logger.By(r.event.serverHostname).Debug("recipient service - mail to verp address of mail %s, recipient %s", verp.Uid, verp.Recipient)
+		}
+	}
+	return WriteStatus
 }
 
 func (r *RcptState) Write(conn *textproto.Conn) {
-	conn.PrintfLine(completeResp)
+	conn.PrintfLine("%s", completeResp)
 	logger.By(r.event.serverHostname).Debug(completeResp)
 }
 
@@ -270,11 +366,14 @@ func (d *DataState) GetCmd() ([]byte, int) {
 }
 
 func (d *DataState) Process(line []byte) StateStatus {
+	if len(bytes.TrimSpace(line[dataCmdLen:])) > 0 {
+		return d.wrongParams()
+	}
 	return WriteStatus
 }
 
 func (d *DataState) Write(conn *textproto.Conn) {
-	conn.PrintfLine(startInputResp)
+	conn.PrintfLine("%s", startInputResp)
 	logger.By(d.event.serverHostname).Debug(startInputResp)
 }
 
@@ -282,12 +381,37 @@ type InputState struct {
 	BaseState
 }
 
-func (i *InputState) Read(conn *textproto.Conn) []byte {
-	line, err := conn.ReadDotBytes()
-	if err == nil {
-		return line
+// читает письмо до строки с точкой
+// если строка или письмо длиннее допустимого, письмо дочитывается до конца и отбрасывается
+func (i *InputState) Read(conn *textproto.Conn) ([]byte, error) {
+	reader := bufio.NewReader(conn.DotReader())
+	body := new(bytes.Buffer)
+	var failure error
+	for {
+		line, err := readLine(reader, maxTextLineLen)
+		if err == errLineTooLong {
+			failure = err
+			body.Reset()
+			continue
+		}
+		if failure == nil {
+			if body.Len()+len(line) > i.event.maxSize {
+				failure = errMessageTooBig
+				body.Reset()
+			} else {
+				body.Write(line)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if failure == nil {
+		return body.Bytes(), nil
 	} else {
-		return nil
+		return nil, failure
 	}
 }
 
@@ -303,12 +427,30 @@ func (i *InputState) Process(line []byte) StateStatus {
 		i.event.message.Recipient,
 		i.event.message.Body,
 	)
+	// письмо не принято, если его не удалось опубликовать, отправитель повторит отправку позже
+	if err := service.deliver(i.event); err == nil {
+		i.error = nil
+		service.handleReports(i.event)
+	} else if err == errNoInbox {
+		// письмо никогда не получится принять, поэтому отправитель не должен повторять отправку
+		i.error = &StateError{
+			message: UserNotFoundCode.GetFormattedName(),
+		}
+	} else {
+		i.error = &StateError{
+			message: AbortedCode.GetFormattedName(),
+		}
+	}
 	return WriteStatus
 }
 
 func (i *InputState) Write(conn *textproto.Conn) {
-	conn.PrintfLine(completeResp)
-	logger.By(i.event.serverHostname).Debug(completeResp)
+	resp := completeResp
+	if i.error != nil {
+		resp = i.error.message
+	}
+	conn.PrintfLine("%s", resp)
+	logger.By(i.event.serverHostname).Debug(resp)
 }
 
 type QuitState struct {
@@ -320,6 +462,9 @@ func (q *QuitState) GetCmd() ([]byte, int) {
 }
 
 func (q *QuitState) Process(line []byte) StateStatus {
+	if len(bytes.TrimSpace(line[quitCmdLen:])) > 0 {
+		return q.wrongParams()
+	}
 	return QuitStatus
 }
 
@@ -342,7 +487,7 @@ func (n *NoopState) Process(line []byte) StateStatus {
 }
 
 func (n *NoopState) Write(conn *textproto.Conn) {
-	conn.PrintfLine(completeResp)
+	conn.PrintfLine("%s", completeResp)
 	logger.By(n.event.serverHostname).Debug(completeResp)
 }
 
@@ -352,6 +497,8 @@ func (n NoopState) IsUseCurrent() bool {
 
 type RsetState struct {
 	BaseState
+	// состояние до приветствия клиента
+	greet State
 }
 
 func (r *RsetState) GetCmd() ([]byte, int) {
@@ -359,15 +506,29 @@ func (r *RsetState) GetCmd() ([]byte, int) {
 }
 
 func (r *RsetState) Process(line []byte) StateStatus {
+	if len(bytes.TrimSpace(line[rsetCmdLen:])) > 0 {
+		return r.wrongParams()
+	}
 	r.event.message = nil
+	r.event.recipients = nil
+	r.event.verp = nil
 	return WriteStatus
 }
 
 func (r *RsetState) Write(conn *textproto.Conn) {
-	conn.PrintfLine(completeResp)
+	conn.PrintfLine("%s", completeResp)
 	logger.By(r.event.serverHostname).Debug(completeResp)
 }
 
+// до приветствия клиент должен поздороваться, после приветствия переходит к команде MAIL
+// состояние выбирается по соединению, т.к. состояния общие для всех соединений обработчика
+func (r *RsetState) GetNext() State {
+	if r.event.clientHostname == nil {
+		return r.greet
+	}
+	return r.next
+}
+
 type VrfyState struct {
 	BaseState
 }
@@ -376,19 +537,46 @@ func (v *VrfyState) GetCmd() ([]byte, int) {
 	return vrfyCmd, vrfyCmdLen
 }
 
+// адреса не проверяются, чтобы по ним нельзя было собрать список получателей, RFC 5321 3.5.3
 func (v *VrfyState) Process(line []byte) StateStatus {
-	if common.EmailRegexp.Match(line[vrfyCmdLen+1:]) {
-		return WriteStatus
-	} else {
-		return FailureStatus
+	if len(bytes.TrimSpace(line[vrfyCmdLen:])) == 0 {
+		return v.wrongParams()
 	}
+	return WriteStatus
 }
 
 func (v *VrfyState) Write(conn *textproto.Conn) {
-	conn.PrintfLine(completeResp)
-	logger.By(v.event.serverHostname).Debug(completeResp)
+	conn.PrintfLine("%s", attemptResp)
+	logger.By(v.event.serverHostname).Debug(attemptResp)
 }
 
 func (v VrfyState) IsUseCurrent() bool {
 	return true
 }
+
+type StartTlsState struct {
+	BaseState
+}
+
+func (s *StartTlsState) GetCmd() ([]byte, int) {
+	return tlsCmd, tlsCmdLen
+}
+
+func (s *StartTlsState) Process(line []byte) StateStatus {
+	if len(bytes.TrimSpace(line[tlsCmdLen:])) > 0 {
+		return s.wrongParams()
+	}
+	if s.event.tlsConfig == nil {
+		return s.fail(NotImplementedCode)
+	}
+	// повторно зашифровать соединение нельзя, RFC 3207 4.2
+	if s.event.tls {
+		return s.fail(BadSequenceCode)
+	}
+	return TlsStatus
+}
+
+func (s *StartTlsState) Write(conn *textproto.Conn) {
+	conn.PrintfLine("%s", startTlsResp)
+	logger.By(s.event.serverHostname).Debug(startTlsResp)
+}